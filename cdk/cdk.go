@@ -2,8 +2,11 @@ package main
 
 import (
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsdynamodb"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsec2"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awslambdaeventsources"
@@ -18,9 +21,43 @@ import (
 )
 
 type CDKStackProps struct {
+	// WeatherProvider is optional, either openweathermap (the default) or open-meteo, or both
+	// separated by a comma to fail over from one to the other.
+	WeatherProvider *string
+	// WeatherAPIKey and WeatherAPIEndpoint are for OpenWeatherMap, they're not needed for
+	// Open-Meteo.
 	WeatherAPIKey      *string
 	WeatherAPIEndpoint *string
-	StackProps         awscdk.StackProps
+	// WeatherAPICallsPerMinute is optional, it limits calls made by each instance of the message
+	// handler, or with WeatherAPIRateLimit set to dynamodb, by all of them together.
+	WeatherAPICallsPerMinute *string
+	WeatherAPIRateLimit      *string
+	// WeatherAPIForecastEndpoint and WeatherAPIHistoryEndpoint are optional, by default they're
+	// alongside WeatherAPIEndpoint.
+	WeatherAPIForecastEndpoint *string
+	WeatherAPIHistoryEndpoint  *string
+	// WeatherAPIUnits and WeatherAPILang are optional, they're the units and language used when a
+	// row doesn't set its own.
+	WeatherAPIUnits *string
+	WeatherAPILang  *string
+	// WeatherCache is optional, either memory to cache the weather in each instance of the message
+	// handler, or dynamodb to share it between them. WeatherCacheGrid, WeatherCacheTTL and
+	// WeatherCacheSize are optional too, see weathercache.Cache.
+	WeatherCache     *string
+	WeatherCacheGrid *string
+	WeatherCacheTTL  *string
+	WeatherCacheSize *string
+	// WeatherDataDedup is optional, when true rows of a file with the same coordinates are queued as
+	// one message. With WeatherDataDedupGrid, in decimal degrees, nearby coordinates are too.
+	WeatherDataDedup     *string
+	WeatherDataDedupGrid *string
+	// WeatherDataAllowDMS and WeatherDataAllowDecimalComma are optional, when true coordinates in
+	// degrees, minutes and seconds or with a decimal comma are accepted too.
+	WeatherDataAllowDMS          *string
+	WeatherDataAllowDecimalComma *string
+	// WeatherResultsFormat is optional, either jsonl (the default) or parquet.
+	WeatherResultsFormat *string
+	StackProps           awscdk.StackProps
 }
 
 func NewCDKStack(scope constructs.Construct, cdkProps CDKStackProps) awscdk.Stack {
@@ -49,16 +86,28 @@ func NewCDKStack(scope constructs.Construct, cdkProps CDKStackProps) awscdk.Stac
 		RetentionPeriod: awscdk.Duration_Days(jsii.Number(2)),
 	})
 
+	// the message handler needs to know when a message is on its last attempt, so it can record the
+	// row as failed before it moves to the DLQ.
+	maxReceiveCount := 10
 	weatherDataProcessingQueue := awssqs.NewQueue(stack, jsii.String("weatherDataProcessorQueue"), &awssqs.QueueProps{
 		Encryption:        awssqs.QueueEncryption_SQS_MANAGED,
 		EnforceSSL:        jsii.Bool(true),
 		VisibilityTimeout: awscdk.Duration_Minutes(jsii.Number(15)),
 		DeadLetterQueue: &awssqs.DeadLetterQueue{
-			MaxReceiveCount: jsii.Number(10),
+			MaxReceiveCount: jsii.Number(float64(maxReceiveCount)),
 			Queue:           weatherDataProcessingDLQ,
 		},
 	})
 
+	// tracks the progress of each uploaded file, so a manifest can be written once all rows are done.
+	jobsTable := awsdynamodb.NewTable(stack, jsii.String("weatherJobsTable"), &awsdynamodb.TableProps{
+		PartitionKey:        &awsdynamodb.Attribute{Name: jsii.String("pk"), Type: awsdynamodb.AttributeType_STRING},
+		SortKey:             &awsdynamodb.Attribute{Name: jsii.String("sk"), Type: awsdynamodb.AttributeType_STRING},
+		BillingMode:         awsdynamodb.BillingMode_PAY_PER_REQUEST,
+		Encryption:          awsdynamodb.TableEncryption_AWS_MANAGED,
+		TimeToLiveAttribute: jsii.String("expires_at"),
+	})
+
 	// this is the lambda function that will get invoked when a new file is created in the bucket.
 	onWeatherDataReceivedHandler := awslambdago.NewGoFunction(stack, jsii.String("onWeatherDataReceivedHandler"), &awslambdago.GoFunctionProps{
 		Runtime:      awslambda.Runtime_PROVIDED_AL2(),
@@ -70,23 +119,37 @@ func NewCDKStack(scope constructs.Construct, cdkProps CDKStackProps) awscdk.Stac
 		Environment: &map[string]*string{
 			"WEATHER_DATA_BUCKET_NAME":   dataBucket.BucketName(),
 			"WEATHER_DATA_SQS_QUEUE_URL": weatherDataProcessingQueue.QueueUrl(),
+			"WEATHER_JOBS_TABLE_NAME":    jobsTable.TableName(),
+			"WEATHER_RESULTS_PREFIX":     jsii.String("results"),
+			"WEATHER_REJECTS_PREFIX":     jsii.String("rejects"),
+			// number of workers queueing rows of a file concurrently.
+			"WEATHER_DATA_INGEST_CONCURRENCY": jsii.String("10"),
 		},
 		MemorySize: jsii.Number(1024),
-		Tracing:    awslambda.Tracing_ACTIVE,
-		Timeout:    awscdk.Duration_Millis(jsii.Number(60000)),
-		Vpc:        vpc,
+		// zip archives are copied to /tmp to be read.
+		EphemeralStorageSize: awscdk.Size_Gibibytes(jsii.Number(10)),
+		Tracing:              awslambda.Tracing_ACTIVE,
+		Timeout:              awscdk.Duration_Millis(jsii.Number(60000)),
+		Vpc:                  vpc,
 		VpcSubnets: &awsec2.SubnetSelection{
 			// we need a subnet that routes to the internet.
 			SubnetType: awsec2.SubnetType_PRIVATE_WITH_EGRESS,
 		},
 	})
 	dataBucket.GrantRead(onWeatherDataReceivedHandler, nil)
-	dataBucket.AddObjectCreatedNotification(awss3notifications.NewLambdaDestination(onWeatherDataReceivedHandler),
-		&awss3.NotificationKeyFilter{
-			Suffix: jsii.String(".csv"),
-			Prefix: jsii.String("weather-data"),
-		})
+	// a notification filter only takes one suffix, so there's one for each supported format.
+	for _, suffix := range []string{".csv", ".tsv", ".tab", ".jsonl", ".ndjson", ".geojson", ".gz", ".gzip", ".zst", ".zstd", ".zip"} {
+		dataBucket.AddObjectCreatedNotification(awss3notifications.NewLambdaDestination(onWeatherDataReceivedHandler),
+			&awss3.NotificationKeyFilter{
+				Suffix: jsii.String(suffix),
+				Prefix: jsii.String("weather-data"),
+			})
+	}
 	weatherDataProcessingQueue.GrantSendMessages(onWeatherDataReceivedHandler)
+	jobsTable.GrantReadWriteData(onWeatherDataReceivedHandler)
+	// an empty file is complete as soon as it's read, so this handler can write manifests too.
+	dataBucket.GrantPut(onWeatherDataReceivedHandler, jsii.String("results/*"))
+	dataBucket.GrantPut(onWeatherDataReceivedHandler, jsii.String("rejects/*"))
 
 	// this is the lambda function that will get invoked when a new SQS message arrives.
 	onMessageReceivedHandler := awslambdago.NewGoFunction(stack, jsii.String("onMessageReceivedHandler"), &awslambdago.GoFunctionProps{
@@ -97,16 +160,98 @@ func NewCDKStack(scope constructs.Construct, cdkProps CDKStackProps) awscdk.Stac
 			GoBuildFlags: &[]*string{jsii.String(`-ldflags "-s -w" -tags lambda.norpc`)},
 		},
 		Environment: &map[string]*string{
-			"WEATHER_API_ENDPOINT": cdkProps.WeatherAPIEndpoint,
-			"WEATHER_API_KEY":      cdkProps.WeatherAPIKey,
+			"WEATHER_DATA_BUCKET_NAME":       dataBucket.BucketName(),
+			"WEATHER_RESULTS_PREFIX":         jsii.String("results"),
+			"WEATHER_JOBS_TABLE_NAME":        jobsTable.TableName(),
+			"WEATHER_DATA_MAX_RECEIVE_COUNT": jsii.String(strconv.Itoa(maxReceiveCount)),
 		},
 		MemorySize: jsii.Number(1024),
 		Tracing:    awslambda.Tracing_ACTIVE,
 		Timeout:    awscdk.Duration_Millis(jsii.Number(60000)),
 		Vpc:        vpc,
 	})
+	if cdkProps.WeatherProvider != nil {
+		onMessageReceivedHandler.AddEnvironment(jsii.String("WEATHER_PROVIDER"), cdkProps.WeatherProvider, nil)
+		onWeatherDataReceivedHandler.AddEnvironment(jsii.String("WEATHER_PROVIDER"), cdkProps.WeatherProvider, nil)
+	}
+	if cdkProps.WeatherAPIEndpoint != nil {
+		onMessageReceivedHandler.AddEnvironment(jsii.String("WEATHER_API_ENDPOINT"), cdkProps.WeatherAPIEndpoint, nil)
+	}
+	if cdkProps.WeatherAPIKey != nil {
+		onMessageReceivedHandler.AddEnvironment(jsii.String("WEATHER_API_KEY"), cdkProps.WeatherAPIKey, nil)
+	}
+	if cdkProps.WeatherAPICallsPerMinute != nil {
+		onMessageReceivedHandler.AddEnvironment(jsii.String("WEATHER_API_CALLS_PER_MINUTE"), cdkProps.WeatherAPICallsPerMinute, nil)
+	}
+	if cdkProps.WeatherAPIRateLimit != nil {
+		onMessageReceivedHandler.AddEnvironment(jsii.String("WEATHER_API_RATE_LIMIT"), cdkProps.WeatherAPIRateLimit, nil)
+		if *cdkProps.WeatherAPIRateLimit == "dynamodb" {
+			rateLimitTable := awsdynamodb.NewTable(stack, jsii.String("weatherRateLimitTable"), &awsdynamodb.TableProps{
+				PartitionKey:        &awsdynamodb.Attribute{Name: jsii.String("pk"), Type: awsdynamodb.AttributeType_STRING},
+				BillingMode:         awsdynamodb.BillingMode_PAY_PER_REQUEST,
+				Encryption:          awsdynamodb.TableEncryption_AWS_MANAGED,
+				TimeToLiveAttribute: jsii.String("expires_at"),
+			})
+			onMessageReceivedHandler.AddEnvironment(jsii.String("WEATHER_API_RATE_LIMIT_TABLE_NAME"), rateLimitTable.TableName(), nil)
+			rateLimitTable.GrantReadWriteData(onMessageReceivedHandler)
+		}
+	}
+	if cdkProps.WeatherAPIForecastEndpoint != nil {
+		onMessageReceivedHandler.AddEnvironment(jsii.String("WEATHER_API_FORECAST_ENDPOINT"), cdkProps.WeatherAPIForecastEndpoint, nil)
+	}
+	if cdkProps.WeatherAPIHistoryEndpoint != nil {
+		onMessageReceivedHandler.AddEnvironment(jsii.String("WEATHER_API_HISTORY_ENDPOINT"), cdkProps.WeatherAPIHistoryEndpoint, nil)
+	}
+	if cdkProps.WeatherAPIUnits != nil {
+		onMessageReceivedHandler.AddEnvironment(jsii.String("WEATHER_API_UNITS"), cdkProps.WeatherAPIUnits, nil)
+	}
+	if cdkProps.WeatherAPILang != nil {
+		onMessageReceivedHandler.AddEnvironment(jsii.String("WEATHER_API_LANG"), cdkProps.WeatherAPILang, nil)
+	}
+	if cdkProps.WeatherCache != nil {
+		onMessageReceivedHandler.AddEnvironment(jsii.String("WEATHER_CACHE"), cdkProps.WeatherCache, nil)
+		if *cdkProps.WeatherCache == "dynamodb" {
+			cacheTable := awsdynamodb.NewTable(stack, jsii.String("weatherCacheTable"), &awsdynamodb.TableProps{
+				PartitionKey:        &awsdynamodb.Attribute{Name: jsii.String("pk"), Type: awsdynamodb.AttributeType_STRING},
+				BillingMode:         awsdynamodb.BillingMode_PAY_PER_REQUEST,
+				Encryption:          awsdynamodb.TableEncryption_AWS_MANAGED,
+				TimeToLiveAttribute: jsii.String("expires_at"),
+			})
+			onMessageReceivedHandler.AddEnvironment(jsii.String("WEATHER_CACHE_TABLE_NAME"), cacheTable.TableName(), nil)
+			cacheTable.GrantReadWriteData(onMessageReceivedHandler)
+		}
+	}
+	if cdkProps.WeatherCacheGrid != nil {
+		onMessageReceivedHandler.AddEnvironment(jsii.String("WEATHER_CACHE_GRID"), cdkProps.WeatherCacheGrid, nil)
+	}
+	if cdkProps.WeatherCacheTTL != nil {
+		onMessageReceivedHandler.AddEnvironment(jsii.String("WEATHER_CACHE_TTL"), cdkProps.WeatherCacheTTL, nil)
+	}
+	if cdkProps.WeatherCacheSize != nil {
+		onMessageReceivedHandler.AddEnvironment(jsii.String("WEATHER_CACHE_SIZE"), cdkProps.WeatherCacheSize, nil)
+	}
+	if cdkProps.WeatherDataDedup != nil {
+		onWeatherDataReceivedHandler.AddEnvironment(jsii.String("WEATHER_DATA_DEDUP"), cdkProps.WeatherDataDedup, nil)
+	}
+	if cdkProps.WeatherDataDedupGrid != nil {
+		onWeatherDataReceivedHandler.AddEnvironment(jsii.String("WEATHER_DATA_DEDUP_GRID"), cdkProps.WeatherDataDedupGrid, nil)
+	}
+	if cdkProps.WeatherDataAllowDMS != nil {
+		onWeatherDataReceivedHandler.AddEnvironment(jsii.String("WEATHER_DATA_ALLOW_DMS"), cdkProps.WeatherDataAllowDMS, nil)
+	}
+	if cdkProps.WeatherDataAllowDecimalComma != nil {
+		onWeatherDataReceivedHandler.AddEnvironment(jsii.String("WEATHER_DATA_ALLOW_DECIMAL_COMMA"), cdkProps.WeatherDataAllowDecimalComma, nil)
+	}
+	if cdkProps.WeatherResultsFormat != nil {
+		onMessageReceivedHandler.AddEnvironment(jsii.String("WEATHER_RESULTS_FORMAT"), cdkProps.WeatherResultsFormat, nil)
+		onWeatherDataReceivedHandler.AddEnvironment(jsii.String("WEATHER_RESULTS_FORMAT"), cdkProps.WeatherResultsFormat, nil)
+	}
+	dataBucket.GrantPut(onMessageReceivedHandler, jsii.String("results/*"))
+	jobsTable.GrantReadWriteData(onMessageReceivedHandler)
 	onMessageReceivedHandler.AddEventSource(awslambdaeventsources.NewSqsEventSource(weatherDataProcessingQueue, &awslambdaeventsources.SqsEventSourceProps{
-		BatchSize: jsii.Number(1),
+		// the handler reports failed messages individually, so only those are retried.
+		BatchSize:               jsii.Number(10),
+		ReportBatchItemFailures: jsii.Bool(true),
 	}))
 	awscdk.NewCfnOutput(stack, jsii.String("dataBucket"), &awscdk.CfnOutputProps{
 		Value:       dataBucket.BucketArn(),
@@ -129,13 +274,77 @@ func main() {
 	if awsAccount == "" {
 		panic("AWS_ACCOUNT_ID undefined")
 	}
-	weatherApiKey := os.Getenv("WEATHER_API_KEY")
-	if weatherApiKey == "" {
-		panic("WEATHER_API_KEY undefined")
+	var weatherProvider *string
+	if v := os.Getenv("WEATHER_PROVIDER"); v != "" {
+		weatherProvider = aws.String(v)
+	}
+	// Open-Meteo doesn't need an API key.
+	var weatherApiKey, weatherApiEndpoint *string
+	if v := os.Getenv("WEATHER_PROVIDER"); v == "" || strings.Contains(v, "openweathermap") {
+		if os.Getenv("WEATHER_API_KEY") == "" {
+			panic("WEATHER_API_KEY undefined")
+		}
+		if os.Getenv("WEATHER_API_ENDPOINT") == "" {
+			panic("WEATHER_API_ENDPOINT undefined")
+		}
+		weatherApiKey = aws.String(os.Getenv("WEATHER_API_KEY"))
+		weatherApiEndpoint = aws.String(os.Getenv("WEATHER_API_ENDPOINT"))
+	}
+
+	var weatherApiCallsPerMinute *string
+	if v := os.Getenv("WEATHER_API_CALLS_PER_MINUTE"); v != "" {
+		weatherApiCallsPerMinute = aws.String(v)
+	}
+	var weatherApiRateLimit *string
+	if v := os.Getenv("WEATHER_API_RATE_LIMIT"); v != "" {
+		weatherApiRateLimit = aws.String(v)
+	}
+	var weatherApiForecastEndpoint *string
+	if v := os.Getenv("WEATHER_API_FORECAST_ENDPOINT"); v != "" {
+		weatherApiForecastEndpoint = aws.String(v)
+	}
+	var weatherApiHistoryEndpoint *string
+	if v := os.Getenv("WEATHER_API_HISTORY_ENDPOINT"); v != "" {
+		weatherApiHistoryEndpoint = aws.String(v)
+	}
+	var weatherApiUnits *string
+	if v := os.Getenv("WEATHER_API_UNITS"); v != "" {
+		weatherApiUnits = aws.String(v)
+	}
+	var weatherApiLang *string
+	if v := os.Getenv("WEATHER_API_LANG"); v != "" {
+		weatherApiLang = aws.String(v)
+	}
+	var weatherCache, weatherCacheGrid, weatherCacheTTL, weatherCacheSize *string
+	if v := os.Getenv("WEATHER_CACHE"); v != "" {
+		weatherCache = aws.String(v)
+	}
+	if v := os.Getenv("WEATHER_CACHE_GRID"); v != "" {
+		weatherCacheGrid = aws.String(v)
+	}
+	if v := os.Getenv("WEATHER_CACHE_TTL"); v != "" {
+		weatherCacheTTL = aws.String(v)
+	}
+	if v := os.Getenv("WEATHER_CACHE_SIZE"); v != "" {
+		weatherCacheSize = aws.String(v)
+	}
+	var weatherDataDedup, weatherDataDedupGrid *string
+	if v := os.Getenv("WEATHER_DATA_DEDUP"); v != "" {
+		weatherDataDedup = aws.String(v)
+	}
+	if v := os.Getenv("WEATHER_DATA_DEDUP_GRID"); v != "" {
+		weatherDataDedupGrid = aws.String(v)
+	}
+	var weatherDataAllowDMS, weatherDataAllowDecimalComma *string
+	if v := os.Getenv("WEATHER_DATA_ALLOW_DMS"); v != "" {
+		weatherDataAllowDMS = aws.String(v)
+	}
+	if v := os.Getenv("WEATHER_DATA_ALLOW_DECIMAL_COMMA"); v != "" {
+		weatherDataAllowDecimalComma = aws.String(v)
 	}
-	weatherApiEndpoint := os.Getenv("WEATHER_API_ENDPOINT")
-	if weatherApiEndpoint == "" {
-		panic("WEATHER_API_ENDPOINT undefined")
+	var weatherResultsFormat *string
+	if v := os.Getenv("WEATHER_RESULTS_FORMAT"); v != "" {
+		weatherResultsFormat = aws.String(v)
 	}
 
 	app := awscdk.NewApp(nil)
@@ -146,8 +355,24 @@ func main() {
 				Account: aws.String(awsAccount),
 			},
 		},
-		WeatherAPIKey:      aws.String(weatherApiKey),
-		WeatherAPIEndpoint: aws.String(weatherApiEndpoint),
+		WeatherProvider:              weatherProvider,
+		WeatherAPIKey:                weatherApiKey,
+		WeatherAPIEndpoint:           weatherApiEndpoint,
+		WeatherAPICallsPerMinute:     weatherApiCallsPerMinute,
+		WeatherAPIRateLimit:          weatherApiRateLimit,
+		WeatherAPIForecastEndpoint:   weatherApiForecastEndpoint,
+		WeatherAPIHistoryEndpoint:    weatherApiHistoryEndpoint,
+		WeatherAPIUnits:              weatherApiUnits,
+		WeatherAPILang:               weatherApiLang,
+		WeatherCache:                 weatherCache,
+		WeatherCacheGrid:             weatherCacheGrid,
+		WeatherCacheTTL:              weatherCacheTTL,
+		WeatherCacheSize:             weatherCacheSize,
+		WeatherDataDedup:             weatherDataDedup,
+		WeatherDataDedupGrid:         weatherDataDedupGrid,
+		WeatherDataAllowDMS:          weatherDataAllowDMS,
+		WeatherDataAllowDecimalComma: weatherDataAllowDecimalComma,
+		WeatherResultsFormat:         weatherResultsFormat,
 	})
 	app.Synth(nil)
 }
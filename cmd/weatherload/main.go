@@ -0,0 +1,357 @@
+// Command weatherload runs a local file through the same pipeline as the Lambda functions, without
+// AWS: the rows are read by S3EventProcessor, queued in process and enriched by MessageProcessor,
+// and the results are written to stdout or a file.
+//
+//	weatherload -provider open-meteo -units metric weather-data/sample.csv > results.jsonl
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/antonielabuschagne/data-loader/event/processors"
+	"github.com/antonielabuschagne/data-loader/localfs"
+	"github.com/antonielabuschagne/data-loader/messagequeue"
+	"github.com/antonielabuschagne/data-loader/results"
+	"github.com/antonielabuschagne/data-loader/weatherapi"
+	"github.com/antonielabuschagne/data-loader/weathercache"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/joerdav/zapray"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const usage = `usage: weatherload [flags] <file>
+
+Loads the weather for every row of a local file, as if it had been uploaded to the data bucket.
+The file can be in any of the formats the bucket accepts, e.g. CSV, JSON Lines or a zip archive.
+
+`
+
+// config is what's set by the command line flags.
+type config struct {
+	input   string
+	out     string
+	rejects string
+	format  string
+	// concurrency is the number of workers reading the file, workers the number processing messages.
+	concurrency int
+	workers     int
+	// attempts is how many times a message is tried before it's given up on, retryDelay the time
+	// between tries.
+	attempts   int
+	retryDelay time.Duration
+	dedup      bool
+	dedupGrid  float64
+	// allowDMS and allowDecimalComma accept coordinates such as 44°20'30"N and 44,34.
+	allowDMS          bool
+	allowDecimalComma bool
+	cache             bool
+	cacheGrid         float64
+	defaults          weatherapi.Options
+}
+
+func main() {
+	var cfg config
+	var provider, apiKey, endpoint, units, lang string
+	var callsPerMinute int
+	var verbose bool
+	flag.StringVar(&cfg.out, "out", "-", "where to write the results, - for stdout; a directory for parquet")
+	flag.StringVar(&cfg.rejects, "rejects", "", "directory to write the rows that couldn't be queued to, as CSV named after the file they're from; by default they're only logged")
+	flag.StringVar(&cfg.format, "format", "jsonl", "format of the results, jsonl or parquet")
+	flag.IntVar(&cfg.concurrency, "concurrency", 1, "number of workers queueing rows of the file")
+	flag.IntVar(&cfg.workers, "workers", 1, "number of workers getting the weather")
+	flag.IntVar(&cfg.attempts, "attempts", 3, "number of times to try getting the weather for a row")
+	flag.DurationVar(&cfg.retryDelay, "retry-delay", time.Second, "time to wait before trying a row again")
+	flag.BoolVar(&cfg.dedup, "dedup", false, "queue rows wanting the same weather as one message")
+	flag.Float64Var(&cfg.dedupGrid, "dedup-grid", 0, "with -dedup, also combine coordinates in the same grid cell, in decimal degrees")
+	flag.BoolVar(&cfg.allowDMS, "allow-dms", false, "accept coordinates in degrees, minutes and seconds, e.g. 44°20'30\"N")
+	flag.BoolVar(&cfg.allowDecimalComma, "allow-decimal-comma", false, "accept coordinates with a decimal comma, e.g. 44,34")
+	flag.BoolVar(&cfg.cache, "cache", false, "cache the weather in memory")
+	flag.Float64Var(&cfg.cacheGrid, "cache-grid", 0, "with -cache, coordinates in the same grid cell share the weather, in decimal degrees")
+	flag.StringVar(&provider, "provider", os.Getenv("WEATHER_PROVIDER"), "openweathermap and/or open-meteo, in the order to try them")
+	flag.StringVar(&apiKey, "api-key", os.Getenv("WEATHER_API_KEY"), "OpenWeatherMap API key")
+	flag.StringVar(&endpoint, "endpoint", envOr("WEATHER_API_ENDPOINT", "https://api.openweathermap.org/data/2.5/weather"), "OpenWeatherMap current weather endpoint")
+	flag.StringVar(&units, "units", os.Getenv("WEATHER_API_UNITS"), "units used when a row doesn't set its own: standard, metric or imperial")
+	flag.StringVar(&lang, "lang", os.Getenv("WEATHER_API_LANG"), "language used when a row doesn't set its own, e.g. de")
+	flag.IntVar(&callsPerMinute, "calls-per-minute", 0, "limit calls to each weather provider, 0 for no limit")
+	flag.BoolVar(&verbose, "v", false, "log every row and message, not just warnings and errors")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cfg.input = flag.Arg(0)
+	// the processor only logs a file it can't read, so it's checked up front.
+	if _, err := os.Stat(cfg.input); err != nil {
+		fatal("%v", err)
+	}
+
+	level := zapcore.WarnLevel
+	if verbose {
+		level = zapcore.InfoLevel
+	}
+	zc := zap.NewProductionConfig()
+	zc.Level = zap.NewAtomicLevelAt(level)
+	zl, err := zc.Build()
+	if err != nil {
+		fatal("unable to build logger: %v", err)
+	}
+	log := zapray.NewLogger(zl)
+
+	cfg.defaults = weatherapi.DefaultOptions()
+	if u, err := weatherapi.ParseUnits(units); err != nil {
+		fatal("-units must be standard, metric or imperial")
+	} else if u != "" {
+		cfg.defaults.Units = u
+	}
+	if cfg.defaults.Lang, err = weatherapi.ParseLang(lang); err != nil {
+		fatal("-lang must be a language code, e.g. en or pt_br")
+	}
+	providerNames, err := weatherapi.ParseProviders(provider)
+	if err != nil {
+		fatal("-provider must be openweathermap and/or open-meteo, in the order to try them")
+	}
+	var providers []weatherapi.Provider
+	for _, name := range providerNames {
+		var limiter weatherapi.Limiter
+		if callsPerMinute > 0 {
+			limiter = weatherapi.NewTokenBucket(callsPerMinute, 1)
+		}
+		switch name {
+		case weatherapi.OpenMeteo:
+			oc, err := weatherapi.NewOpenMeteoClient(weatherapi.DefaultOpenMeteoURL, weatherapi.DefaultOpenMeteoArchiveURL, log)
+			if err != nil {
+				fatal("unable to build Open-Meteo client: %v", err)
+			}
+			oc.Limiter = limiter
+			oc.Defaults = cfg.defaults
+			providers = append(providers, &oc)
+		default:
+			if apiKey == "" {
+				fatal("OpenWeatherMap needs an API key, set -api-key or WEATHER_API_KEY, or use -provider open-meteo")
+			}
+			wc, err := weatherapi.NewWeatherAPIClient(apiKey, endpoint, log)
+			if err != nil {
+				fatal("unable to build weather API client: %v", err)
+			}
+			wc.Limiter = limiter
+			wc.Defaults = cfg.defaults
+			providers = append(providers, &wc)
+		}
+	}
+	var p weatherapi.Provider = providers[0]
+	if len(providers) > 1 {
+		p = weatherapi.NewFailover(log, providers...)
+	}
+
+	// parquet is written as a file per job and date, so it goes to a directory rather than one file.
+	out := io.Writer(os.Stdout)
+	if cfg.format == "parquet" && cfg.out == "-" {
+		fatal("-format parquet needs -out, the directory to write the results to")
+	}
+	if cfg.out != "-" && cfg.format != "parquet" {
+		f, err := os.Create(cfg.out)
+		if err != nil {
+			fatal("unable to create results file: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	s, err := run(ctx, log, cfg, weatherapi.WidestCoverage(providerNames), p.Observe, out)
+	fmt.Fprintf(os.Stderr, "%d rows queued as %d messages, %d rows rejected, %d messages failed\n", s.rows, s.messages, s.rejected, s.failed)
+	if err != nil {
+		stop()
+		fatal("%v", err)
+	}
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func fatal(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "weatherload: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// summary is the outcome of a run.
+type summary struct {
+	// rows is the number of rows queued, which can be more than the messages when they're deduplicated.
+	rows     int64
+	messages int64
+	rejected int64
+	failed   int64
+}
+
+// run reads the input file, queues its rows and gets the weather for each, writing the results to
+// out once every message has been processed, or for parquet to the cfg.out directory. Messages are
+// retried up to the number of attempts, those that still fail are counted in the summary and an
+// error is returned.
+func run(ctx context.Context, log *zapray.Logger, cfg config, coverage weatherapi.Coverage, fetch processors.WeatherFetcherFunc, out io.Writer) (s summary, err error) {
+	if cfg.cache {
+		cache := weathercache.NewCache(log, weatherapi.ObserveFunc(fetch), weathercache.NewLRU(100000))
+		cache.Grid = cfg.cacheGrid
+		fetch = cache.Observe
+	}
+	mp := processors.NewMessageProcessor(log, fetch)
+	mp.Defaults = cfg.defaults
+	switch cfg.format {
+	case "jsonl":
+		// every result goes to out, whichever job the sink would put it under, as JSON Lines can be
+		// joined together.
+		writeOut := func(ctx context.Context, key string, data []byte) (err error) {
+			_, err = out.Write(data)
+			return
+		}
+		mp.Sink = results.NewJSONLinesSink(writeOut, "")
+	case "parquet":
+		// a zip archive has a job for each file in it, and a run can cross midnight, so there can be
+		// several partitions; each is a complete Parquet file of its own.
+		mp.Sink = results.NewParquetSink(localfs.NewDirDataWriter(cfg.out), "")
+	default:
+		err = fmt.Errorf("unknown results format %q, expected jsonl or parquet", cfg.format)
+		return
+	}
+
+	queue := messagequeue.NewLocalQueue()
+	queue.MaxReceiveCount = cfg.attempts
+	// ingest is done once the file has been read and every row queued, from then on the workers stop
+	// as soon as the queue is empty.
+	ingested := make(chan struct{})
+	var wg sync.WaitGroup
+	workers := cfg.workers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			processQueue(ctx, log, queue, &mp, cfg.retryDelay, ingested)
+		}()
+	}
+
+	// the file is read from its directory, as it would be from the data bucket.
+	fetcher := localfs.NewDirDataFetcher(filepath.Dir(cfg.input))
+	ep := processors.NewS3EventProcessor(fetcher, queue.SendMessage, log)
+	ep.MessageBatchQueue = queue.SendMessageBatch
+	ep.Coverage = coverage
+	ep.Concurrency = cfg.concurrency
+	ep.Coordinates.AllowDMS = cfg.allowDMS
+	ep.Coordinates.AllowDecimalComma = cfg.allowDecimalComma
+	ep.Jobs = newCounter(&s.rows, &s.rejected)
+	if cfg.dedup {
+		opts := processors.DefaultDedupOptions()
+		opts.Grid = cfg.dedupGrid
+		ep.Dedup = &opts
+	}
+	// each file has rejects of its own, e.g. every file in a zip archive, so they're kept apart.
+	if cfg.rejects != "" {
+		ep.Rejects = localfs.NewDirDataWriter(cfg.rejects)
+		ep.RejectsPrefix = ""
+	}
+	messageIds, _ := ep.Process(ctx, events.S3Event{Records: []events.S3EventRecord{{
+		S3: events.S3Entity{Object: events.S3Object{Key: filepath.Base(cfg.input), URLDecodedKey: filepath.Base(cfg.input)}},
+	}}})
+	s.messages = int64(len(messageIds))
+	close(ingested)
+	wg.Wait()
+	s.failed = int64(len(queue.DeadLetters()))
+
+	if err = mp.Flush(ctx); err != nil {
+		return
+	}
+	switch {
+	case ctx.Err() != nil:
+		err = ctx.Err()
+	case s.failed > 0:
+		err = fmt.Errorf("unable to get the weather for %d messages", s.failed)
+	case s.rows == 0 && s.rejected == 0:
+		err = errors.New("no rows were read, check the file has column headings and is in a supported format")
+	}
+	return
+}
+
+// processQueue processes messages until the queue is empty once ingest is done. Messages that
+// fail are retried after the delay, until they're dead lettered.
+func processQueue(ctx context.Context, log *zapray.Logger, queue *messagequeue.LocalQueue, mp *processors.MessageProcessor, retryDelay time.Duration, ingested <-chan struct{}) {
+	for ctx.Err() == nil {
+		messages, err := queue.Receive(ctx, messagequeue.MaxBatchEntries)
+		if err != nil {
+			log.Error("unable to receive messages", zap.String("error", err.Error()))
+			return
+		}
+		if len(messages) == 0 {
+			select {
+			case <-ingested:
+				if queue.Len() == 0 {
+					return
+				}
+			default:
+			}
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		for _, m := range messages {
+			if err := mp.Process(ctx, m.Body); err != nil {
+				log.Warn("unable to process message", zap.String("messageId", m.MessageId), zap.String("receiveCount", m.Attributes["ApproximateReceiveCount"]), zap.String("error", err.Error()))
+				err = queue.ChangeVisibility(ctx, m.ReceiptHandle, retryDelay)
+			} else {
+				err = queue.Delete(ctx, m.ReceiptHandle)
+			}
+			if err != nil {
+				log.Error("unable to update message", zap.String("messageId", m.MessageId), zap.String("error", err.Error()))
+			}
+		}
+	}
+}
+
+// counter is a JobTracker counting the rows of the file. A zip archive has a job for each file in
+// it, so the rows rejected are counted by job, to be taken off that job's row count.
+type counter struct {
+	mu          sync.Mutex
+	queued      *int64
+	rejected    *int64
+	jobRejected map[string]int64
+}
+
+func newCounter(queued, rejected *int64) *counter {
+	return &counter{
+		queued:      queued,
+		rejected:    rejected,
+		jobRejected: make(map[string]int64),
+	}
+}
+
+func (c *counter) SetExpected(ctx context.Context, jobId, sourceKey string, expected int, truncated bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*c.queued += int64(expected) - c.jobRejected[jobId]
+	return nil
+}
+
+func (c *counter) RecordRow(ctx context.Context, jobId string, row int, succeeded bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.jobRejected[jobId]++
+	*c.rejected++
+	return nil
+}
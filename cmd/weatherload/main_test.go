@@ -0,0 +1,249 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/antonielabuschagne/data-loader/results"
+	"github.com/antonielabuschagne/data-loader/weatherapi"
+	"github.com/google/go-cmp/cmp"
+	"github.com/joerdav/zapray"
+)
+
+func TestRun(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+
+	tests := []struct {
+		description string
+		content     string
+		// zipped puts the content in a zip archive twice, as a.csv and b.csv.
+		zipped          bool
+		cfg             config
+		failLon         string
+		expectedRows    []int
+		expectedCalls   int64
+		expectedSummary summary
+		// expectedRejects are the files written to the rejects directory, by name.
+		expectedRejects map[string]string
+		expectedError   bool
+	}{
+		{
+			description:     "given a file, every row gets the weather",
+			content:         "lon,lat\n1,2\n3,4\n5,6\n",
+			cfg:             config{workers: 2},
+			expectedRows:    []int{1, 2, 3},
+			expectedCalls:   3,
+			expectedSummary: summary{rows: 3, messages: 3},
+		},
+		{
+			description:     "given repeated coordinates and dedup, they're looked up once and written for every row",
+			content:         "lon,lat\n1,2\n1,2\n3,4\n1,2\n",
+			cfg:             config{dedup: true},
+			expectedRows:    []int{1, 2, 3, 4},
+			expectedCalls:   2,
+			expectedSummary: summary{rows: 4, messages: 2},
+		},
+		{
+			description:     "given repeated coordinates and a cache, they're looked up once",
+			content:         "lon,lat\n1,2\n1,2\n1,2\n",
+			cfg:             config{cache: true},
+			expectedRows:    []int{1, 2, 3},
+			expectedCalls:   1,
+			expectedSummary: summary{rows: 3, messages: 3},
+		},
+		{
+			description:     "given coordinates in degrees, minutes and seconds or with a decimal comma when allowed, they're queued",
+			content:         "lon,lat\n18°25'E,33°55'S\n\"18,5\",\"-33,9\"\n",
+			cfg:             config{allowDMS: true, allowDecimalComma: true},
+			expectedRows:    []int{1, 2},
+			expectedCalls:   2,
+			expectedSummary: summary{rows: 2, messages: 2},
+		},
+		{
+			description:     "given coordinates in degrees, minutes and seconds or with a decimal comma by default, they're rejected",
+			content:         "lon,lat\n18°25'E,33°55'S\n\"18,5\",\"-33,9\"\n1,2\n",
+			expectedRows:    []int{3},
+			expectedCalls:   1,
+			expectedSummary: summary{rows: 1, messages: 1, rejected: 2},
+		},
+		{
+			description:     "given invalid rows, they're written to the rejects file",
+			content:         "lon,lat\n1,2\n,\n3,4\n",
+			cfg:             config{rejects: "rejects"},
+			expectedRows:    []int{1, 3},
+			expectedCalls:   2,
+			expectedSummary: summary{rows: 2, messages: 2, rejected: 1},
+			expectedRejects: map[string]string{
+				"data.csv": "line,reason,lon,lat\n3,\"row 2: invalid lon \"\"\"\": value is required\",,\n",
+			},
+		},
+		{
+			description:     "given a zip archive, the rows and rejects of each file are counted",
+			content:         "lon,lat\n1,2\n,\n3,4\n",
+			zipped:          true,
+			cfg:             config{rejects: "rejects"},
+			expectedRows:    []int{1, 1, 3, 3},
+			expectedCalls:   4,
+			expectedSummary: summary{rows: 4, messages: 4, rejected: 2},
+			expectedRejects: map[string]string{
+				"data.zip/a.csv": "line,reason,lon,lat\n3,\"row 2: invalid lon \"\"\"\": value is required\",,\n",
+				"data.zip/b.csv": "line,reason,lon,lat\n3,\"row 2: invalid lon \"\"\"\": value is required\",,\n",
+			},
+		},
+		{
+			description:     "given the weather can't be got for a row, it's retried then the rest are written and an error returned",
+			content:         "lon,lat\n1,2\n3,4\n",
+			cfg:             config{attempts: 3},
+			failLon:         "3",
+			expectedRows:    []int{1},
+			expectedCalls:   4,
+			expectedSummary: summary{rows: 2, messages: 2, failed: 1},
+			expectedError:   true,
+		},
+		{
+			description:   "given a file without coordinates, an error is returned",
+			content:       "name\nA\n",
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		dir := t.TempDir()
+		tt.cfg.input = filepath.Join(dir, "data.csv")
+		data := []byte(tt.content)
+		if tt.zipped {
+			tt.cfg.input = filepath.Join(dir, "data.zip")
+			data = zipOf(t, map[string]string{"a.csv": tt.content, "b.csv": tt.content})
+		}
+		if err := os.WriteFile(tt.cfg.input, data, 0o644); err != nil {
+			t.Fatalf("%s: unable to write input: %v", tt.description, err)
+		}
+		if tt.cfg.rejects != "" {
+			tt.cfg.rejects = filepath.Join(dir, tt.cfg.rejects)
+		}
+		tt.cfg.format = "jsonl"
+		if tt.cfg.attempts == 0 {
+			tt.cfg.attempts = 1
+		}
+		tt.cfg.defaults = weatherapi.DefaultOptions()
+		var calls int64
+		fetch := func(ctx context.Context, lon, lat string, opts weatherapi.Options) (o weatherapi.Observation, err error) {
+			atomic.AddInt64(&calls, 1)
+			if lon == tt.failLon {
+				err = errors.New("rate limit exceeded")
+				return
+			}
+			o.Provider = weatherapi.OpenMeteo
+			return
+		}
+		var out bytes.Buffer
+		s, err := run(context.Background(), logger, tt.cfg, weatherapi.OpenMeteoCoverage, fetch, &out)
+		if (err != nil) != tt.expectedError {
+			t.Errorf("%s: unexpected error %v", tt.description, err)
+		}
+		if s != tt.expectedSummary {
+			t.Errorf("%s: got summary %+v, expected %+v", tt.description, s, tt.expectedSummary)
+		}
+		if calls != tt.expectedCalls {
+			t.Errorf("%s: got %d weather calls, expected %d", tt.description, calls, tt.expectedCalls)
+		}
+		var rows []int
+		scanner := bufio.NewScanner(&out)
+		for scanner.Scan() {
+			var r results.Record
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				t.Fatalf("%s: unable to decode result %q: %v", tt.description, scanner.Text(), err)
+			}
+			rows = append(rows, r.Request.Row)
+		}
+		sort.Ints(rows)
+		if !cmp.Equal(rows, tt.expectedRows) {
+			t.Errorf("%s: got results for rows %v, expected %v", tt.description, rows, tt.expectedRows)
+		}
+		if tt.expectedRejects == nil {
+			continue
+		}
+		rejects := map[string]string{}
+		filepath.WalkDir(tt.cfg.rejects, func(name string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			data, err := os.ReadFile(name)
+			rel, _ := filepath.Rel(tt.cfg.rejects, name)
+			rejects[filepath.ToSlash(rel)] = strings.ReplaceAll(string(data), "\r\n", "\n")
+			return err
+		})
+		if diff := cmp.Diff(tt.expectedRejects, rejects); diff != "" {
+			t.Errorf("%s: unexpected rejects: %s", tt.description, diff)
+		}
+	}
+}
+
+func TestRunParquet(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+	dir := t.TempDir()
+	archive := zipOf(t, map[string]string{"a.csv": "lon,lat\n1,2\n3,4\n", "b.csv": "lon,lat\n1,2\n3,4\n"})
+	cfg := config{
+		input:    filepath.Join(dir, "data.zip"),
+		out:      filepath.Join(dir, "results"),
+		format:   "parquet",
+		attempts: 1,
+		defaults: weatherapi.DefaultOptions(),
+	}
+	if err := os.WriteFile(cfg.input, archive, 0o644); err != nil {
+		t.Fatalf("unable to write input: %v", err)
+	}
+	fetch := func(ctx context.Context, lon, lat string, opts weatherapi.Options) (o weatherapi.Observation, err error) {
+		return
+	}
+	if _, err := run(context.Background(), logger, cfg, weatherapi.OpenMeteoCoverage, fetch, nil); err != nil {
+		t.Fatalf("unable to run: %v", err)
+	}
+	// each file in the archive is a job of its own, so gets a Parquet file of its own.
+	files, err := filepath.Glob(filepath.Join(cfg.out, "job=*", "date=*", "*.parquet"))
+	if err != nil {
+		t.Fatalf("unable to list results: %v", err)
+	}
+	if len(files) != 2 {
+		t.Errorf("got %d Parquet files %v, expected one for each job", len(files), files)
+	}
+}
+
+// zipOf returns a zip archive of the files, in name order.
+func zipOf(t *testing.T, files map[string]string) []byte {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, name := range names {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("unable to add %s: %v", name, err)
+		}
+		w.Write([]byte(files[name]))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("unable to write archive: %v", err)
+	}
+	return archive.Bytes()
+}
@@ -2,12 +2,22 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"net/url"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/antonielabuschagne/data-loader/event/processors"
+	"github.com/antonielabuschagne/data-loader/jobs"
+	"github.com/antonielabuschagne/data-loader/results"
+	"github.com/antonielabuschagne/data-loader/s3client"
 	"github.com/antonielabuschagne/data-loader/weatherapi"
+	"github.com/antonielabuschagne/data-loader/weathercache"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/joerdav/zapray"
 	"go.uber.org/zap"
 )
@@ -17,6 +27,95 @@ func main() {
 	if err != nil {
 		panic("unable to build logger")
 	}
+	defaults := weatherapi.DefaultOptions()
+	if defaults.Units, err = weatherapi.ParseUnits(os.Getenv("WEATHER_API_UNITS")); err != nil {
+		panic("WEATHER_API_UNITS must be standard, metric or imperial")
+	}
+	if defaults.Units == "" {
+		defaults.Units = weatherapi.UnitsStandard
+	}
+	if defaults.Lang, err = weatherapi.ParseLang(os.Getenv("WEATHER_API_LANG")); err != nil {
+		panic("WEATHER_API_LANG must be a language code, e.g. en or pt_br")
+	}
+	var callsPerMinute int
+	if v := os.Getenv("WEATHER_API_CALLS_PER_MINUTE"); v != "" {
+		if callsPerMinute, err = strconv.Atoi(v); err != nil || callsPerMinute < 1 {
+			panic("WEATHER_API_CALLS_PER_MINUTE must be a positive number")
+		}
+	}
+	providerNames, err := weatherapi.ParseProviders(os.Getenv("WEATHER_PROVIDER"))
+	if err != nil {
+		panic("WEATHER_PROVIDER must be openweathermap and/or open-meteo, in the order to try them")
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		panic("error loading config")
+	}
+	limiterBackend := newLimiterBackend(cfg)
+	// with more than one provider, the next is tried whenever one fails.
+	var providers []weatherapi.Provider
+	for _, name := range providerNames {
+		var limiter weatherapi.Limiter
+		switch {
+		case callsPerMinute == 0:
+		case limiterBackend != nil:
+			limiter = weatherapi.NewSharedLimiter(limiterBackend, string(name), callsPerMinute)
+		default:
+			limiter = weatherapi.NewTokenBucket(callsPerMinute, 1)
+		}
+		switch name {
+		case weatherapi.OpenMeteo:
+			providers = append(providers, newOpenMeteoClient(log, limiter, defaults))
+		default:
+			providers = append(providers, newOpenWeatherMapClient(log, limiter, defaults))
+		}
+	}
+	var provider weatherapi.Provider = providers[0]
+	if len(providers) > 1 {
+		provider = weatherapi.NewFailover(log, providers...)
+	}
+	mp := processors.NewMessageProcessor(log, provider.Observe)
+	mp.Defaults = defaults
+	cache := newCache(log, cfg, provider)
+	if cache != nil {
+		mp.WeatherClient = cache.Observe
+	}
+	bucket := os.Getenv("WEATHER_DATA_BUCKET_NAME")
+	if bucket == "" {
+		panic("WEATHER_DATA_BUCKET_NAME not configured")
+	}
+	resultsPrefix := os.Getenv("WEATHER_RESULTS_PREFIX")
+	if resultsPrefix == "" {
+		resultsPrefix = "results"
+	}
+	jobsTable := os.Getenv("WEATHER_JOBS_TABLE_NAME")
+	if jobsTable == "" {
+		panic("WEATHER_JOBS_TABLE_NAME not configured")
+	}
+	maxReceiveCount, err := strconv.Atoi(os.Getenv("WEATHER_DATA_MAX_RECEIVE_COUNT"))
+	if err != nil {
+		panic("WEATHER_DATA_MAX_RECEIVE_COUNT not configured")
+	}
+	writer := s3client.NewS3DataWriter(cfg, bucket)
+	tracker := jobs.NewTracker(jobs.NewDynamoDBStore(cfg, jobsTable), writer, resultsPrefix)
+	switch format := os.Getenv("WEATHER_RESULTS_FORMAT"); format {
+	case "", "jsonl":
+		mp.Sink = results.NewJSONLinesSink(writer, resultsPrefix)
+	case "parquet":
+		sink := results.NewParquetSink(writer, resultsPrefix)
+		mp.Sink = sink
+		tracker.JobPrefix = sink.JobPrefix
+	default:
+		panic("WEATHER_RESULTS_FORMAT must be jsonl or parquet")
+	}
+	h := NewHandler(log, mp)
+	h.Jobs = tracker
+	h.MaxReceiveCount = maxReceiveCount
+	h.Cache = cache
+	lambda.Start(h.handler)
+}
+
+func newOpenWeatherMapClient(log *zapray.Logger, limiter weatherapi.Limiter, defaults weatherapi.Options) *weatherapi.WeatherAPIClient {
 	weatherApiEndpoint := os.Getenv("WEATHER_API_ENDPOINT")
 	if weatherApiEndpoint == "" {
 		panic("WEATHER_API_ENDPOINT not configured")
@@ -29,36 +128,231 @@ func main() {
 	if err != nil {
 		panic("unable to build weather API client")
 	}
-	mp := processors.NewMessageProcessor(log, wc.GetWeatherForLatLong)
-	h := NewHandler(log, mp)
-	lambda.Start(h.handler)
+	if v := os.Getenv("WEATHER_API_FORECAST_ENDPOINT"); v != "" {
+		if wc.ForecastURL, err = url.Parse(v); err != nil {
+			panic("WEATHER_API_FORECAST_ENDPOINT must be a URL")
+		}
+	}
+	if v := os.Getenv("WEATHER_API_HISTORY_ENDPOINT"); v != "" {
+		if wc.HistoryURL, err = url.Parse(v); err != nil {
+			panic("WEATHER_API_HISTORY_ENDPOINT must be a URL")
+		}
+	}
+	wc.Limiter = limiter
+	wc.Defaults = defaults
+	return &wc
+}
+
+func newOpenMeteoClient(log *zapray.Logger, limiter weatherapi.Limiter, defaults weatherapi.Options) *weatherapi.OpenMeteoClient {
+	endpoint := os.Getenv("OPEN_METEO_ENDPOINT")
+	if endpoint == "" {
+		endpoint = weatherapi.DefaultOpenMeteoURL
+	}
+	archiveEndpoint := os.Getenv("OPEN_METEO_ARCHIVE_ENDPOINT")
+	if archiveEndpoint == "" {
+		archiveEndpoint = weatherapi.DefaultOpenMeteoArchiveURL
+	}
+	oc, err := weatherapi.NewOpenMeteoClient(endpoint, archiveEndpoint, log)
+	if err != nil {
+		panic("unable to build Open-Meteo client")
+	}
+	oc.Limiter = limiter
+	oc.Defaults = defaults
+	return &oc
+}
+
+// newLimiterBackend returns the backend configured by WEATHER_API_RATE_LIMIT for limiting calls to
+// the weather API across every instance of the handler, or nil when each instance is limited on its
+// own to WEATHER_API_CALLS_PER_MINUTE.
+func newLimiterBackend(cfg aws.Config) weatherapi.LimiterBackend {
+	switch os.Getenv("WEATHER_API_RATE_LIMIT") {
+	case "":
+		return nil
+	case "dynamodb":
+		tableName := os.Getenv("WEATHER_API_RATE_LIMIT_TABLE_NAME")
+		if tableName == "" {
+			panic("WEATHER_API_RATE_LIMIT_TABLE_NAME not configured")
+		}
+		return weatherapi.NewDynamoDBLimiterBackend(cfg, tableName)
+	default:
+		panic("WEATHER_API_RATE_LIMIT must be dynamodb, or empty to limit each instance on its own")
+	}
+}
+
+// newCache returns the cache configured by WEATHER_CACHE, or nil when the weather isn't cached.
+func newCache(log *zapray.Logger, cfg aws.Config, provider weatherapi.Provider) *weathercache.Cache {
+	var backend weathercache.Backend
+	switch os.Getenv("WEATHER_CACHE") {
+	case "":
+		return nil
+	case "memory":
+		size := 10000
+		if v := os.Getenv("WEATHER_CACHE_SIZE"); v != "" {
+			var err error
+			if size, err = strconv.Atoi(v); err != nil || size < 1 {
+				panic("WEATHER_CACHE_SIZE must be a positive number")
+			}
+		}
+		backend = weathercache.NewLRU(size)
+	case "dynamodb":
+		tableName := os.Getenv("WEATHER_CACHE_TABLE_NAME")
+		if tableName == "" {
+			panic("WEATHER_CACHE_TABLE_NAME not configured")
+		}
+		backend = weathercache.NewDynamoDBBackend(cfg, tableName)
+	default:
+		panic("WEATHER_CACHE must be memory or dynamodb")
+	}
+	cache := weathercache.NewCache(log, provider.Observe, backend)
+	if v := os.Getenv("WEATHER_CACHE_GRID"); v != "" {
+		grid, err := strconv.ParseFloat(v, 64)
+		if err != nil || grid < 0 {
+			panic("WEATHER_CACHE_GRID must be a size in decimal degrees, e.g. 0.01")
+		}
+		cache.Grid = grid
+	}
+	if v := os.Getenv("WEATHER_CACHE_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			panic("WEATHER_CACHE_TTL must be a duration, e.g. 30m")
+		}
+		cache.TTL = ttl
+	}
+	return cache
 }
 
 type Handler struct {
 	Log              *zapray.Logger
 	MessageProcessor processors.MessageProcessor
+	// Jobs is optional. When set, the outcome of each row is recorded once it's final: as soon as
+	// it succeeds, or on the last delivery attempt before SQS moves it to the dead letter queue.
+	Jobs            processors.JobTracker
+	MaxReceiveCount int
+	// Cache is optional, its hits and misses are logged with each batch. They're counted from when
+	// the function started, so across every batch handled by a warm Lambda function.
+	Cache *weathercache.Cache
+	// DeadlineMargin is how long before the context deadline to stop processing messages, leaving
+	// time to flush the results of those already processed. The rest are reported as failures.
+	DeadlineMargin time.Duration
 }
 
 func NewHandler(log *zapray.Logger, mp processors.MessageProcessor) Handler {
 	return Handler{
 		Log:              log,
 		MessageProcessor: mp,
+		DeadlineMargin:   10 * time.Second,
 	}
 }
 
-func (h *Handler) handler(ctx context.Context, e events.SQSEvent) (err error) {
+// rowOutcome is the final result of a message, to be recorded against its job for every row it
+// serves.
+type rowOutcome struct {
+	messageId string
+	jobId     string
+	rows      []int
+	succeeded bool
+}
+
+// handler processes each message independently and reports back only the ones that failed, so
+// SQS retries those rather than the whole batch.
+func (h *Handler) handler(ctx context.Context, e events.SQSEvent) (res events.SQSEventResponse, err error) {
 	log := h.Log
 	mp := h.MessageProcessor
 	log.Info("starting handler", zap.Int("records", len(e.Records)))
-	processed := make([]string, len(e.Records))
-	for _, r := range e.Records {
-		err = mp.Process(ctx, r.Body)
-		if err != nil {
-			log.Error("unable to process message", zap.String("error", err.Error()))
-			return
+	var processed []rowOutcome
+	var finalFailures []rowOutcome
+	var permanentFailures []rowOutcome
+	// messages stop being processed a little before the deadline, so the results of those already
+	// processed can still be flushed rather than the whole batch being delivered again.
+	processCtx := ctx
+	if deadline, ok := ctx.Deadline(); ok && h.DeadlineMargin > 0 {
+		var cancel context.CancelFunc
+		processCtx, cancel = context.WithDeadline(ctx, deadline.Add(-h.DeadlineMargin))
+		defer cancel()
+	}
+	for i, r := range e.Records {
+		outcome := newRowOutcome(r)
+		if processCtx.Err() != nil {
+			log.Warn("stopping before the deadline", zap.Int("remaining", len(e.Records)-i))
+			for _, r := range e.Records[i:] {
+				res.BatchItemFailures = append(res.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: r.MessageId})
+				if h.isFinalAttempt(r) {
+					finalFailures = append(finalFailures, newRowOutcome(r))
+				}
+			}
+			break
+		}
+		if err := mp.Process(processCtx, r.Body); err != nil {
+			log.Error("unable to process message", zap.String("messageId", r.MessageId), zap.String("error", err.Error()))
+			// the API won't answer any differently next time, so the row fails now rather than after
+			// every delivery attempt.
+			if weatherapi.IsPermanent(err) {
+				permanentFailures = append(permanentFailures, outcome)
+				continue
+			}
+			res.BatchItemFailures = append(res.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: r.MessageId})
+			if h.isFinalAttempt(r) {
+				finalFailures = append(finalFailures, outcome)
+			}
+			continue
+		}
+		outcome.succeeded = true
+		processed = append(processed, outcome)
+	}
+	// results are only durable once flushed, so if that fails every message has to be retried.
+	if err := mp.Flush(ctx); err != nil {
+		log.Error("unable to write weather results", zap.String("error", err.Error()))
+		for _, o := range processed {
+			res.BatchItemFailures = append(res.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: o.messageId})
+		}
+		processed = nil
+	}
+	res.BatchItemFailures = append(res.BatchItemFailures, h.recordOutcomes(ctx, processed)...)
+	res.BatchItemFailures = append(res.BatchItemFailures, h.recordOutcomes(ctx, permanentFailures)...)
+	h.recordOutcomes(ctx, finalFailures)
+	fields := []zap.Field{zap.Int("count", len(processed)), zap.Int("failed", len(res.BatchItemFailures))}
+	if h.Cache != nil {
+		stats := h.Cache.Stats()
+		fields = append(fields, zap.Int64("cacheHits", stats.Hits), zap.Int64("cacheMisses", stats.Misses), zap.Int64("cacheErrors", stats.Errors))
+	}
+	log.Info("weather requests processed", fields...)
+	return
+}
+
+func newRowOutcome(r events.SQSMessage) (o rowOutcome) {
+	o.messageId = r.MessageId
+	var req weatherapi.WeatherAPIRequest
+	if err := json.Unmarshal([]byte(r.Body), &req); err == nil {
+		o.jobId = req.JobId
+		for _, r := range req.FanOut() {
+			o.rows = append(o.rows, r.Row)
+		}
+	}
+	return
+}
+
+func (h *Handler) isFinalAttempt(r events.SQSMessage) bool {
+	count, err := strconv.Atoi(r.Attributes["ApproximateReceiveCount"])
+	return err == nil && h.MaxReceiveCount > 0 && count >= h.MaxReceiveCount
+}
+
+// recordOutcomes records each outcome against its job, returning the messages that need to be
+// retried because their outcome couldn't be recorded.
+func (h *Handler) recordOutcomes(ctx context.Context, outcomes []rowOutcome) (failures []events.SQSBatchItemFailure) {
+	if h.Jobs == nil {
+		return
+	}
+	for _, o := range outcomes {
+		if o.jobId == "" {
+			continue
+		}
+		for _, row := range o.rows {
+			if err := h.Jobs.RecordRow(ctx, o.jobId, row, o.succeeded); err != nil {
+				h.Log.Error("unable to record row outcome", zap.String("error", err.Error()), zap.String("jobId", o.jobId), zap.Int("row", row))
+				failures = append(failures, events.SQSBatchItemFailure{ItemIdentifier: o.messageId})
+				break
+			}
 		}
-		processed = append(processed, r.MessageId)
 	}
-	log.Info("weather requests processed", zap.Int("count", len(processed)))
 	return
 }
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/antonielabuschagne/data-loader/event/processors"
+	"github.com/antonielabuschagne/data-loader/results"
+	"github.com/antonielabuschagne/data-loader/weatherapi"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/go-cmp/cmp"
+	"github.com/joerdav/zapray"
+)
+
+func TestHandler(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+
+	tests := []struct {
+		description      string
+		weatherFetcher   processors.WeatherFetcherFunc
+		event            events.SQSEvent
+		expectedFailures []events.SQSBatchItemFailure
+	}{
+		{
+			description: "given all messages succeed, no failures reported",
+			weatherFetcher: func(ctx context.Context, lon, lat string, opts weatherapi.Options) (result weatherapi.Observation, err error) {
+				result = weatherapi.Observation{Conditions: []weatherapi.Condition{{Description: "warm"}}}
+				return
+			},
+			event: events.SQSEvent{Records: []events.SQSMessage{
+				{MessageId: "1", Body: `{"lat": "1", "lon": "2"}`},
+				{MessageId: "2", Body: `{"lat": "3", "lon": "4"}`},
+			}},
+		},
+		{
+			description: "given some messages fail, only those are reported",
+			weatherFetcher: func(ctx context.Context, lon, lat string, opts weatherapi.Options) (result weatherapi.Observation, err error) {
+				if lat == "3" {
+					err = errors.New("rate limit exceeded")
+					return
+				}
+				result = weatherapi.Observation{Conditions: []weatherapi.Condition{{Description: "warm"}}}
+				return
+			},
+			event: events.SQSEvent{Records: []events.SQSMessage{
+				{MessageId: "1", Body: `{"lat": "1", "lon": "2"}`},
+				{MessageId: "2", Body: `{"lat": "3", "lon": "4"}`},
+				{MessageId: "3", Body: `{"lat": "5"}`},
+				{MessageId: "4", Body: `{"lat": "6", "lon": "7"}`},
+			}},
+			expectedFailures: []events.SQSBatchItemFailure{{ItemIdentifier: "2"}, {ItemIdentifier: "3"}},
+		},
+	}
+
+	for _, tt := range tests {
+		h := NewHandler(logger, processors.NewMessageProcessor(logger, tt.weatherFetcher))
+		res, err := h.handler(context.Background(), tt.event)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.description, err)
+		}
+		if !cmp.Equal(res.BatchItemFailures, tt.expectedFailures) {
+			t.Errorf("%s: got failures %v, expected %v", tt.description, res.BatchItemFailures, tt.expectedFailures)
+		}
+	}
+}
+
+type failingSink struct{}
+
+func (failingSink) Write(ctx context.Context, r results.Record) error { return nil }
+func (failingSink) Flush(ctx context.Context) error                   { return errors.New("access denied") }
+
+func TestHandlerFlushFailure(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+	mp := processors.NewMessageProcessor(logger, func(ctx context.Context, lon, lat string, opts weatherapi.Options) (result weatherapi.Observation, err error) {
+		return
+	})
+	mp.Sink = failingSink{}
+	h := NewHandler(logger, mp)
+	res, err := h.handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "1", Body: `{"lat": "1", "lon": "2"}`},
+		{MessageId: "2", Body: `{"lat": "3"}`},
+		{MessageId: "3", Body: `{"lat": "4", "lon": "5"}`},
+	}})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	expected := []events.SQSBatchItemFailure{{ItemIdentifier: "2"}, {ItemIdentifier: "1"}, {ItemIdentifier: "3"}}
+	if !cmp.Equal(res.BatchItemFailures, expected) {
+		t.Errorf("got failures %v, expected %v", res.BatchItemFailures, expected)
+	}
+}
+
+type recordingJobTracker struct {
+	rows map[int]bool
+}
+
+func (r *recordingJobTracker) SetExpected(ctx context.Context, jobId, sourceKey string, expected int, truncated bool) error {
+	return nil
+}
+
+func (r *recordingJobTracker) RecordRow(ctx context.Context, jobId string, row int, succeeded bool) error {
+	r.rows[row] = succeeded
+	return nil
+}
+
+func TestHandlerJobs(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+	mp := processors.NewMessageProcessor(logger, func(ctx context.Context, lon, lat string, opts weatherapi.Options) (result weatherapi.Observation, err error) {
+		if lon == "0" {
+			err = errors.New("rate limit exceeded")
+		}
+		return
+	})
+	tracker := &recordingJobTracker{rows: map[int]bool{}}
+	h := NewHandler(logger, mp)
+	h.Jobs = tracker
+	h.MaxReceiveCount = 3
+	_, err = h.handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "1", Body: `{"lat": "1", "lon": "2", "job_id": "job", "row": 1}`},
+		{MessageId: "2", Body: `{"lat": "1", "lon": "0", "job_id": "job", "row": 2}`, Attributes: map[string]string{"ApproximateReceiveCount": "1"}},
+		{MessageId: "3", Body: `{"lat": "1", "lon": "0", "job_id": "job", "row": 3}`, Attributes: map[string]string{"ApproximateReceiveCount": "3"}},
+		{MessageId: "4", Body: `{"lat": "1", "lon": "2", "job_id": "job", "row": 4, "rows": [{"row": 5, "lat": "1", "lon": "2"}, {"row": 7, "lat": "1", "lon": "2"}]}`},
+	}})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// row 2 will be retried, so only the successes and the final failure are recorded, including
+	// the rows served by a deduplicated message.
+	expected := map[int]bool{1: true, 3: false, 4: true, 5: true, 7: true}
+	if !cmp.Equal(tracker.rows, expected) {
+		t.Errorf("got rows %v, expected %v", tracker.rows, expected)
+	}
+}
+
+func TestHandlerPermanentFailure(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+	mp := processors.NewMessageProcessor(logger, func(ctx context.Context, lon, lat string, opts weatherapi.Options) (result weatherapi.Observation, err error) {
+		switch lon {
+		case "0":
+			err = &weatherapi.APIError{StatusCode: http.StatusNotFound, Body: "city not found"}
+		case "9":
+			err = &weatherapi.APIError{StatusCode: http.StatusServiceUnavailable}
+		}
+		return
+	})
+	tracker := &recordingJobTracker{rows: map[int]bool{}}
+	h := NewHandler(logger, mp)
+	h.Jobs = tracker
+	h.MaxReceiveCount = 3
+	res, err := h.handler(context.Background(), events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "1", Body: `{"lat": "1", "lon": "2", "job_id": "job", "row": 1}`},
+		{MessageId: "2", Body: `{"lat": "1", "lon": "0", "job_id": "job", "row": 2, "rows": [{"row": 4, "lat": "1", "lon": "0"}]}`, Attributes: map[string]string{"ApproximateReceiveCount": "1"}},
+		{MessageId: "3", Body: `{"lat": "1", "lon": "9", "job_id": "job", "row": 3}`, Attributes: map[string]string{"ApproximateReceiveCount": "1"}},
+	}})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// the unknown location fails on its first attempt and isn't retried, the unavailable API is.
+	expectedFailures := []events.SQSBatchItemFailure{{ItemIdentifier: "3"}}
+	if !cmp.Equal(res.BatchItemFailures, expectedFailures) {
+		t.Errorf("got failures %v, expected %v", res.BatchItemFailures, expectedFailures)
+	}
+	expectedRows := map[int]bool{1: true, 2: false, 4: false}
+	if !cmp.Equal(tracker.rows, expectedRows) {
+		t.Errorf("got rows %v, expected %v", tracker.rows, expectedRows)
+	}
+}
+
+func TestHandlerDeadline(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+	mp := processors.NewMessageProcessor(logger, func(ctx context.Context, lon, lat string, opts weatherapi.Options) (result weatherapi.Observation, err error) {
+		// every lookup is slow, so the deadline is reached part way through the batch.
+		select {
+		case <-time.After(60 * time.Millisecond):
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		return
+	})
+	sink := &countingSink{}
+	mp.Sink = sink
+	tracker := &recordingJobTracker{rows: map[int]bool{}}
+	h := NewHandler(logger, mp)
+	h.Jobs = tracker
+	h.MaxReceiveCount = 3
+	h.DeadlineMargin = 200 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 350*time.Millisecond)
+	defer cancel()
+	res, err := h.handler(ctx, events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "1", Body: `{"lat": "1", "lon": "2", "job_id": "job", "row": 1}`},
+		{MessageId: "2", Body: `{"lat": "1", "lon": "2", "job_id": "job", "row": 2}`},
+		{MessageId: "3", Body: `{"lat": "1", "lon": "2", "job_id": "job", "row": 3}`},
+		{MessageId: "4", Body: `{"lat": "1", "lon": "2", "job_id": "job", "row": 4}`, Attributes: map[string]string{"ApproximateReceiveCount": "3"}},
+	}})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// two lookups fit before the margin, the third is cancelled by it and the last isn't started.
+	expectedFailures := []events.SQSBatchItemFailure{{ItemIdentifier: "3"}, {ItemIdentifier: "4"}}
+	if !cmp.Equal(res.BatchItemFailures, expectedFailures) {
+		t.Errorf("got failures %v, expected %v", res.BatchItemFailures, expectedFailures)
+	}
+	if !sink.flushed || sink.written != 2 {
+		t.Errorf("got %d results written (flushed: %v), expected the 2 processed before the deadline to be flushed", sink.written, sink.flushed)
+	}
+	expectedRows := map[int]bool{1: true, 2: true, 4: false}
+	if !cmp.Equal(tracker.rows, expectedRows) {
+		t.Errorf("got rows %v, expected %v", tracker.rows, expectedRows)
+	}
+}
+
+type countingSink struct {
+	written int
+	flushed bool
+}
+
+func (c *countingSink) Write(ctx context.Context, r results.Record) error {
+	c.written++
+	return nil
+}
+
+func (c *countingSink) Flush(ctx context.Context) error {
+	c.flushed = true
+	return nil
+}
@@ -3,10 +3,14 @@ package main
 import (
 	"context"
 	"os"
+	"strconv"
 
 	"github.com/antonielabuschagne/data-loader/event/processors"
+	"github.com/antonielabuschagne/data-loader/jobs"
 	"github.com/antonielabuschagne/data-loader/messagequeue"
+	"github.com/antonielabuschagne/data-loader/results"
 	"github.com/antonielabuschagne/data-loader/s3client"
+	"github.com/antonielabuschagne/data-loader/weatherapi"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/config"
@@ -27,6 +31,14 @@ func main() {
 	if bucket == "" {
 		log.Fatal("WEATHER_DATA_BUCKET_NAME not defined")
 	}
+	jobsTable := os.Getenv("WEATHER_JOBS_TABLE_NAME")
+	if jobsTable == "" {
+		log.Fatal("WEATHER_JOBS_TABLE_NAME not defined")
+	}
+	resultsPrefix := os.Getenv("WEATHER_RESULTS_PREFIX")
+	if resultsPrefix == "" {
+		resultsPrefix = "results"
+	}
 	cfg, err := config.LoadDefaultConfig(context.Background())
 	if err != nil {
 		log.Fatal("error loading config")
@@ -35,8 +47,63 @@ func main() {
 	// id as receipt of delivery. What our S3EventProcessor needs to do that, is a fetcher for fetching the
 	// data and a message queue for delivering the data somewhere. That's the extend to what it cares about.
 	messageQueue := messagequeue.NewMessageQueue(cfg, queueUrl)
-	fetcher := s3client.NewS3DataFetcher(cfg, bucket)
+	// files are read from whichever bucket the event is for, results and rejects are written to ours.
+	fetcher := s3client.NewS3DataFetcher(cfg)
 	processor := processors.NewS3EventProcessor(fetcher, messageQueue.SendMessage, log)
+	processor.MessageBatchQueue = messageQueue.SendMessageBatch
+	if v := os.Getenv("WEATHER_DATA_INGEST_CONCURRENCY"); v != "" {
+		concurrency, err := strconv.Atoi(v)
+		if err != nil || concurrency < 1 {
+			log.Fatal("WEATHER_DATA_INGEST_CONCURRENCY must be a positive number")
+		}
+		processor.Concurrency = concurrency
+	}
+	writer := s3client.NewS3DataWriter(cfg, bucket)
+	tracker := jobs.NewTracker(jobs.NewDynamoDBStore(cfg, jobsTable), writer, resultsPrefix)
+	// manifests of empty files are written here, so they need to go where the results would be.
+	if os.Getenv("WEATHER_RESULTS_FORMAT") == "parquet" {
+		tracker.JobPrefix = func(jobId string) string {
+			return results.ParquetJobPrefix(resultsPrefix, jobId)
+		}
+	}
+	// rows asking for weather at a time the provider doesn't have are rejected as they're read.
+	providers, err := weatherapi.ParseProviders(os.Getenv("WEATHER_PROVIDER"))
+	if err != nil {
+		log.Fatal("WEATHER_PROVIDER must be openweathermap and/or open-meteo, in the order to try them")
+	}
+	processor.Coverage = weatherapi.WidestCoverage(providers)
+	dedup := false
+	if v := os.Getenv("WEATHER_DATA_DEDUP"); v != "" {
+		if dedup, err = strconv.ParseBool(v); err != nil {
+			log.Fatal("WEATHER_DATA_DEDUP must be true or false")
+		}
+	}
+	// rows wanting the same weather are queued once, and fanned back out to each row in the results.
+	if dedup {
+		opts := processors.DefaultDedupOptions()
+		if v := os.Getenv("WEATHER_DATA_DEDUP_GRID"); v != "" {
+			if opts.Grid, err = strconv.ParseFloat(v, 64); err != nil || opts.Grid < 0 {
+				log.Fatal("WEATHER_DATA_DEDUP_GRID must be a size in decimal degrees, e.g. 0.01")
+			}
+		}
+		processor.Dedup = &opts
+	}
+	// coordinates are decimal degrees with a decimal point, unless other notations are allowed.
+	if v := os.Getenv("WEATHER_DATA_ALLOW_DMS"); v != "" {
+		if processor.Coordinates.AllowDMS, err = strconv.ParseBool(v); err != nil {
+			log.Fatal("WEATHER_DATA_ALLOW_DMS must be true or false")
+		}
+	}
+	if v := os.Getenv("WEATHER_DATA_ALLOW_DECIMAL_COMMA"); v != "" {
+		if processor.Coordinates.AllowDecimalComma, err = strconv.ParseBool(v); err != nil {
+			log.Fatal("WEATHER_DATA_ALLOW_DECIMAL_COMMA must be true or false")
+		}
+	}
+	processor.Jobs = tracker
+	processor.Rejects = writer
+	if v := os.Getenv("WEATHER_REJECTS_PREFIX"); v != "" {
+		processor.RejectsPrefix = v
+	}
 
 	h := NewHandler(log, processor)
 	lambda.Start(h.handler)
@@ -60,6 +127,6 @@ func (h *Handler) handler(ctx context.Context, e events.S3Event) (err error) {
 	if err != nil {
 		h.Log.Error("unable to process file", zap.String("error", err.Error()))
 	}
-	h.Log.Info("event processed completed", zap.Any("messages", messages))
+	h.Log.Info("event processed completed", zap.Int("messages", len(messages)))
 	return
 }
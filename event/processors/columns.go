@@ -0,0 +1,120 @@
+package processors
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ColumnAliases lists the headings (matched case-insensitively) that identify the longitude and
+// latitude columns of an input file, and the optional units, language and time columns.
+type ColumnAliases struct {
+	Lon   []string
+	Lat   []string
+	Units []string
+	Lang  []string
+	Time  []string
+}
+
+func DefaultColumnAliases() ColumnAliases {
+	return ColumnAliases{
+		Lon:   []string{"lon", "longitude", "lng", "long", "x"},
+		Lat:   []string{"lat", "latitude", "y"},
+		Units: []string{"units"},
+		Lang:  []string{"lang", "language"},
+		Time:  []string{"time", "timestamp", "datetime", "date"},
+	}
+}
+
+// columnMapping is the result of resolving a heading row: where to find the coordinates and
+// options, and the name of every other column so it can be passed through as metadata. The options
+// are -1 when the file doesn't have them.
+type columnMapping struct {
+	lon   int
+	lat   int
+	units int
+	lang  int
+	time  int
+	extra map[int]string
+}
+
+func (a ColumnAliases) resolve(header []string) (m columnMapping, err error) {
+	return a.resolveWith(header, -1, -1)
+}
+
+// resolveWith resolves a heading row where the coordinates are known to be in columns lon and lat,
+// unless they're -1. Any other column named like a coordinate is then passed through as metadata.
+func (a ColumnAliases) resolveWith(header []string, lon, lat int) (m columnMapping, err error) {
+	m.lon = -1
+	m.lat = -1
+	m.units = -1
+	m.lang = -1
+	m.time = -1
+	m.extra = make(map[int]string)
+	for i, h := range header {
+		name := normaliseHeading(h)
+		switch {
+		case i == lon:
+			m.lon = i
+		case i == lat:
+			m.lat = i
+		case lon == -1 && matchesAlias(name, a.Lon):
+			if m.lon != -1 {
+				err = fmt.Errorf("multiple longitude columns found: %q and %q", header[m.lon], h)
+				return
+			}
+			m.lon = i
+		case lat == -1 && matchesAlias(name, a.Lat):
+			if m.lat != -1 {
+				err = fmt.Errorf("multiple latitude columns found: %q and %q", header[m.lat], h)
+				return
+			}
+			m.lat = i
+		case matchesAlias(name, a.Units):
+			if m.units != -1 {
+				err = fmt.Errorf("multiple units columns found: %q and %q", header[m.units], h)
+				return
+			}
+			m.units = i
+		case matchesAlias(name, a.Lang):
+			if m.lang != -1 {
+				err = fmt.Errorf("multiple language columns found: %q and %q", header[m.lang], h)
+				return
+			}
+			m.lang = i
+		case matchesAlias(name, a.Time):
+			if m.time != -1 {
+				err = fmt.Errorf("multiple time columns found: %q and %q", header[m.time], h)
+				return
+			}
+			m.time = i
+		default:
+			if name == "" {
+				name = fmt.Sprintf("column_%d", i+1)
+			}
+			m.extra[i] = name
+		}
+	}
+	if m.lon == -1 {
+		err = fmt.Errorf("longitude column not found, expected one of %v", a.Lon)
+		return
+	}
+	if m.lat == -1 {
+		err = fmt.Errorf("latitude column not found, expected one of %v", a.Lat)
+		return
+	}
+	return
+}
+
+func normaliseHeading(h string) string {
+	// spreadsheet exports commonly prefix the first heading with a UTF-8 byte order mark.
+	return strings.TrimSpace(strings.TrimPrefix(h, "\ufeff"))
+}
+
+func matchesAlias(name string, aliases []string) bool {
+	for _, a := range aliases {
+		if strings.EqualFold(name, a) {
+			return true
+		}
+	}
+	return false
+}
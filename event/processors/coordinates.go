@@ -0,0 +1,132 @@
+package processors
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CoordinateOptions controls how coordinate values are parsed and normalised.
+type CoordinateOptions struct {
+	// Precision is the number of decimal places coordinates are rounded to.
+	Precision int
+	// AllowDMS accepts degrees/minutes/seconds notation, e.g. 44°20'30"N.
+	AllowDMS bool
+	// AllowDecimalComma accepts a comma as the decimal separator, e.g. 44,34.
+	AllowDecimalComma bool
+}
+
+func DefaultCoordinateOptions() CoordinateOptions {
+	return CoordinateOptions{
+		Precision: 4,
+	}
+}
+
+// ValidationError describes why a row's coordinates or options were rejected.
+type ValidationError struct {
+	Row    int
+	Field  string
+	Value  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("row %d: invalid %s %q: %s", e.Row, e.Field, e.Value, e.Reason)
+}
+
+type coordinateAxis struct {
+	field       string
+	limit       float64
+	hemispheres string
+	negative    string
+}
+
+var (
+	longitude = coordinateAxis{field: "lon", limit: 180, hemispheres: "EW", negative: "W"}
+	latitude  = coordinateAxis{field: "lat", limit: 90, hemispheres: "NS", negative: "S"}
+)
+
+// dmsPattern matches degrees with optional minutes and seconds, and a hemisphere either before or
+// after the value.
+var dmsPattern = regexp.MustCompile(`^([NSEW])?\s*(-?\d+(?:\.\d+)?)\s*°\s*(?:(\d+(?:\.\d+)?)\s*['′]\s*)?(?:(\d+(?:\.\d+)?)\s*(?:"|″|'')\s*)?([NSEW])?$`)
+
+// normaliseCoordinate parses and range checks a single coordinate, returning it rounded to the
+// configured precision.
+func (o CoordinateOptions) normaliseCoordinate(row int, axis coordinateAxis, value string) (normalised string, err error) {
+	invalid := func(reason string) error {
+		return &ValidationError{Row: row, Field: axis.field, Value: value, Reason: reason}
+	}
+	v := strings.TrimSpace(value)
+	if v == "" {
+		err = invalid("value is required")
+		return
+	}
+	var f float64
+	if o.AllowDMS && strings.Contains(v, "°") {
+		f, err = parseDMS(strings.ToUpper(v), axis)
+		if err != nil {
+			err = invalid(err.Error())
+			return
+		}
+	} else {
+		if o.AllowDecimalComma && strings.Count(v, ",") == 1 && !strings.Contains(v, ".") {
+			v = strings.Replace(v, ",", ".", 1)
+		}
+		f, err = strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			err = invalid("not a number")
+			return
+		}
+	}
+	if f < -axis.limit || f > axis.limit {
+		err = invalid(fmt.Sprintf("out of range, must be between -%v and %v", axis.limit, axis.limit))
+		return
+	}
+	scale := math.Pow10(o.Precision)
+	normalised = strconv.FormatFloat(math.Round(f*scale)/scale, 'f', -1, 64)
+	return
+}
+
+func parseDMS(v string, axis coordinateAxis) (f float64, err error) {
+	m := dmsPattern.FindStringSubmatch(v)
+	if m == nil {
+		err = fmt.Errorf("not a valid degrees/minutes/seconds value")
+		return
+	}
+	hemisphere := m[1]
+	if m[5] != "" {
+		if hemisphere != "" {
+			err = fmt.Errorf("hemisphere given twice")
+			return
+		}
+		hemisphere = m[5]
+	}
+	if hemisphere != "" && !strings.Contains(axis.hemispheres, hemisphere) {
+		err = fmt.Errorf("hemisphere %s isn't valid for %s", hemisphere, axis.field)
+		return
+	}
+	degrees, _ := strconv.ParseFloat(m[2], 64)
+	var minutes, seconds float64
+	if m[3] != "" {
+		minutes, _ = strconv.ParseFloat(m[3], 64)
+	}
+	if m[4] != "" {
+		seconds, _ = strconv.ParseFloat(m[4], 64)
+	}
+	if minutes >= 60 || seconds >= 60 {
+		err = fmt.Errorf("minutes and seconds must be less than 60")
+		return
+	}
+	negative := degrees < 0 || strings.HasPrefix(m[2], "-")
+	if negative && hemisphere != "" {
+		err = fmt.Errorf("negative value with a hemisphere is ambiguous")
+		return
+	}
+	f = math.Abs(degrees) + minutes/60 + seconds/3600
+	if negative || hemisphere == axis.negative {
+		f = -f
+	}
+	return
+}
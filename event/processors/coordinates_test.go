@@ -0,0 +1,138 @@
+package processors
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormaliseCoordinate(t *testing.T) {
+	tests := []struct {
+		description    string
+		opts           CoordinateOptions
+		axis           coordinateAxis
+		value          string
+		expected       string
+		expectedReason string
+	}{
+		{
+			description: "given a decimal value, it's rounded to the configured precision",
+			opts:        CoordinateOptions{Precision: 4},
+			axis:        latitude,
+			value:       " 44.3456789 ",
+			expected:    "44.3457",
+		},
+		{
+			description: "given a whole number, no trailing zeros are added",
+			opts:        CoordinateOptions{Precision: 4},
+			axis:        longitude,
+			value:       "-10",
+			expected:    "-10",
+		},
+		{
+			description:    "given text, it's rejected",
+			opts:           CoordinateOptions{Precision: 4},
+			axis:           longitude,
+			value:          "abc",
+			expectedReason: "not a number",
+		},
+		{
+			description:    "given an empty value, it's rejected",
+			opts:           CoordinateOptions{Precision: 4},
+			axis:           longitude,
+			value:          "",
+			expectedReason: "value is required",
+		},
+		{
+			description:    "given a latitude beyond 90, it's rejected",
+			opts:           CoordinateOptions{Precision: 4},
+			axis:           latitude,
+			value:          "91",
+			expectedReason: "out of range, must be between -90 and 90",
+		},
+		{
+			description:    "given a longitude beyond 180, it's rejected",
+			opts:           CoordinateOptions{Precision: 4},
+			axis:           longitude,
+			value:          "999",
+			expectedReason: "out of range, must be between -180 and 180",
+		},
+		{
+			description:    "given a decimal comma when not allowed, it's rejected",
+			opts:           CoordinateOptions{Precision: 4},
+			axis:           latitude,
+			value:          "44,34",
+			expectedReason: "not a number",
+		},
+		{
+			description: "given a decimal comma when allowed, it's parsed",
+			opts:        CoordinateOptions{Precision: 4, AllowDecimalComma: true},
+			axis:        latitude,
+			value:       "44,34",
+			expected:    "44.34",
+		},
+		{
+			description:    "given DMS when not allowed, it's rejected",
+			opts:           CoordinateOptions{Precision: 4},
+			axis:           latitude,
+			value:          "44°20'N",
+			expectedReason: "not a number",
+		},
+		{
+			description: "given degrees and minutes, it's converted to decimal",
+			opts:        CoordinateOptions{Precision: 4, AllowDMS: true},
+			axis:        latitude,
+			value:       "44°20'N",
+			expected:    "44.3333",
+		},
+		{
+			description: "given degrees, minutes and seconds in the southern hemisphere, it's negative",
+			opts:        CoordinateOptions{Precision: 4, AllowDMS: true},
+			axis:        latitude,
+			value:       `S 33°55'30"`,
+			expected:    "-33.925",
+		},
+		{
+			description: "given a western longitude, it's negative",
+			opts:        CoordinateOptions{Precision: 4, AllowDMS: true},
+			axis:        longitude,
+			value:       "18°25′w",
+			expected:    "-18.4167",
+		},
+		{
+			description:    "given a latitude with an east/west hemisphere, it's rejected",
+			opts:           CoordinateOptions{Precision: 4, AllowDMS: true},
+			axis:           latitude,
+			value:          "44°20'E",
+			expectedReason: "hemisphere E isn't valid for lat",
+		},
+		{
+			description:    "given minutes of 60 or more, it's rejected",
+			opts:           CoordinateOptions{Precision: 4, AllowDMS: true},
+			axis:           latitude,
+			value:          "44°60'N",
+			expectedReason: "minutes and seconds must be less than 60",
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.opts.normaliseCoordinate(3, tt.axis, tt.value)
+		if tt.expectedReason != "" {
+			var ve *ValidationError
+			if !errors.As(err, &ve) {
+				t.Errorf("%s: expected validation error, got %v", tt.description, err)
+				continue
+			}
+			if ve.Reason != tt.expectedReason || ve.Row != 3 || ve.Field != tt.axis.field || ve.Value != tt.value {
+				t.Errorf("%s: got %+v", tt.description, ve)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.description, err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("%s: got %q, expected %q", tt.description, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,452 @@
+package processors
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+// RowReader reads an input file a row at a time, so memory use doesn't grow with the size of the
+// file. Header is called once, before the first call to Read.
+type RowReader interface {
+	// Header returns the column names, or io.EOF if the file has no rows.
+	Header() (header []string, err error)
+	// Read returns the fields of the next row, in the same order as the header, and the line of
+	// the file it starts on. It returns io.EOF once every row has been read. A *RowError means
+	// only that row is bad and reading can carry on.
+	Read() (fields []string, line int, err error)
+}
+
+// CoordinateReader is implemented by a RowReader whose coordinates don't come from a named
+// column, e.g. the geometry of a GeoJSON feature. The columns it returns are used for the
+// longitude and latitude whatever their headings, and columns that happen to be named like
+// coordinates are passed through as metadata.
+type CoordinateReader interface {
+	CoordinateColumns() (lon, lat int)
+}
+
+// DecoderFunc creates a RowReader over the content of a file.
+type DecoderFunc func(r io.Reader) RowReader
+
+// RowError is returned by a RowReader for a row that can't be decoded, it's rejected without
+// stopping the rest of the file being read.
+type RowError struct {
+	Line   int
+	Fields []string
+	Err    error
+}
+
+func (e *RowError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err.Error())
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// Decoders maps file extensions (including the dot, matched case-insensitively) and content types
+// to the decoder for that format. The extension is tried first, the content type is used for
+// files without a recognised extension.
+type Decoders struct {
+	Extensions   map[string]DecoderFunc
+	ContentTypes map[string]DecoderFunc
+}
+
+func DefaultDecoders() Decoders {
+	csvDecoder := NewDelimitedDecoder(',')
+	tsvDecoder := NewDelimitedDecoder('\t')
+	return Decoders{
+		Extensions: map[string]DecoderFunc{
+			".csv":     csvDecoder,
+			".tsv":     tsvDecoder,
+			".tab":     tsvDecoder,
+			".jsonl":   NewJSONLinesDecoder,
+			".ndjson":  NewJSONLinesDecoder,
+			".geojson": NewGeoJSONDecoder,
+		},
+		ContentTypes: map[string]DecoderFunc{
+			"text/csv":                  csvDecoder,
+			"text/tab-separated-values": tsvDecoder,
+			"application/jsonl":         NewJSONLinesDecoder,
+			"application/x-ndjson":      NewJSONLinesDecoder,
+			"application/geo+json":      NewGeoJSONDecoder,
+		},
+	}
+}
+
+// lookup finds the decoder for a file, preferring the longest matching extension.
+func (d Decoders) lookup(key, contentType string) (decoder DecoderFunc, ok bool) {
+	key = strings.ToLower(key)
+	var matched string
+	for ext, dec := range d.Extensions {
+		if strings.HasSuffix(key, strings.ToLower(ext)) && len(ext) > len(matched) {
+			matched, decoder, ok = ext, dec, true
+		}
+	}
+	if ok || contentType == "" {
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return
+	}
+	decoder, ok = d.ContentTypes[mediaType]
+	return
+}
+
+// NewDelimitedDecoder decodes CSV, or any similar format with a different separator, where the
+// first row contains the column headings.
+func NewDelimitedDecoder(comma rune) DecoderFunc {
+	return func(r io.Reader) RowReader {
+		cr := csv.NewReader(r)
+		cr.Comma = comma
+		// row lengths are checked against the heading row when converting, so a short row is
+		// rejected on its own rather than failing the rest of the file.
+		cr.FieldsPerRecord = -1
+		// tab separated files don't normally quote fields, so a stray quote isn't an error.
+		cr.LazyQuotes = comma == '\t'
+		return delimitedReader{r: cr}
+	}
+}
+
+type delimitedReader struct {
+	r *csv.Reader
+}
+
+func (d delimitedReader) Header() (header []string, err error) {
+	return d.r.Read()
+}
+
+func (d delimitedReader) Read() (fields []string, line int, err error) {
+	fields, err = d.r.Read()
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		// the reader carries on from the line after the bad row, so only that row is lost.
+		line = parseErr.StartLine
+		err = &RowError{Line: line, Fields: fields, Err: fmt.Errorf("column %d: %w", parseErr.Column, parseErr.Err)}
+		return
+	}
+	if err != nil {
+		return
+	}
+	line, _ = d.r.FieldPos(0)
+	return
+}
+
+// NewJSONLinesDecoder decodes a file with a JSON object on each line. The columns are the keys of
+// the first object, in the order they're written; keys that only appear in later objects are
+// ignored.
+func NewJSONLinesDecoder(r io.Reader) RowReader {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	return &jsonLinesReader{s: s}
+}
+
+type jsonLinesReader struct {
+	s      *bufio.Scanner
+	line   int
+	header []string
+	// first is the row the header was taken from, returned by the first call to Read.
+	first     []string
+	firstLine int
+}
+
+// next returns the next line that isn't blank.
+func (j *jsonLinesReader) next() (text []byte, err error) {
+	for j.s.Scan() {
+		j.line++
+		if text = bytes.TrimSpace(j.s.Bytes()); len(text) > 0 {
+			return
+		}
+	}
+	if err = j.s.Err(); err == nil {
+		err = io.EOF
+	}
+	return
+}
+
+func (j *jsonLinesReader) Header() (header []string, err error) {
+	text, err := j.next()
+	if err != nil {
+		return
+	}
+	keys, values, err := decodeObject(text)
+	if err != nil {
+		err = fmt.Errorf("line %d: unable to read the columns from the first object: %w", j.line, err)
+		return
+	}
+	j.header = keys
+	j.first = fieldsOf(keys, values)
+	j.firstLine = j.line
+	header = keys
+	return
+}
+
+func (j *jsonLinesReader) Read() (fields []string, line int, err error) {
+	if j.first != nil {
+		fields, line, j.first = j.first, j.firstLine, nil
+		return
+	}
+	text, err := j.next()
+	if err != nil {
+		return
+	}
+	line = j.line
+	_, values, err := decodeObject(text)
+	if err != nil {
+		err = &RowError{Line: line, Fields: []string{string(text)}, Err: err}
+		return
+	}
+	fields = fieldsOf(j.header, values)
+	return
+}
+
+// NewGeoJSONDecoder decodes a GeoJSON FeatureCollection of Points. The columns are lon and lat,
+// followed by the property names of the first feature. Features are read one at a time, so the
+// collection is never held in memory.
+func NewGeoJSONDecoder(r io.Reader) RowReader {
+	lines := &lineCounter{r: r}
+	return &geoJSONReader{lines: lines, dec: json.NewDecoder(lines)}
+}
+
+type geoJSONReader struct {
+	lines  *lineCounter
+	dec    *json.Decoder
+	header []string
+	first  []string
+	// firstErr is returned by the first call to Read when the feature the header was taken from
+	// isn't a point.
+	firstErr  error
+	firstLine int
+	pending   bool
+}
+
+type geoJSONFeature struct {
+	Type     string `json:"type"`
+	Geometry *struct {
+		Type        string            `json:"type"`
+		Coordinates []json.RawMessage `json:"coordinates"`
+	} `json:"geometry"`
+	Properties json.RawMessage `json:"properties"`
+}
+
+func (g *geoJSONReader) Header() (header []string, err error) {
+	if err = g.openFeatures(); err != nil {
+		return
+	}
+	if !g.dec.More() {
+		err = io.EOF
+		return
+	}
+	feature, line, err := g.decodeFeature()
+	if err != nil {
+		return
+	}
+	keys, values, err := decodeProperties(feature.Properties)
+	if err != nil {
+		err = fmt.Errorf("line %d: unable to read the columns from the first feature: %w", line, err)
+		return
+	}
+	g.header = append([]string{"lon", "lat"}, keys...)
+	g.first, g.firstErr = g.fields(feature, values, line)
+	g.firstLine = line
+	g.pending = true
+	header = g.header
+	return
+}
+
+// CoordinateColumns returns the columns of the point's coordinates, so properties named lon, lat
+// and the like are kept as metadata.
+func (g *geoJSONReader) CoordinateColumns() (lon, lat int) {
+	return 0, 1
+}
+
+// openFeatures moves the decoder to the start of the features array.
+func (g *geoJSONReader) openFeatures() (err error) {
+	if err = expectDelim(g.dec, '{'); err != nil {
+		return
+	}
+	for g.dec.More() {
+		t, err := g.dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case "features":
+			return expectDelim(g.dec, '[')
+		case "type":
+			var collectionType string
+			if err = g.dec.Decode(&collectionType); err != nil {
+				return err
+			}
+			if collectionType != "FeatureCollection" {
+				return fmt.Errorf("GeoJSON type %q isn't supported, expected FeatureCollection", collectionType)
+			}
+		default:
+			var skip json.RawMessage
+			if err = g.dec.Decode(&skip); err != nil {
+				return err
+			}
+		}
+	}
+	return io.EOF
+}
+
+func (g *geoJSONReader) Read() (fields []string, line int, err error) {
+	if g.pending {
+		g.pending = false
+		fields, line, err = g.first, g.firstLine, g.firstErr
+		return
+	}
+	if !g.dec.More() {
+		// anything after the features array isn't needed.
+		err = io.EOF
+		return
+	}
+	feature, line, err := g.decodeFeature()
+	if err != nil {
+		return
+	}
+	_, values, err := decodeProperties(feature.Properties)
+	if err != nil {
+		err = &RowError{Line: line, Err: err}
+		return
+	}
+	fields, err = g.fields(feature, values, line)
+	return
+}
+
+func (g *geoJSONReader) decodeFeature() (feature geoJSONFeature, line int, err error) {
+	var raw json.RawMessage
+	if err = g.dec.Decode(&raw); err != nil {
+		return
+	}
+	// the raw message is exactly the bytes of the feature, so it ends where the decoder is now.
+	line = g.lines.lineAt(g.dec.InputOffset() - int64(len(raw)))
+	if err = json.Unmarshal(raw, &feature); err != nil {
+		err = &RowError{Line: line, Fields: []string{string(raw)}, Err: err}
+	}
+	return
+}
+
+// fields returns the row for a feature, rejecting anything that isn't a point.
+func (g *geoJSONReader) fields(feature geoJSONFeature, properties map[string]string, line int) (fields []string, err error) {
+	fields = fieldsOf(g.header, properties)
+	switch {
+	case feature.Geometry == nil:
+		err = fmt.Errorf("feature has no geometry")
+	case feature.Geometry.Type != "Point":
+		err = fmt.Errorf("geometry type %s isn't supported, expected Point", feature.Geometry.Type)
+	case len(feature.Geometry.Coordinates) < 2:
+		err = fmt.Errorf("point must have a longitude and latitude")
+	default:
+		fields[0] = jsonValueString(feature.Geometry.Coordinates[0])
+		fields[1] = jsonValueString(feature.Geometry.Coordinates[1])
+		return
+	}
+	err = &RowError{Line: line, Fields: fields, Err: err}
+	return
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) (err error) {
+	t, err := dec.Token()
+	if err != nil {
+		return
+	}
+	if t != delim {
+		err = fmt.Errorf("expected %v, got %v", delim, t)
+	}
+	return
+}
+
+// decodeObject decodes a JSON object, keeping the order its keys were written in. Values are
+// returned as text: strings unquoted, null as empty and anything else as written.
+func decodeObject(data []byte) (keys []string, values map[string]string, err error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if err = expectDelim(dec, '{'); err != nil {
+		return
+	}
+	values = make(map[string]string)
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		key, _ := t.(string)
+		var raw json.RawMessage
+		if err = dec.Decode(&raw); err != nil {
+			return nil, nil, err
+		}
+		if _, seen := values[key]; !seen {
+			keys = append(keys, key)
+		}
+		values[key] = jsonValueString(raw)
+	}
+	err = expectDelim(dec, '}')
+	return
+}
+
+// decodeProperties decodes the properties of a feature, which may be null.
+func decodeProperties(data json.RawMessage) (keys []string, values map[string]string, err error) {
+	if len(data) == 0 || string(data) == "null" {
+		return
+	}
+	return decodeObject(data)
+}
+
+func jsonValueString(raw json.RawMessage) string {
+	raw = bytes.TrimSpace(raw)
+	if string(raw) == "null" {
+		return ""
+	}
+	var s string
+	if len(raw) > 0 && raw[0] == '"' && json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	return string(raw)
+}
+
+// fieldsOf lines values up with the header, leaving the fields of missing keys empty.
+func fieldsOf(header []string, values map[string]string) (fields []string) {
+	fields = make([]string, len(header))
+	for i, h := range header {
+		fields[i] = values[h]
+	}
+	return
+}
+
+// lineCounter keeps track of the line numbers of what's been read, so a byte offset reported by a
+// json.Decoder can be turned into a line. Offsets must be looked up in increasing order.
+type lineCounter struct {
+	r    io.Reader
+	read int64
+	// newlines are the offsets of newlines that haven't been passed by a lookup yet.
+	newlines []int64
+	line     int
+}
+
+func (l *lineCounter) Read(p []byte) (n int, err error) {
+	n, err = l.r.Read(p)
+	for i, b := range p[:n] {
+		if b == '\n' {
+			l.newlines = append(l.newlines, l.read+int64(i))
+		}
+	}
+	l.read += int64(n)
+	return
+}
+
+// lineAt returns the line, numbered from 1, of the byte at offset.
+func (l *lineCounter) lineAt(offset int64) int {
+	for len(l.newlines) > 0 && l.newlines[0] < offset {
+		l.line++
+		l.newlines = l.newlines[1:]
+	}
+	return l.line + 1
+}
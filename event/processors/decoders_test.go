@@ -0,0 +1,201 @@
+package processors
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type decodedRow struct {
+	Fields []string
+	Line   int
+	Err    string
+}
+
+func decodeAll(rr RowReader) (header []string, rows []decodedRow, err error) {
+	if header, err = rr.Header(); err != nil {
+		return
+	}
+	for {
+		fields, line, readErr := rr.Read()
+		if readErr == io.EOF {
+			return
+		}
+		var rowErr *RowError
+		if errors.As(readErr, &rowErr) {
+			rows = append(rows, decodedRow{Fields: rowErr.Fields, Line: rowErr.Line, Err: rowErr.Err.Error()})
+			continue
+		}
+		if readErr != nil {
+			err = readErr
+			return
+		}
+		rows = append(rows, decodedRow{Fields: fields, Line: line})
+	}
+}
+
+func TestDecoders(t *testing.T) {
+	tests := []struct {
+		description    string
+		decoder        DecoderFunc
+		input          string
+		expectedHeader []string
+		expectedRows   []decodedRow
+		expectedErr    error
+	}{
+		{
+			description:    "given a CSV file, rows are returned with their line",
+			decoder:        NewDelimitedDecoder(','),
+			input:          "lon,lat,name\n1,2,\"two\nlines\"\n3,4,c",
+			expectedHeader: []string{"lon", "lat", "name"},
+			expectedRows: []decodedRow{
+				{Fields: []string{"1", "2", "two\nlines"}, Line: 2},
+				{Fields: []string{"3", "4", "c"}, Line: 4},
+			},
+		},
+		{
+			description:    "given a CSV row with a bad quote, it's a row error and the rows after it are read",
+			decoder:        NewDelimitedDecoder(','),
+			input:          "lon,lat\n1,2\n3,4\"x\n5,6\n7,8",
+			expectedHeader: []string{"lon", "lat"},
+			expectedRows: []decodedRow{
+				{Fields: []string{"1", "2"}, Line: 2},
+				{Fields: []string{"3"}, Line: 3, Err: "column 4: bare \" in non-quoted-field"},
+				{Fields: []string{"5", "6"}, Line: 4},
+				{Fields: []string{"7", "8"}, Line: 5},
+			},
+		},
+		{
+			description:    "given a TSV file with a stray quote, the quote is kept",
+			decoder:        NewDelimitedDecoder('\t'),
+			input:          "lon\tlat\tname\n1\t2\tthe \"old\" mill",
+			expectedHeader: []string{"lon", "lat", "name"},
+			expectedRows: []decodedRow{
+				{Fields: []string{"1", "2", "the \"old\" mill"}, Line: 2},
+			},
+		},
+		{
+			description:    "given JSON Lines, columns come from the first object and bad lines are row errors",
+			decoder:        NewJSONLinesDecoder,
+			input:          "{\"lat\":2,\"lon\":1.5,\"name\":\"a\"}\n\n{\"lon\":\"3\",\"name\":null,\"extra\":true,\"lat\":4}\n{\"lon\":\n{\"lat\":6}",
+			expectedHeader: []string{"lat", "lon", "name"},
+			expectedRows: []decodedRow{
+				{Fields: []string{"2", "1.5", "a"}, Line: 1},
+				{Fields: []string{"4", "3", ""}, Line: 3},
+				{Fields: []string{"{\"lon\":"}, Line: 4, Err: "unexpected EOF"},
+				{Fields: []string{"6", "", ""}, Line: 5},
+			},
+		},
+		{
+			description:    "given empty JSON Lines, the header is EOF",
+			decoder:        NewJSONLinesDecoder,
+			input:          "\n\n",
+			expectedErr:    io.EOF,
+			expectedHeader: nil,
+		},
+		{
+			description: "given a GeoJSON FeatureCollection, points are returned and other geometry is a row error",
+			decoder:     NewGeoJSONDecoder,
+			input: `{
+  "type": "FeatureCollection",
+  "name": "stations",
+  "features": [
+    {"type": "Feature", "geometry": {"type": "Point", "coordinates": [-0.1, 51.5]}, "properties": {"name": "london", "id": 7}},
+    {
+      "type": "Feature",
+      "geometry": {"type": "LineString", "coordinates": [[1, 2], [3, 4]]},
+      "properties": {"name": "route"}
+    },
+    {"type": "Feature", "geometry": {"type": "Point", "coordinates": [2.35, 48.85, 35]}, "properties": null}
+  ]
+}`,
+			expectedHeader: []string{"lon", "lat", "name", "id"},
+			expectedRows: []decodedRow{
+				{Fields: []string{"-0.1", "51.5", "london", "7"}, Line: 5},
+				{Fields: []string{"", "", "route", ""}, Line: 6, Err: "geometry type LineString isn't supported, expected Point"},
+				{Fields: []string{"2.35", "48.85", "", ""}, Line: 11},
+			},
+		},
+		{
+			description: "given GeoJSON that isn't a FeatureCollection, an error is returned",
+			decoder:     NewGeoJSONDecoder,
+			input:       `{"type": "Feature", "geometry": {"type": "Point", "coordinates": [1, 2]}}`,
+			expectedErr: errors.New(`GeoJSON type "Feature" isn't supported, expected FeatureCollection`),
+		},
+		{
+			description: "given a FeatureCollection without features, the header is EOF",
+			decoder:     NewGeoJSONDecoder,
+			input:       `{"type": "FeatureCollection", "features": []}`,
+			expectedErr: io.EOF,
+		},
+	}
+
+	for _, tt := range tests {
+		header, rows, err := decodeAll(tt.decoder(strings.NewReader(tt.input)))
+		if (err == nil) != (tt.expectedErr == nil) || (err != nil && err.Error() != tt.expectedErr.Error()) {
+			t.Errorf("%s: got error %v, expected %v", tt.description, err, tt.expectedErr)
+			continue
+		}
+		if !cmp.Equal(header, tt.expectedHeader) {
+			t.Errorf("%s: got header %q, expected %q", tt.description, header, tt.expectedHeader)
+		}
+		if diff := cmp.Diff(tt.expectedRows, rows); diff != "" {
+			t.Errorf("%s: unexpected rows: %s", tt.description, diff)
+		}
+	}
+}
+
+func TestDecodersLookup(t *testing.T) {
+	decoders := DefaultDecoders()
+	decoders.Extensions[".weather.csv"] = NewJSONLinesDecoder
+
+	tests := []struct {
+		description string
+		key         string
+		contentType string
+		expectedOk  bool
+		expectedCSV bool
+	}{
+		{
+			description: "given a known extension in any case, a decoder is found",
+			key:         "weather-data/DATA.CSV",
+			expectedOk:  true,
+			expectedCSV: true,
+		},
+		{
+			description: "given extensions that overlap, the longest is used",
+			key:         "data.weather.csv",
+			expectedOk:  true,
+		},
+		{
+			description: "given an unknown extension and a known content type, a decoder is found",
+			key:         "export",
+			contentType: "text/csv; charset=utf-8",
+			expectedOk:  true,
+			expectedCSV: true,
+		},
+		{
+			description: "given an unknown extension and content type, no decoder is found",
+			key:         "data.txt",
+			contentType: "text/plain",
+		},
+	}
+
+	for _, tt := range tests {
+		decoder, ok := decoders.lookup(tt.key, tt.contentType)
+		if ok != tt.expectedOk {
+			t.Errorf("%s: got ok %v, expected %v", tt.description, ok, tt.expectedOk)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		_, isCSV := decoder(strings.NewReader("")).(delimitedReader)
+		if isCSV != tt.expectedCSV {
+			t.Errorf("%s: got a CSV decoder %v, expected %v", tt.description, isCSV, tt.expectedCSV)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package processors
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+)
+
+// contentEncoder is implemented by fetched content that knows how it was compressed, it's used for
+// files without a compression extension.
+type contentEncoder interface {
+	ContentEncoding() string
+}
+
+// compressionExtensions maps the extensions of compressed files to their content encoding.
+var compressionExtensions = map[string]string{
+	".gz":   "gzip",
+	".gzip": "gzip",
+	".zst":  "zstd",
+	".zstd": "zstd",
+}
+
+// decompress wraps r so it's read decompressed, based on the extension of the key or else the
+// content encoding. The returned name is the key without the compression extension, so the format
+// of the content can be worked out from it.
+func decompress(key, contentEncoding string, r io.Reader) (name string, rc io.ReadCloser, err error) {
+	name = key
+	encoding := strings.ToLower(strings.TrimSpace(contentEncoding))
+	ext := path.Ext(key)
+	if e, ok := compressionExtensions[strings.ToLower(ext)]; ok {
+		name = strings.TrimSuffix(key, ext)
+		encoding = e
+	}
+	switch encoding {
+	case "", "identity":
+		rc = io.NopCloser(r)
+	case "gzip", "x-gzip":
+		rc, err = gzip.NewReader(r)
+	case "zstd":
+		var zr *zstd.Decoder
+		// a single goroutine keeps memory use down, the rows are read slower than they decompress.
+		if zr, err = zstd.NewReader(r, zstd.WithDecoderConcurrency(1)); err == nil {
+			rc = zr.IOReadCloser()
+		}
+	default:
+		err = fmt.Errorf("content encoding %q isn't supported", contentEncoding)
+	}
+	return
+}
+
+// processArchive processes each file in a zip archive as a file of its own, with a key made from
+// the archive key and the name of the file within it. Files with names that aren't a relative path,
+// e.g. ../../results/x.csv, are skipped and listed in the rejects of the archive itself.
+func (ep S3EventProcessor) processArchive(ctx context.Context, key string, r io.Reader) (processed []string, err error) {
+	log := ep.Log
+	// the index of a zip archive is at the end, so the archive is copied to disk to be read. The
+	// files within it are still read a row at a time.
+	tmp, err := os.CreateTemp(ep.TempDir, "archive-*.zip")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return
+	}
+	// the rejects of the archive are its skipped files, numbered by where they are in it.
+	skipped := &inputFile{key: key, name: key, header: []string{"file"}, rejects: &rejectLog{max: ep.MaxRejects}}
+	defer ep.writeRejects(ctx, skipped)
+	var files, failed int
+	for i, entry := range zr.File {
+		if entry.FileInfo().IsDir() || hiddenArchiveEntry(entry.Name) {
+			continue
+		}
+		// the name becomes part of the key the file's rejects are written to, so it mustn't be
+		// able to point anywhere else in the bucket.
+		if !fs.ValidPath(entry.Name) {
+			log.Warn("skipping file in archive with an invalid name", zap.String("key", key), zap.String("name", entry.Name))
+			skipped.rejects.add(i+1, "file name isn't a relative path within the archive", []string{entry.Name})
+			continue
+		}
+		files++
+		entryKey := key + "/" + entry.Name
+		messages, entryErr := ep.processArchiveEntry(ctx, entryKey, entry)
+		processed = append(processed, messages...)
+		if entryErr != nil {
+			log.Error("unable to process file in archive", zap.String("error", entryErr.Error()), zap.String("key", entryKey))
+			failed++
+		}
+	}
+	if failed > 0 {
+		err = fmt.Errorf("unable to process %d of %d files in the archive", failed, files)
+	}
+	return
+}
+
+func (ep S3EventProcessor) processArchiveEntry(ctx context.Context, key string, entry *zip.File) (processed []string, err error) {
+	rc, err := entry.Open()
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	return ep.processContent(ctx, key, rc, "", "")
+}
+
+// hiddenArchiveEntry reports whether a file in an archive is metadata added by the tool that
+// created it, e.g. the __MACOSX folder added by macOS, rather than something that was uploaded.
+func hiddenArchiveEntry(name string) bool {
+	return strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(path.Base(name), ".")
+}
@@ -0,0 +1,181 @@
+package processors
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/antonielabuschagne/data-loader/weatherapi"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/uuid"
+	"github.com/joerdav/zapray"
+	"github.com/klauspost/compress/zstd"
+)
+
+func gzipContent(t *testing.T, content string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstdContent(t *testing.T, content string) []byte {
+	w, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	return w.EncodeAll([]byte(content), nil)
+}
+
+func zipContent(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = f.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+type encodedContent struct {
+	io.Reader
+	contentEncoding string
+}
+
+func (encodedContent) Close() error {
+	return nil
+}
+
+func (c encodedContent) ContentEncoding() string {
+	return c.contentEncoding
+}
+
+func TestS3EventProcessorCompression(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+
+	tests := []struct {
+		description     string
+		key             string
+		contentEncoding string
+		content         []byte
+		expected        []weatherapi.WeatherAPIRequest
+		expectedRejects []string
+	}{
+		{
+			description: "given a gzipped CSV file, rows are queued",
+			key:         "data.csv.gz",
+			content:     gzipContent(t, "lon,lat\n1,2\n3,4"),
+			expected:    []weatherapi.WeatherAPIRequest{{Lon: "1", Lat: "2", Row: 1}, {Lon: "3", Lat: "4", Row: 2}},
+		},
+		{
+			description: "given a zstd compressed JSON Lines file, rows are queued",
+			key:         "data.jsonl.zst",
+			content:     zstdContent(t, "{\"lon\":1,\"lat\":2}\n{\"lon\":3,\"lat\":4}"),
+			expected:    []weatherapi.WeatherAPIRequest{{Lon: "1", Lat: "2", Row: 1}, {Lon: "3", Lat: "4", Row: 2}},
+		},
+		{
+			description:     "given a gzip content encoding, rows are queued",
+			key:             "data.csv",
+			contentEncoding: "gzip",
+			content:         gzipContent(t, "lon,lat\n1,2"),
+			expected:        []weatherapi.WeatherAPIRequest{{Lon: "1", Lat: "2", Row: 1}},
+		},
+		{
+			description:     "given an unsupported content encoding, nothing is queued",
+			key:             "data.csv",
+			contentEncoding: "br",
+			content:         []byte("lon,lat\n1,2"),
+		},
+		{
+			description: "given a corrupt gzip file, nothing is queued",
+			key:         "data.csv.gz",
+			content:     []byte("lon,lat\n1,2"),
+		},
+		{
+			description:     "given a gzipped file with bad rows, rejects are written uncompressed",
+			key:             "data.csv.gz",
+			content:         gzipContent(t, "lon,lat\n1,2\n,"),
+			expected:        []weatherapi.WeatherAPIRequest{{Lon: "1", Lat: "2", Row: 1}},
+			expectedRejects: []string{"rejects/data.csv"},
+		},
+		{
+			description: "given a zip archive, each supported file is queued and the rest skipped",
+			key:         "upload.zip",
+			content: zipContent(t, map[string]string{
+				"stores/a.csv":            "lon,lat\n1,2",
+				"b.tsv":                   "lon\tlat\n3,x\t4",
+				"readme.txt":              "lon,lat\n5,6",
+				"__MACOSX/stores/._a.csv": "\x00\x05\x16\x07",
+				"stores/":                 "",
+			}),
+			expected:        []weatherapi.WeatherAPIRequest{{Lon: "1", Lat: "2", Row: 1}},
+			expectedRejects: []string{"rejects/upload.zip/b.tsv.csv"},
+		},
+		{
+			description: "given a zip archive with a file named outside it, the file is skipped and rejected",
+			key:         "upload.zip",
+			content: zipContent(t, map[string]string{
+				"a.csv":                               "lon,lat\n1,2",
+				"../../results/job=x/date=y/evil.csv": "lon,lat\n,",
+				"/results/job=x/date=y/absolute.csv":  "lon,lat\n,",
+			}),
+			expected:        []weatherapi.WeatherAPIRequest{{Lon: "1", Lat: "2", Row: 1}},
+			expectedRejects: []string{"rejects/upload.zip.csv"},
+		},
+	}
+
+	for _, tt := range tests {
+		var messages []weatherapi.WeatherAPIRequest
+		var rejects []string
+		fetcher := func(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error) {
+			rc = encodedContent{Reader: bytes.NewReader(tt.content), contentEncoding: tt.contentEncoding}
+			return
+		}
+		messageQueue := func(ctx context.Context, message string) (messageId string, err error) {
+			var req weatherapi.WeatherAPIRequest
+			if err = json.Unmarshal([]byte(message), &req); err != nil {
+				return
+			}
+			messages = append(messages, req)
+			messageId = uuid.New().String()
+			return
+		}
+		ep := NewS3EventProcessor(fetcher, messageQueue, logger)
+		ep.TempDir = t.TempDir()
+		ep.Rejects = func(ctx context.Context, key string, data []byte) (err error) {
+			rejects = append(rejects, key)
+			return
+		}
+		if _, err := ep.Process(context.Background(), buildS3Event(tt.key)); err != nil {
+			t.Errorf("%s: unable to process: %s", tt.description, err.Error())
+		}
+		if !cmp.Equal(messages, tt.expected, cmpopts.IgnoreFields(weatherapi.WeatherAPIRequest{}, "JobId")) {
+			t.Errorf("%s: got %v, expected %v", tt.description, messages, tt.expected)
+		}
+		if !cmp.Equal(rejects, tt.expectedRejects) {
+			t.Errorf("%s: got rejects %v, expected %v", tt.description, rejects, tt.expectedRejects)
+		}
+	}
+}
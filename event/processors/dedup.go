@@ -0,0 +1,124 @@
+package processors
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/antonielabuschagne/data-loader/weatherapi"
+)
+
+// DedupOptions controls how rows wanting the same weather are combined into a single message.
+type DedupOptions struct {
+	// Grid is the size of a grid cell in decimal degrees, rows with coordinates in the same cell
+	// share the weather of the first of them. With no grid only identical coordinates (once
+	// normalised) are combined.
+	Grid float64
+	// MaxRows is the most rows served by one message, so it stays under the SQS message size limit
+	// however much metadata the rows carry.
+	MaxRows int
+}
+
+func DefaultDedupOptions() DedupOptions {
+	return DedupOptions{
+		MaxRows: 100,
+	}
+}
+
+// key is what rows are grouped by, they also have to want the weather in the same units and
+// language, and for the same time.
+func (o DedupOptions) key(req weatherapi.WeatherAPIRequest) string {
+	at := "now"
+	if req.At != nil {
+		at = strconv.FormatInt(req.At.Unix(), 10)
+	}
+	return fmt.Sprintf("%s,%s|%s|%s|%s", o.cell(req.Lon), o.cell(req.Lat), req.Units, req.Lang, at)
+}
+
+// cell is the grid cell a normalised coordinate falls in.
+func (o DedupOptions) cell(coordinate string) string {
+	v, err := strconv.ParseFloat(coordinate, 64)
+	if err != nil || o.Grid <= 0 {
+		return coordinate
+	}
+	return strconv.FormatInt(int64(math.Round(v/o.Grid)), 10)
+}
+
+// dedupGroups collects the requests of a file by key, until it's been read and they can be
+// queued. It's safe for concurrent use.
+type dedupGroups struct {
+	opts DedupOptions
+
+	mu     sync.Mutex
+	keys   []string
+	groups map[string][]dedupRow
+}
+
+type dedupRow struct {
+	row inputRow
+	req weatherapi.WeatherAPIRequest
+}
+
+func newDedupGroups(opts DedupOptions) *dedupGroups {
+	return &dedupGroups{
+		opts:   opts,
+		groups: make(map[string][]dedupRow),
+	}
+}
+
+func (g *dedupGroups) add(r inputRow, req weatherapi.WeatherAPIRequest) {
+	key := g.opts.key(req)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.groups[key]; !ok {
+		g.keys = append(g.keys, key)
+	}
+	g.groups[key] = append(g.groups[key], dedupRow{row: r, req: req})
+}
+
+// messages returns a message for every MaxRows rows of each group, in the order the groups were
+// first seen. The first row of a message, by row number, is the one the weather is fetched for.
+func (g *dedupGroups) messages() (messages []pendingMessage, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	maxRows := g.opts.MaxRows
+	if maxRows < 1 {
+		maxRows = 1
+	}
+	for _, key := range g.keys {
+		rows := g.groups[key]
+		// rows are added by several workers, so they aren't necessarily in order.
+		sort.Slice(rows, func(i, j int) bool { return rows[i].row.number < rows[j].row.number })
+		for start := 0; start < len(rows); start += maxRows {
+			end := start + maxRows
+			if end > len(rows) {
+				end = len(rows)
+			}
+			m := pendingMessage{}
+			req := rows[start].req
+			for _, r := range rows[start:end] {
+				m.rows = append(m.rows, r.row)
+				if r.row.number != req.Row {
+					req.Rows = append(req.Rows, weatherapi.RequestRow{Row: r.req.Row, Lat: r.req.Lat, Lon: r.req.Lon, Metadata: r.req.Metadata})
+				}
+			}
+			if m.body, err = encodeRequest(req); err != nil {
+				return
+			}
+			messages = append(messages, m)
+		}
+	}
+	return
+}
+
+// len is the number of rows collected.
+func (g *dedupGroups) len() (n int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, rows := range g.groups {
+		n += len(rows)
+	}
+	return
+}
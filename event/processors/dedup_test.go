@@ -0,0 +1,134 @@
+package processors
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/antonielabuschagne/data-loader/weatherapi"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+	"github.com/joerdav/zapray"
+)
+
+func TestS3EventProcessorDedup(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+	rows := func(from, to int) (rows []weatherapi.RequestRow) {
+		for i := from; i <= to; i++ {
+			rows = append(rows, weatherapi.RequestRow{Row: i, Lat: "2", Lon: "1"})
+		}
+		return
+	}
+
+	tests := []struct {
+		description      string
+		content          string
+		opts             DedupOptions
+		concurrency      int
+		queueErr         error
+		expectedRequests []weatherapi.WeatherAPIRequest
+		expectedFailed   int
+	}{
+		{
+			description: "given repeated coordinates, they're queued once with the rows they serve",
+			content:     "lon,lat,store\n1,2,A\n1,2,B\n3,4,C\n1.00001,2.0,D\n",
+			opts:        DefaultDedupOptions(),
+			expectedRequests: []weatherapi.WeatherAPIRequest{
+				{Lon: "1", Lat: "2", Row: 1, Metadata: map[string]string{"store": "A"}, Rows: []weatherapi.RequestRow{
+					{Row: 2, Lat: "2", Lon: "1", Metadata: map[string]string{"store": "B"}},
+					{Row: 4, Lat: "2", Lon: "1", Metadata: map[string]string{"store": "D"}},
+				}},
+				{Lon: "3", Lat: "4", Row: 3, Metadata: map[string]string{"store": "C"}},
+			},
+		},
+		{
+			description: "given nearby coordinates in the same grid cell, they're queued once",
+			content:     "lon,lat\n1,2\n1.02,2.01\n1.2,2\n",
+			opts:        DedupOptions{Grid: 0.1, MaxRows: 100},
+			expectedRequests: []weatherapi.WeatherAPIRequest{
+				{Lon: "1", Lat: "2", Row: 1, Rows: []weatherapi.RequestRow{{Row: 2, Lat: "2.01", Lon: "1.02"}}},
+				{Lon: "1.2", Lat: "2", Row: 3},
+			},
+		},
+		{
+			description: "given the same coordinates in different units, they're queued separately",
+			content:     "lon,lat,units\n1,2,metric\n1,2,imperial\n1,2,metric\n",
+			opts:        DefaultDedupOptions(),
+			expectedRequests: []weatherapi.WeatherAPIRequest{
+				{Lon: "1", Lat: "2", Row: 1, Units: weatherapi.UnitsMetric, Rows: rows(3, 3)},
+				{Lon: "1", Lat: "2", Row: 2, Units: weatherapi.UnitsImperial},
+			},
+		},
+		{
+			description: "given more rows than fit in a message, they're split across messages in row order",
+			content:     "lon,lat\n" + strings.Repeat("1,2\n", 25),
+			opts:        DedupOptions{MaxRows: 10},
+			concurrency: 4,
+			expectedRequests: []weatherapi.WeatherAPIRequest{
+				{Lon: "1", Lat: "2", Row: 1, Rows: rows(2, 10)},
+				{Lon: "1", Lat: "2", Row: 11, Rows: rows(12, 20)},
+				{Lon: "1", Lat: "2", Row: 21, Rows: rows(22, 25)},
+			},
+		},
+		{
+			description:    "given a message can't be queued, every row it serves is failed",
+			content:        "lon,lat\n1,2\n1,2\n1,2\n",
+			opts:           DefaultDedupOptions(),
+			queueErr:       errors.New("message queue unavailable"),
+			expectedFailed: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		fetcher := func(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error) {
+			rc = io.NopCloser(strings.NewReader(tt.content))
+			return
+		}
+		var mu sync.Mutex
+		var requests []weatherapi.WeatherAPIRequest
+		messageQueue := func(ctx context.Context, message string) (messageId string, err error) {
+			if tt.queueErr != nil {
+				err = tt.queueErr
+				return
+			}
+			var req weatherapi.WeatherAPIRequest
+			if err = json.Unmarshal([]byte(message), &req); err != nil {
+				return
+			}
+			req.JobId = ""
+			mu.Lock()
+			requests = append(requests, req)
+			mu.Unlock()
+			messageId = uuid.New().String()
+			return
+		}
+		tracker := &syncJobTracker{}
+		ep := NewS3EventProcessor(fetcher, messageQueue, logger)
+		ep.Dedup = &tt.opts
+		ep.Concurrency = tt.concurrency
+		ep.Jobs = tracker
+		messages, err := ep.Process(context.Background(), buildS3Event("data.csv"))
+		if err != nil {
+			t.Errorf("%s: unable to process: %v", tt.description, err)
+		}
+		if len(messages) != len(tt.expectedRequests) {
+			t.Errorf("%s: got %d messages, expected %d", tt.description, len(messages), len(tt.expectedRequests))
+		}
+		if diff := cmp.Diff(tt.expectedRequests, requests); diff != "" {
+			t.Errorf("%s: unexpected requests: %s", tt.description, diff)
+		}
+		if tracker.failed != tt.expectedFailed {
+			t.Errorf("%s: got %d failed rows, expected %d", tt.description, tracker.failed, tt.expectedFailed)
+		}
+		if expected := strings.Count(tt.content, "\n") - 1; tracker.expected != expected {
+			t.Errorf("%s: got a row count of %d, expected %d", tt.description, tracker.expected, expected)
+		}
+	}
+}
@@ -4,22 +4,38 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"time"
 
+	"github.com/antonielabuschagne/data-loader/results"
 	weather "github.com/antonielabuschagne/data-loader/weatherapi"
 	"github.com/joerdav/zapray"
 	"go.uber.org/zap"
 )
 
-type WeatherFetcherFunc func(ctx context.Context, lon, lat string) (result weather.WeatherAPIResponse, err error)
+// WeatherFetcherFunc gets the weather from a provider, e.g. weather.Provider.Observe.
+type WeatherFetcherFunc func(ctx context.Context, lon, lat string, opts weather.Options) (result weather.Observation, err error)
+
+// ResultSink receives the enriched record for every successfully processed message. Records may be
+// buffered until Flush is called.
+type ResultSink interface {
+	Write(ctx context.Context, r results.Record) error
+	Flush(ctx context.Context) error
+}
 
 type MessageProcessor struct {
 	Log           *zapray.Logger
 	WeatherClient WeatherFetcherFunc
+	// Sink is optional, without it results are only logged.
+	Sink ResultSink
+	// Defaults are the options used when a message doesn't set its own, they're recorded with
+	// the result so it's clear what units it's in.
+	Defaults weather.Options
 }
 
 func NewMessageProcessor(log *zapray.Logger, wc WeatherFetcherFunc) (mp MessageProcessor) {
 	mp.Log = log
 	mp.WeatherClient = wc
+	mp.Defaults = weather.DefaultOptions()
 	return
 }
 
@@ -33,11 +49,48 @@ func (mp *MessageProcessor) Process(ctx context.Context, message string) (err er
 		err = errors.New("invalid message, lon/lat required")
 		return
 	}
-	res, err := mp.WeatherClient(ctx, req.Lon, req.Lat)
+	opts := req.Options().WithDefaults(mp.Defaults)
+	res, err := mp.WeatherClient(ctx, req.Lon, req.Lat, opts)
 	if err != nil {
 		log.Error("unable to query weather API", zap.String("error", err.Error()))
 		return
 	}
-	log.Info("weather data retrieved", zap.String("description", res.WeatherResults[0].Description), zap.Float64("temp", res.Main.Temp))
+	fields := []zap.Field{zap.String("provider", string(res.Provider)), zap.Float64("temp", res.Main.Temp), zap.String("units", string(opts.Units))}
+	if !opts.At.IsZero() {
+		fields = append(fields, zap.Time("at", opts.At))
+	}
+	if len(res.Conditions) > 0 {
+		fields = append(fields, zap.String("description", res.Conditions[0].Description))
+	}
+	if len(req.Rows) > 0 {
+		fields = append(fields, zap.Int("rows", len(req.Rows)+1))
+	}
+	log.Info("weather data retrieved", fields...)
+	if mp.Sink == nil {
+		return
+	}
+	// a deduplicated request has a result for every row it serves.
+	fetchedAt := time.Now().UTC()
+	for _, r := range req.FanOut() {
+		err = mp.Sink.Write(ctx, results.Record{
+			Request:   r,
+			Weather:   res,
+			Units:     opts.Units,
+			Lang:      opts.Lang,
+			FetchedAt: fetchedAt,
+		})
+		if err != nil {
+			log.Error("unable to write weather result", zap.String("error", err.Error()), zap.Int("row", r.Row))
+			return
+		}
+	}
 	return
 }
+
+// Flush writes out any results buffered by the sink.
+func (mp *MessageProcessor) Flush(ctx context.Context) (err error) {
+	if mp.Sink == nil {
+		return
+	}
+	return mp.Sink.Flush(ctx)
+}
@@ -5,7 +5,10 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/antonielabuschagne/data-loader/results"
 	weather "github.com/antonielabuschagne/data-loader/weatherapi"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/joerdav/zapray"
 )
 
@@ -23,16 +26,16 @@ func TestMessageProcessor(t *testing.T) {
 	}{
 		{
 			description: "given a valid message and weather API response, successful response returned",
-			weatherFetcher: func(ctx context.Context, lon, lat string) (result weather.WeatherAPIResponse, err error) {
-				result = buildGoodWeatherResponse()
+			weatherFetcher: func(ctx context.Context, lon, lat string, opts weather.Options) (result weather.Observation, err error) {
+				result = buildGoodObservation()
 				return
 			},
 			message: `{"lat": "123", "lon": "123"}`,
 		},
 		{
 			description: "given a bad message data, failed response returned",
-			weatherFetcher: func(ctx context.Context, lon, lat string) (result weather.WeatherAPIResponse, err error) {
-				result = buildGoodWeatherResponse()
+			weatherFetcher: func(ctx context.Context, lon, lat string, opts weather.Options) (result weather.Observation, err error) {
+				result = buildGoodObservation()
 				return
 			},
 			message:       `{"lat": "123"}`,
@@ -40,8 +43,8 @@ func TestMessageProcessor(t *testing.T) {
 		},
 		{
 			description: "given a bad message, failed response returned",
-			weatherFetcher: func(ctx context.Context, lon, lat string) (result weather.WeatherAPIResponse, err error) {
-				result = buildGoodWeatherResponse()
+			weatherFetcher: func(ctx context.Context, lon, lat string, opts weather.Options) (result weather.Observation, err error) {
+				result = buildGoodObservation()
 				return
 			},
 			message:       `{"lat": "123}`,
@@ -49,7 +52,7 @@ func TestMessageProcessor(t *testing.T) {
 		},
 		{
 			description: "given a good message and bad API response, failed response returned",
-			weatherFetcher: func(ctx context.Context, lon, lat string) (result weather.WeatherAPIResponse, err error) {
+			weatherFetcher: func(ctx context.Context, lon, lat string, opts weather.Options) (result weather.Observation, err error) {
 				err = errors.New("rate limit exceeded")
 				return
 			},
@@ -75,9 +78,10 @@ func TestMessageProcessor(t *testing.T) {
 	}
 }
 
-func buildGoodWeatherResponse() weather.WeatherAPIResponse {
-	return weather.WeatherAPIResponse{
-		Coorinates: weather.Coorinates{
+func buildGoodObservation() weather.Observation {
+	return weather.Observation{
+		Provider: weather.OpenWeatherMap,
+		Coordinates: weather.Coordinates{
 			Lon: 1,
 			Lat: 2,
 		},
@@ -88,9 +92,9 @@ func buildGoodWeatherResponse() weather.WeatherAPIResponse {
 			FeelsLike: 25,
 			Humidity:  90,
 		},
-		WeatherResults: []weather.Weather{
+		Conditions: []weather.Condition{
 			{
-				ID:          1,
+				Code:        1,
 				Description: "warm",
 				Main:        "main",
 				Icon:        "icon",
@@ -98,3 +102,143 @@ func buildGoodWeatherResponse() weather.WeatherAPIResponse {
 		},
 	}
 }
+
+type recordingSink struct {
+	records []results.Record
+	flushed bool
+}
+
+func (s *recordingSink) Write(ctx context.Context, r results.Record) error {
+	s.records = append(s.records, r)
+	return nil
+}
+
+func (s *recordingSink) Flush(ctx context.Context) error {
+	s.flushed = true
+	return nil
+}
+
+func TestMessageProcessorSink(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+	sink := &recordingSink{}
+	mp := NewMessageProcessor(logger, func(ctx context.Context, lon, lat string, opts weather.Options) (result weather.Observation, err error) {
+		result = buildGoodObservation()
+		return
+	})
+	mp.Sink = sink
+
+	if err := mp.Process(context.Background(), `{"lat": "1", "lon": "2", "metadata": {"store": "A1"}}`); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := mp.Process(context.Background(), `{"lat": "1"}`); err == nil {
+		t.Fatal("expected error for invalid message")
+	}
+	if err := mp.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error flushing: %v", err)
+	}
+
+	expected := []results.Record{{
+		Request: weather.WeatherAPIRequest{Lat: "1", Lon: "2", Metadata: map[string]string{"store": "A1"}},
+		Weather: buildGoodObservation(),
+		Units:   weather.UnitsStandard,
+	}}
+	if !cmp.Equal(sink.records, expected, cmpopts.IgnoreFields(results.Record{}, "FetchedAt")) {
+		t.Errorf("got records %v, expected %v", sink.records, expected)
+	}
+	if len(sink.records) == 1 && sink.records[0].FetchedAt.IsZero() {
+		t.Error("expected fetch timestamp to be recorded")
+	}
+	if !sink.flushed {
+		t.Error("expected sink to be flushed")
+	}
+}
+
+func TestMessageProcessorFanOut(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+	var calls int
+	sink := &recordingSink{}
+	mp := NewMessageProcessor(logger, func(ctx context.Context, lon, lat string, opts weather.Options) (result weather.Observation, err error) {
+		calls++
+		result = buildGoodObservation()
+		return
+	})
+	mp.Sink = sink
+
+	message := `{"lat": "1", "lon": "2", "job_id": "job", "row": 1, "metadata": {"store": "A1"}, "rows": [{"row": 4, "lat": "1.001", "lon": "2", "metadata": {"store": "B2"}}]}`
+	if err := mp.Process(context.Background(), message); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("got %d weather calls, expected 1", calls)
+	}
+	expected := []results.Record{
+		{
+			Request: weather.WeatherAPIRequest{Lat: "1", Lon: "2", JobId: "job", Row: 1, Metadata: map[string]string{"store": "A1"}},
+			Weather: buildGoodObservation(),
+			Units:   weather.UnitsStandard,
+		},
+		{
+			Request: weather.WeatherAPIRequest{Lat: "1.001", Lon: "2", JobId: "job", Row: 4, Metadata: map[string]string{"store": "B2"}},
+			Weather: buildGoodObservation(),
+			Units:   weather.UnitsStandard,
+		},
+	}
+	if diff := cmp.Diff(expected, sink.records, cmpopts.IgnoreFields(results.Record{}, "FetchedAt")); diff != "" {
+		t.Errorf("unexpected records: %s", diff)
+	}
+}
+
+func TestMessageProcessorOptions(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+
+	tests := []struct {
+		description string
+		message     string
+		expected    weather.Options
+	}{
+		{
+			description: "given a message without options, the defaults are used",
+			message:     `{"lat": "1", "lon": "2"}`,
+			expected:    weather.Options{Units: weather.UnitsMetric, Lang: "de"},
+		},
+		{
+			description: "given a message with options, they override the defaults",
+			message:     `{"lat": "1", "lon": "2", "units": "imperial", "lang": "fr"}`,
+			expected:    weather.Options{Units: weather.UnitsImperial, Lang: "fr"},
+		},
+		{
+			description: "given a message with only units, the default language is used",
+			message:     `{"lat": "1", "lon": "2", "units": "standard"}`,
+			expected:    weather.Options{Units: weather.UnitsStandard, Lang: "de"},
+		},
+	}
+
+	for _, tt := range tests {
+		var requested weather.Options
+		sink := &recordingSink{}
+		mp := NewMessageProcessor(logger, func(ctx context.Context, lon, lat string, opts weather.Options) (result weather.Observation, err error) {
+			requested = opts
+			return
+		})
+		mp.Defaults = weather.Options{Units: weather.UnitsMetric, Lang: "de"}
+		mp.Sink = sink
+		if err := mp.Process(context.Background(), tt.message); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.description, err)
+		}
+		if requested != tt.expected {
+			t.Errorf("%s: requested %v, expected %v", tt.description, requested, tt.expected)
+		}
+		if len(sink.records) != 1 || sink.records[0].Units != tt.expected.Units || sink.records[0].Lang != tt.expected.Lang {
+			t.Errorf("%s: got records %v, expected options %v", tt.description, sink.records, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package processors
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/antonielabuschagne/data-loader/localfs"
+	"github.com/antonielabuschagne/data-loader/messagequeue"
+	"github.com/antonielabuschagne/data-loader/results"
+	weather "github.com/antonielabuschagne/data-loader/weatherapi"
+	"github.com/google/go-cmp/cmp"
+	"github.com/joerdav/zapray"
+)
+
+// TestPipeline runs a file through ingest and message processing, with the bucket and queue held
+// locally.
+func TestPipeline(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+	ctx := context.Background()
+	bucket := localfs.NewMemoryStore()
+	bucket.Write(ctx, "weather-data/stores.csv", []byte("lon,lat,store\n1,2,A\n3,4,B\n1,2,C\n"))
+	queue := messagequeue.NewLocalQueue()
+	queue.MaxReceiveCount = 2
+
+	ep := NewS3EventProcessor(bucket.Fetch, queue.SendMessage, logger)
+	ep.MessageBatchQueue = queue.SendMessageBatch
+	ep.Dedup = &DedupOptions{MaxRows: 10}
+	if _, err := ep.Process(ctx, buildS3Event("weather-data/stores.csv")); err != nil {
+		t.Fatalf("unable to ingest: %v", err)
+	}
+
+	var attempts int
+	mp := NewMessageProcessor(logger, func(ctx context.Context, lon, lat string, opts weather.Options) (o weather.Observation, err error) {
+		attempts++
+		// the first attempt fails, so the message has to be delivered again.
+		if attempts == 1 {
+			err = context.DeadlineExceeded
+			return
+		}
+		o.Location.Name = lon + "," + lat
+		return
+	})
+	mp.Sink = results.NewJSONLinesSink(bucket.Write, "results")
+	for queue.Len() > 0 {
+		messages, err := queue.Receive(ctx, 10)
+		if err != nil {
+			t.Fatalf("unable to receive: %v", err)
+		}
+		for _, m := range messages {
+			if err := mp.Process(ctx, m.Body); err != nil {
+				queue.ChangeVisibility(ctx, m.ReceiptHandle, 0)
+				continue
+			}
+			queue.Delete(ctx, m.ReceiptHandle)
+		}
+	}
+	if err := mp.Flush(ctx); err != nil {
+		t.Fatalf("unable to flush: %v", err)
+	}
+	if dead := queue.DeadLetters(); len(dead) != 0 {
+		t.Errorf("got %d dead letters, expected none", len(dead))
+	}
+
+	stores := map[string]string{}
+	for _, key := range bucket.Keys() {
+		if !strings.HasPrefix(key, "results/") {
+			continue
+		}
+		data, _ := bucket.Get(key)
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			var r results.Record
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				t.Fatalf("unable to decode result: %v", err)
+			}
+			stores[r.Request.Metadata["store"]] = r.Weather.Location.Name
+		}
+	}
+	expected := map[string]string{"A": "1,2", "B": "3,4", "C": "1,2"}
+	if diff := cmp.Diff(expected, stores); diff != "" {
+		t.Errorf("unexpected results: %s", diff)
+	}
+}
@@ -0,0 +1,79 @@
+package processors
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// rejectLog collects the rows of a file that couldn't be queued. It's safe for concurrent use.
+type rejectLog struct {
+	mu sync.Mutex
+	// max is the most rows kept, 0 for no limit. Rows rejected after that are only counted, so a
+	// file of nothing but bad rows can't run the function out of memory.
+	max     int
+	rows    []rejectedRow
+	dropped int
+}
+
+type rejectedRow struct {
+	line   int
+	reason string
+	fields []string
+}
+
+func (l *rejectLog) add(line int, reason string, fields []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && len(l.rows) >= l.max {
+		l.dropped++
+		return
+	}
+	l.rows = append(l.rows, rejectedRow{line: line, reason: reason, fields: fields})
+}
+
+// addNote is add for a row about the file as a whole, e.g. where reading stopped, which is kept
+// even when the log is full.
+func (l *rejectLog) addNote(line int, reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rows = append(l.rows, rejectedRow{line: line, reason: reason})
+}
+
+// len is the number of rows rejected, including those that weren't kept.
+func (l *rejectLog) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.rows) + l.dropped
+}
+
+// encode returns the rejected rows as CSV, in file order, with the line number and reason ahead of
+// the original columns. When rows weren't kept, a last row without a line number says how many.
+func (l *rejectLog) encode(header []string) (data []byte, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sort.SliceStable(l.rows, func(i, j int) bool {
+		return l.rows[i].line < l.rows[j].line
+	})
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err = w.Write(append([]string{"line", "reason"}, header...)); err != nil {
+		return
+	}
+	for _, r := range l.rows {
+		if err = w.Write(append([]string{strconv.Itoa(r.line), r.reason}, r.fields...)); err != nil {
+			return
+		}
+	}
+	if l.dropped > 0 {
+		if err = w.Write([]string{"", fmt.Sprintf("%d more rows were rejected, only the first %d are listed", l.dropped, l.max)}); err != nil {
+			return
+		}
+	}
+	w.Flush()
+	data, err = buf.Bytes(), w.Error()
+	return
+}
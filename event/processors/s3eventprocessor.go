@@ -2,14 +2,20 @@ package processors
 
 import (
 	"context"
-	"encoding/csv"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"path"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/antonielabuschagne/data-loader/messagequeue"
+	"github.com/antonielabuschagne/data-loader/results"
 	"github.com/antonielabuschagne/data-loader/weatherapi"
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
 	"github.com/joerdav/zapray"
 	"go.uber.org/zap"
 )
@@ -18,70 +24,415 @@ type EventProcessor interface {
 	Process(ctx context.Context, e events.S3Event) (processed []string, err error)
 }
 
-type DataFetcherFunc func(ctx context.Context, key string) (rc io.ReadCloser, err error)
+// DataFetcherFunc fetches an object from a bucket. versionId and eTag are optional, when they're
+// given the fetch should fail rather than return any other version of the object.
+type DataFetcherFunc func(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error)
+
+// contentTyper is implemented by fetched content that knows its media type, it's used to pick a
+// decoder for files without a recognised extension.
+type contentTyper interface {
+	ContentType() string
+}
 type EventNotifierFunc func(ctx context.Context)
 type MessageQueueFunc func(ctx context.Context, message string) (messageId string, err error)
 
+// MessageBatchQueueFunc sends several messages at once, returning a result for each message in
+// the same order they were given.
+type MessageBatchQueueFunc func(ctx context.Context, messages []string) (results []messagequeue.BatchResult, err error)
+
+// JobTracker follows each file through the pipeline as a job, so there's a signal once all of its
+// rows have been processed.
+type JobTracker interface {
+	// SetExpected records the rows of a file once it's been read. truncated is set when reading
+	// stopped early, expected is then the rows that were read.
+	SetExpected(ctx context.Context, jobId, sourceKey string, expected int, truncated bool) error
+	RecordRow(ctx context.Context, jobId string, row int, succeeded bool) error
+}
+
 type S3EventProcessor struct {
 	DataFetcher  DataFetcherFunc
 	Log          *zapray.Logger
 	MessageQueue MessageQueueFunc
+	// MessageBatchQueue is used in preference to MessageQueue when set, sending rows in batches of
+	// up to messagequeue.MaxBatchEntries.
+	MessageBatchQueue MessageBatchQueueFunc
+	// Decoders picks how to read each file, files without a decoder are skipped.
+	Decoders    Decoders
+	Columns     ColumnAliases
+	Coordinates CoordinateOptions
+	// Coverage is the range of times the weather provider has weather for, rows asking for a time
+	// outside it are rejected.
+	Coverage weatherapi.Coverage
+	// Jobs is optional. When set, rows that can't be queued are recorded as failed and the row
+	// count is recorded once the file has been read.
+	Jobs JobTracker
+	// Rejects is optional. When set, rows that can't be queued are written to a CSV file under
+	// RejectsPrefix, at the same key as the source file, with the line number and reason.
+	Rejects       results.DataWriterFunc
+	RejectsPrefix string
+	// MaxRejects is the most rejected rows of a file held in memory to be written, 0 for no limit.
+	// Any more are counted in the last row of the rejects file.
+	MaxRejects int
+	// Dedup is optional. When set, rows wanting the weather for the same place, in the same units and
+	// language and for the same time, are queued as a single message serving all of them. The rows
+	// are held until the whole file has been read, then queued.
+	Dedup *DedupOptions
+	// Concurrency is the number of workers converting and queueing the rows of a file.
+	Concurrency int
+	// TempDir is where zip archives are copied to while they're read, the default temporary
+	// directory is used when it's empty.
+	TempDir string
+	// DeadlineMargin is how long before the context deadline to stop reading a file, leaving time
+	// to queue the rows that have already been read.
+	DeadlineMargin time.Duration
 }
 
 func NewS3EventProcessor(df DataFetcherFunc, mq MessageQueueFunc, log *zapray.Logger) (p S3EventProcessor) {
 	p.DataFetcher = df
 	p.MessageQueue = mq
 	p.Log = log
+	p.Decoders = DefaultDecoders()
+	p.Columns = DefaultColumnAliases()
+	p.Coordinates = DefaultCoordinateOptions()
+	p.Coverage = weatherapi.OpenWeatherMapCoverage
+	p.RejectsPrefix = "rejects"
+	p.MaxRejects = 10000
+	p.Concurrency = 1
+	p.DeadlineMargin = 5 * time.Second
 	return
 }
 
 func (ep S3EventProcessor) Process(ctx context.Context, e events.S3Event) (processed []string, err error) {
 	log := ep.Log
 	for _, r := range e.Records {
-		key := r.S3.Object.Key
-		log.Info("processing s3 event", zap.String("key", key))
-		if !strings.HasSuffix(key, ".csv") {
-			log.Warn("skipping file extension")
-			continue
-		}
-		messages, err := ep.processFile(ctx, key)
+		bucket, key := r.S3.Bucket.Name, objectKey(r.S3.Object)
+		log.Info("processing s3 event", zap.String("bucket", bucket), zap.String("key", key))
+		messages, err := ep.processFile(ctx, bucket, key, r.S3.Object)
+		// rows are queued as the file is read, so anything queued before a failure still counts.
+		processed = append(processed, messages...)
 		if err != nil {
-			log.Error("unable to process file", zap.String("error", err.Error()))
+			log.Error("unable to process file", zap.String("error", err.Error()), zap.Int("queued", len(messages)))
 			continue
 		}
-		processed = append(processed, messages...)
-		log.Info("messages processed", zap.Any("messages", messages))
+		log.Info("messages processed", zap.Int("count", len(messages)))
 	}
 	return
 }
 
-func (ep S3EventProcessor) processFile(ctx context.Context, key string) (processed []string, err error) {
+// objectKey is the key of the object in an event. Keys are URL encoded in S3 events, e.g. a space
+// is a +, and decoded when the event is unmarshalled; events made in code are used as they are.
+func objectKey(o events.S3Object) string {
+	if o.URLDecodedKey != "" {
+		return o.URLDecodedKey
+	}
+	return o.Key
+}
+
+// processFile fetches the version of the object the event was for, so a file that's been replaced
+// since isn't read in its place. The replacement has an event of its own.
+func (ep S3EventProcessor) processFile(ctx context.Context, bucket, key string, object events.S3Object) (processed []string, err error) {
 	log := ep.Log
-	lines, err := ep.getS3FileContent(ctx, key)
-	if len(lines) <= 1 {
+	log.Info("processing entry", zap.String("bucket", bucket), zap.String("key", key))
+	r, err := ep.DataFetcher(ctx, bucket, key, object.VersionID, object.ETag)
+	if err != nil {
+		log.Error("unable to fetch data for key", zap.String("error", err.Error()), zap.String("bucket", bucket), zap.String("key", key))
+		return
+	}
+	defer r.Close()
+
+	if strings.EqualFold(path.Ext(key), ".zip") {
+		return ep.processArchive(ctx, key, r)
+	}
+	var contentType, contentEncoding string
+	if ct, ok := r.(contentTyper); ok {
+		contentType = ct.ContentType()
+	}
+	if ce, ok := r.(contentEncoder); ok {
+		contentEncoding = ce.ContentEncoding()
+	}
+	return ep.processContent(ctx, key, r, contentType, contentEncoding)
+}
+
+// processContent reads the rows of a file and queues them, key is used to identify the file in
+// logs, the job and the rejects file.
+func (ep S3EventProcessor) processContent(ctx context.Context, key string, r io.Reader, contentType, contentEncoding string) (processed []string, err error) {
+	log := ep.Log
+	name, dr, err := decompress(key, contentEncoding, r)
+	if err != nil {
+		return
+	}
+	defer dr.Close()
+	decoder, ok := ep.Decoders.lookup(name, contentType)
+	if !ok {
+		log.Warn("skipping unsupported file", zap.String("key", key), zap.String("contentType", contentType))
+		return
+	}
+	rr := decoder(dr)
+	header, err := rr.Header()
+	if err == io.EOF {
 		log.Info("file content empty (first row reserved for column heading)")
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	f := &inputFile{
+		key:     key,
+		name:    name,
+		jobId:   uuid.New().String(),
+		header:  header,
+		rejects: &rejectLog{max: ep.MaxRejects},
+	}
+	if ep.Dedup != nil {
+		f.groups = newDedupGroups(*ep.Dedup)
+	}
+	// a file missing the coordinate columns is rejected as a whole, with the heading row as the reason.
+	lon, lat := -1, -1
+	if cr, ok := rr.(CoordinateReader); ok {
+		lon, lat = cr.CoordinateColumns()
+	}
+	if f.columns, err = ep.Columns.resolveWith(header, lon, lat); err != nil {
+		f.rejects.add(1, err.Error(), header)
+		ep.writeRejects(ctx, f)
 		return
 	}
+	log.Info("processing file", zap.String("jobId", f.jobId), zap.Int("concurrency", ep.concurrency()))
+
+	// reading stops a little before the deadline, so the rows already read can still be queued.
+	readCtx := ctx
+	if deadline, ok := ctx.Deadline(); ok && ep.DeadlineMargin > 0 {
+		var cancel context.CancelFunc
+		readCtx, cancel = context.WithDeadline(ctx, deadline.Add(-ep.DeadlineMargin))
+		defer cancel()
+	}
+
+	// rows are handed to the workers in chunks, which is also the size of a message batch.
+	chunks := make(chan []inputRow)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < ep.concurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunks {
+				messageIds := ep.queueRows(ctx, f, chunk)
+				mu.Lock()
+				processed = append(processed, messageIds...)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var rows int
+	// lastLine is where the last row read starts, the heading row is taken to be line 1.
+	lastLine := 1
+	chunk := make([]inputRow, 0, messagequeue.MaxBatchEntries)
+read:
+	for {
+		if err = readCtx.Err(); err != nil {
+			break
+		}
+		fields, line, readErr := rr.Read()
+		if readErr == io.EOF {
+			break
+		}
+		var rowErr *RowError
+		if errors.As(readErr, &rowErr) {
+			rows++
+			lastLine = rowErr.Line
+			log.Error("unable to decode row", zap.String("error", readErr.Error()), zap.Int("row", rows))
+			ep.rejectRow(ctx, f, inputRow{number: rows, line: rowErr.Line, fields: rowErr.Fields}, rowErr.Err)
+			continue
+		}
+		if readErr != nil {
+			err = readErr
+			break
+		}
+		rows++
+		lastLine = line
+		chunk = append(chunk, inputRow{number: rows, line: line, fields: fields})
+		if len(chunk) < messagequeue.MaxBatchEntries {
+			continue
+		}
+		select {
+		case chunks <- chunk:
+			chunk = make([]inputRow, 0, messagequeue.MaxBatchEntries)
+		case <-readCtx.Done():
+			err = readCtx.Err()
+			break read
+		}
+	}
+	// whatever was read before the file failed is still worth sending.
+	if len(chunk) > 0 {
+		chunks <- chunk
+	}
+	close(chunks)
+	wg.Wait()
+	if f.groups != nil {
+		processed = ep.queueGroups(ctx, f)
+	}
+	// a file that wasn't read to the end, e.g. because time ran out, is truncated: the job expects
+	// the rows that were read so it still completes, and the rejects say where reading stopped.
+	truncated := err != nil
+	if truncated {
+		log.Warn("file truncated", zap.String("error", err.Error()), zap.String("jobId", f.jobId), zap.Int("rows", rows), zap.Int("line", lastLine))
+		f.rejects.addNote(lastLine+1, fmt.Sprintf("reading stopped after row %d, the rest of the file wasn't queued: %s", rows, err.Error()))
+	}
+	ep.writeRejects(ctx, f)
 
-	log.Info("processing CSV file", zap.Int("rows", len(lines)))
-	for _, line := range lines[1:] {
-		messageId, err := ep.addToMessageQueue(ctx, line)
+	log.Info("file processed", zap.String("jobId", f.jobId), zap.Int("rows", rows), zap.Int("queued", len(processed)))
+	if ep.Jobs == nil {
+		return
+	}
+	if jobErr := ep.Jobs.SetExpected(ctx, f.jobId, key, rows, truncated); err == nil {
+		err = jobErr
+	}
+	return
+}
+
+func (ep S3EventProcessor) concurrency() int {
+	if ep.Concurrency < 1 {
+		return 1
+	}
+	return ep.Concurrency
+}
+
+// inputFile is the file being processed, shared by the workers queueing its rows.
+type inputFile struct {
+	key string
+	// name is the key without any compression extension, it's where rejects are written.
+	name    string
+	jobId   string
+	header  []string
+	columns columnMapping
+	rejects *rejectLog
+	// groups collects the rows of the file when they're deduplicated.
+	groups *dedupGroups
+}
+
+// inputRow is a data row read from a file, numbered from 1 for the first row after the headings.
+// line is where the row starts in the file, which differs from the number when there are blank
+// lines or fields span lines.
+type inputRow struct {
+	number int
+	line   int
+	fields []string
+}
+
+// queueRows converts and queues a chunk of rows, returning the message ids of the ones that were
+// queued. Rows that fail are logged and rejected. When rows are deduplicated they're only
+// collected, to be queued once the file has been read.
+func (ep S3EventProcessor) queueRows(ctx context.Context, f *inputFile, rows []inputRow) (messageIds []string) {
+	log := ep.Log
+	var pending []pendingMessage
+	for _, r := range rows {
+		req, err := convertRowToRequest(r.fields, f.columns, ep.Coordinates, ep.Coverage, f.jobId, r.number)
+		var message string
+		if err == nil && f.groups == nil {
+			message, err = encodeRequest(req)
+		}
 		if err != nil {
-			log.Error("unable to add message to queue", zap.String("error", err.Error()))
+			log.Error("unable to convert row into message", zap.String("error", err.Error()), zap.Int("row", r.number))
+			ep.rejectRow(ctx, f, r, err)
+			continue
+		}
+		if f.groups != nil {
+			f.groups.add(r, req)
 			continue
 		}
-		processed = append(processed, messageId)
+		pending = append(pending, pendingMessage{rows: []inputRow{r}, body: message})
+	}
+	return ep.sendMessages(ctx, f, pending)
+}
+
+// queueGroups queues the deduplicated rows of a file, in batches when there's a batch queue.
+func (ep S3EventProcessor) queueGroups(ctx context.Context, f *inputFile) (messageIds []string) {
+	log := ep.Log
+	rows := f.groups.len()
+	pending, err := f.groups.messages()
+	if err != nil {
+		log.Error("unable to convert rows into messages", zap.String("error", err.Error()))
+		return
+	}
+	log.Info("rows deduplicated", zap.String("jobId", f.jobId), zap.Int("rows", rows), zap.Int("messages", len(pending)))
+	for start := 0; start < len(pending); start += messagequeue.MaxBatchEntries {
+		end := start + messagequeue.MaxBatchEntries
+		if end > len(pending) {
+			end = len(pending)
+		}
+		messageIds = append(messageIds, ep.sendMessages(ctx, f, pending[start:end])...)
 	}
 	return
 }
 
-func (ep S3EventProcessor) addToMessageQueue(ctx context.Context, line []string) (messageId string, err error) {
+// sendMessages queues the messages, as a batch when there's a batch queue, returning the message
+// ids of the ones that were queued. The rows of messages that fail are rejected.
+func (ep S3EventProcessor) sendMessages(ctx context.Context, f *inputFile, pending []pendingMessage) (messageIds []string) {
+	if len(pending) == 0 {
+		return
+	}
+	if ep.MessageBatchQueue != nil {
+		return ep.addBatchToMessageQueue(ctx, f, pending)
+	}
 	log := ep.Log
-	message, err := convertRowToMessage(line)
+	for _, m := range pending {
+		messageId, err := ep.addToMessageQueue(ctx, m.body)
+		if err != nil {
+			for _, r := range m.rows {
+				log.Error("unable to add message to queue", zap.String("error", err.Error()), zap.Int("row", r.number))
+				ep.rejectRow(ctx, f, r, err)
+			}
+			continue
+		}
+		messageIds = append(messageIds, messageId)
+	}
+	return
+}
+
+// rejectRow records a row that won't be processed, against the job and in the rejects file.
+func (ep S3EventProcessor) rejectRow(ctx context.Context, f *inputFile, r inputRow, reason error) {
+	f.rejects.add(r.line, reason.Error(), r.fields)
+	if ep.Jobs == nil {
+		return
+	}
+	if err := ep.Jobs.RecordRow(ctx, f.jobId, r.number, false); err != nil {
+		ep.Log.Error("unable to record failed row", zap.String("error", err.Error()), zap.String("jobId", f.jobId), zap.Int("row", r.number))
+	}
+}
+
+// writeRejects writes the rejected rows of a file, if there are any, to <RejectsPrefix>/<name>.
+// They're always CSV, so .csv is added to the name of a file in any other format, e.g.
+// rejects/data.jsonl.csv, leaving it apart from the rejects of a data.csv.
+func (ep S3EventProcessor) writeRejects(ctx context.Context, f *inputFile) {
+	if ep.Rejects == nil || f.rejects.len() == 0 {
+		return
+	}
+	log := ep.Log
+	// S3 keys can contain .. too, which path.Join would resolve to somewhere outside the prefix.
+	for _, elem := range strings.Split(f.name, "/") {
+		if elem == ".." {
+			log.Error("not writing rejected rows for a key outside the rejects prefix", zap.String("key", f.name), zap.Int("rows", f.rejects.len()))
+			return
+		}
+	}
+	rejectsKey := path.Join(ep.RejectsPrefix, f.name)
+	if !strings.EqualFold(path.Ext(rejectsKey), ".csv") {
+		rejectsKey += ".csv"
+	}
+	data, err := f.rejects.encode(f.header)
+	if err == nil {
+		err = ep.Rejects(ctx, rejectsKey, data)
+	}
 	if err != nil {
-		log.Error("unable to convert row into message", zap.String("error", err.Error()))
+		log.Error("unable to write rejected rows", zap.String("error", err.Error()), zap.String("key", rejectsKey))
 		return
 	}
+	log.Info("rejected rows written", zap.String("key", rejectsKey), zap.Int("rows", f.rejects.len()))
+}
+
+func (ep S3EventProcessor) addToMessageQueue(ctx context.Context, message string) (messageId string, err error) {
+	log := ep.Log
 	log.Info("message details", zap.String("body", message))
 	messageId, err = ep.MessageQueue(ctx, message)
 	if err != nil {
@@ -92,31 +443,95 @@ func (ep S3EventProcessor) addToMessageQueue(ctx context.Context, line []string)
 	return
 }
 
-func (ep S3EventProcessor) getS3FileContent(ctx context.Context, key string) (lines [][]string, err error) {
+// pendingMessage is a message waiting to be sent, along with the rows it serves.
+type pendingMessage struct {
+	rows []inputRow
+	body string
+}
+
+// addBatchToMessageQueue sends the batch in one go and returns the message ids of the rows that
+// were queued. Rows that failed are logged individually.
+func (ep S3EventProcessor) addBatchToMessageQueue(ctx context.Context, f *inputFile, batch []pendingMessage) (messageIds []string) {
 	log := ep.Log
-	log.Info("processing entry", zap.String("key", key))
-	r, err := ep.DataFetcher(ctx, key)
+	messages := make([]string, len(batch))
+	for i, m := range batch {
+		messages[i] = m.body
+	}
+	results, err := ep.MessageBatchQueue(ctx, messages)
 	if err != nil {
-		log.Error("unable to fetch data for key", zap.String("key", key))
-		return
+		log.Error("unable to send message batch", zap.String("error", err.Error()))
 	}
-	defer r.Close()
-
-	lines, err = csv.NewReader(r).ReadAll()
+	for i, m := range batch {
+		r := messagequeue.BatchResult{Err: err}
+		if i < len(results) {
+			r = results[i]
+		}
+		if r.Err == nil && r.MessageId == "" {
+			r.Err = errors.New("no message id returned")
+		}
+		if r.Err != nil {
+			for _, row := range m.rows {
+				log.Error("unable to add message to queue", zap.String("error", r.Err.Error()), zap.Int("row", row.number))
+				ep.rejectRow(ctx, f, row, r.Err)
+			}
+			continue
+		}
+		messageIds = append(messageIds, r.MessageId)
+	}
+	log.Info("message batch queued", zap.Int("messages", len(batch)), zap.Int("queued", len(messageIds)))
 	return
 }
 
-func convertRowToMessage(row []string) (message string, err error) {
-	lon := row[0]
-	lat := row[1]
-	if lon == "" || lat == "" {
-		err = errors.New("bad data provided")
+func convertRowToRequest(row []string, columns columnMapping, opts CoordinateOptions, coverage weatherapi.Coverage, jobId string, rowNumber int) (wr weatherapi.WeatherAPIRequest, err error) {
+	var lon, lat string
+	if columns.lon < len(row) {
+		lon = row[columns.lon]
+	}
+	if columns.lat < len(row) {
+		lat = row[columns.lat]
+	}
+	if lon, err = opts.normaliseCoordinate(rowNumber, longitude, lon); err != nil {
+		return
+	}
+	if lat, err = opts.normaliseCoordinate(rowNumber, latitude, lat); err != nil {
 		return
 	}
-	wr := weatherapi.WeatherAPIRequest{
-		Lon: lon,
-		Lat: lat,
+	wr = weatherapi.WeatherAPIRequest{
+		Lon:   lon,
+		Lat:   lat,
+		JobId: jobId,
+		Row:   rowNumber,
+	}
+	if columns.units != -1 && columns.units < len(row) {
+		if wr.Units, err = weatherapi.ParseUnits(row[columns.units]); err != nil {
+			err = &ValidationError{Row: rowNumber, Field: "units", Value: row[columns.units], Reason: err.Error()}
+			return
+		}
+	}
+	if columns.lang != -1 && columns.lang < len(row) {
+		if wr.Lang, err = weatherapi.ParseLang(row[columns.lang]); err != nil {
+			err = &ValidationError{Row: rowNumber, Field: "lang", Value: row[columns.lang], Reason: err.Error()}
+			return
+		}
+	}
+	if columns.time != -1 && columns.time < len(row) {
+		if wr.At, err = parseRowTime(rowNumber, row[columns.time], coverage); err != nil {
+			return
+		}
 	}
+	for i, name := range columns.extra {
+		if i >= len(row) {
+			continue
+		}
+		if wr.Metadata == nil {
+			wr.Metadata = make(map[string]string, len(columns.extra))
+		}
+		wr.Metadata[name] = row[i]
+	}
+	return
+}
+
+func encodeRequest(wr weatherapi.WeatherAPIRequest) (message string, err error) {
 	d, err := json.Marshal(wr)
 	if err != nil {
 		return
@@ -124,3 +539,20 @@ func convertRowToMessage(row []string) (message string, err error) {
 	message = string(d)
 	return
 }
+
+// parseRowTime parses the time a row wants the weather for, checking the provider has weather for
+// it so the row isn't retried until it's dead lettered.
+func parseRowTime(rowNumber int, value string, coverage weatherapi.Coverage) (at *time.Time, err error) {
+	t, err := weatherapi.ParseTime(value)
+	if err == nil {
+		_, err = coverage.ModeAt(t, time.Now())
+	}
+	if err != nil {
+		err = &ValidationError{Row: rowNumber, Field: "time", Value: value, Reason: err.Error()}
+		return
+	}
+	if !t.IsZero() {
+		at = &t
+	}
+	return
+}
@@ -2,12 +2,22 @@ package processors
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"github.com/antonielabuschagne/data-loader/messagequeue"
+	"github.com/antonielabuschagne/data-loader/weatherapi"
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/google/uuid"
 	"github.com/joerdav/zapray"
 )
@@ -27,7 +37,7 @@ func TestNewS3EventProcessor(t *testing.T) {
 	}{
 		{
 			description: "given single line of coordinates, returns messageId",
-			fetcher: func(ctx context.Context, key string) (rc io.ReadCloser, err error) {
+			fetcher: func(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error) {
 				sr := strings.NewReader("lon,lat\n1,2")
 				rc = io.NopCloser(sr)
 				return
@@ -51,7 +61,7 @@ func TestNewS3EventProcessor(t *testing.T) {
 		},
 		{
 			description: "given multiple lines of coordinates, returns messageId's",
-			fetcher: func(ctx context.Context, key string) (rc io.ReadCloser, err error) {
+			fetcher: func(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error) {
 				sr := strings.NewReader("lon,lat\n1,2\n2,4\n5,6")
 				rc = io.NopCloser(sr)
 				return
@@ -75,7 +85,7 @@ func TestNewS3EventProcessor(t *testing.T) {
 		},
 		{
 			description: "given multiple files, returns messageId's for each of the lines",
-			fetcher: func(ctx context.Context, key string) (rc io.ReadCloser, err error) {
+			fetcher: func(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error) {
 				sr := strings.NewReader("lon,lat\n1,2\n2,4\n5,6")
 				rc = io.NopCloser(sr)
 				return
@@ -106,7 +116,7 @@ func TestNewS3EventProcessor(t *testing.T) {
 		},
 		{
 			description: "given just a csv heading row, no messages delivered",
-			fetcher: func(ctx context.Context, key string) (rc io.ReadCloser, err error) {
+			fetcher: func(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error) {
 				sr := strings.NewReader("lon,lat")
 				rc = io.NopCloser(sr)
 				return
@@ -128,9 +138,37 @@ func TestNewS3EventProcessor(t *testing.T) {
 			},
 			expectedCount: 0,
 		},
+		{
+			description: "given the file stream fails part way through, rows read before the failure are delivered",
+			fetcher: func(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error) {
+				r := io.MultiReader(strings.NewReader("lon,lat\n1,2\n3,4\n"), iotest.ErrReader(errors.New("connection reset")))
+				rc = io.NopCloser(r)
+				return
+			},
+			messageQueue: func(ctx context.Context, message string) (messageId string, err error) {
+				messageId = uuid.New().String()
+				return
+			},
+			s3event:       buildS3Event("data.csv"),
+			expectedCount: 2,
+		},
+		{
+			description: "given a short row, only that row is skipped",
+			fetcher: func(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error) {
+				sr := strings.NewReader("lon,lat\n1\n3,4")
+				rc = io.NopCloser(sr)
+				return
+			},
+			messageQueue: func(ctx context.Context, message string) (messageId string, err error) {
+				messageId = uuid.New().String()
+				return
+			},
+			s3event:       buildS3Event("data.csv"),
+			expectedCount: 1,
+		},
 		{
 			description: "given wrong key suffix, no messages delivered",
-			fetcher: func(ctx context.Context, key string) (rc io.ReadCloser, err error) {
+			fetcher: func(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error) {
 				sr := strings.NewReader("lon,lat\n1,2\n3,4")
 				rc = io.NopCloser(sr)
 				return
@@ -154,7 +192,7 @@ func TestNewS3EventProcessor(t *testing.T) {
 		},
 		{
 			description: "given fetcher returns an error, no messages delivered",
-			fetcher: func(ctx context.Context, key string) (rc io.ReadCloser, err error) {
+			fetcher: func(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error) {
 				err = errors.New("unable to fetch data")
 				return
 			},
@@ -177,7 +215,7 @@ func TestNewS3EventProcessor(t *testing.T) {
 		},
 		{
 			description: "given message queue is unavailable, no messages delivered",
-			fetcher: func(ctx context.Context, key string) (rc io.ReadCloser, err error) {
+			fetcher: func(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error) {
 				sr := strings.NewReader("lon,lat\n1,2\n3,4")
 				rc = io.NopCloser(sr)
 				return
@@ -212,3 +250,670 @@ func TestNewS3EventProcessor(t *testing.T) {
 		}
 	}
 }
+
+func TestS3EventProcessorColumnMapping(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+
+	tests := []struct {
+		description string
+		content     string
+		expected    []weatherapi.WeatherAPIRequest
+	}{
+		{
+			description: "given longitude/latitude headings, coordinates are mapped by name",
+			content:     "Longitude,Latitude\n1,2",
+			expected:    []weatherapi.WeatherAPIRequest{{Lon: "1", Lat: "2", Row: 1}},
+		},
+		{
+			description: "given latitude before longitude, coordinates are not swapped",
+			content:     "Latitude,Longitude\n1,2",
+			expected:    []weatherapi.WeatherAPIRequest{{Lon: "2", Lat: "1", Row: 1}},
+		},
+		{
+			description: "given aliased headings, coordinates are mapped by alias",
+			content:     "\ufeffY, X \n1,2",
+			expected:    []weatherapi.WeatherAPIRequest{{Lon: "2", Lat: "1", Row: 1}},
+		},
+		{
+			description: "given extra columns, they are passed through as metadata",
+			content:     "store,lat,lng,region\nA1,1,2,north",
+			expected: []weatherapi.WeatherAPIRequest{{
+				Lon:      "2",
+				Lat:      "1",
+				Metadata: map[string]string{"store": "A1", "region": "north"},
+				Row:      1,
+			}},
+		},
+		{
+			description: "given units and language columns, they are sent as options rather than metadata",
+			content:     "lon,lat,Units,language\n1,2,Metric,DE\n3,4,,",
+			expected: []weatherapi.WeatherAPIRequest{
+				{Lon: "1", Lat: "2", Units: weatherapi.UnitsMetric, Lang: "de", Row: 1},
+				{Lon: "3", Lat: "4", Row: 2},
+			},
+		},
+		{
+			description: "given invalid units or language, only those rows are skipped",
+			content:     "lon,lat,units,lang\n1,2,kelvin,en\n3,4,imperial,english\n5,6,imperial,pt_br",
+			expected:    []weatherapi.WeatherAPIRequest{{Lon: "5", Lat: "6", Units: weatherapi.UnitsImperial, Lang: "pt_br", Row: 3}},
+		},
+		{
+			description: "given a time column, each row asks for the weather at that time",
+			content:     "lon,lat,Timestamp\n1,2,2023-04-20T12:30:00+02:00\n3,4,\n5,6,2023-04-20",
+			expected: []weatherapi.WeatherAPIRequest{
+				{Lon: "1", Lat: "2", At: timeOf(time.Date(2023, 4, 20, 10, 30, 0, 0, time.UTC)), Row: 1},
+				{Lon: "3", Lat: "4", Row: 2},
+				{Lon: "5", Lat: "6", At: timeOf(time.Date(2023, 4, 20, 12, 0, 0, 0, time.UTC)), Row: 3},
+			},
+		},
+		{
+			description: "given an invalid time or one beyond the forecast, only those rows are skipped",
+			content:     "lon,lat,date\n1,2,yesterday\n3,4,2999-01-01\n5,6,1681986600",
+			expected:    []weatherapi.WeatherAPIRequest{{Lon: "5", Lat: "6", At: timeOf(time.Date(2023, 4, 20, 10, 30, 0, 0, time.UTC)), Row: 3}},
+		},
+		{
+			description: "given a missing latitude column, the file is rejected",
+			content:     "lon,store\n1,A1",
+		},
+		{
+			description: "given duplicate longitude columns, the file is rejected",
+			content:     "lon,lng,lat\n1,2,3",
+		},
+	}
+
+	for _, tt := range tests {
+		var messages []weatherapi.WeatherAPIRequest
+		fetcher := func(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error) {
+			rc = io.NopCloser(strings.NewReader(tt.content))
+			return
+		}
+		messageQueue := func(ctx context.Context, message string) (messageId string, err error) {
+			var req weatherapi.WeatherAPIRequest
+			if err = json.Unmarshal([]byte(message), &req); err != nil {
+				return
+			}
+			messages = append(messages, req)
+			messageId = uuid.New().String()
+			return
+		}
+		ep := NewS3EventProcessor(fetcher, messageQueue, logger)
+		_, err := ep.Process(context.Background(), buildS3Event("data.csv"))
+		if err != nil {
+			t.Errorf("%s: unable to process: %s", tt.description, err.Error())
+		}
+		if !cmp.Equal(messages, tt.expected, cmpopts.IgnoreFields(weatherapi.WeatherAPIRequest{}, "JobId")) {
+			t.Errorf("%s: got %v, expected %v", tt.description, messages, tt.expected)
+		}
+	}
+}
+
+func timeOf(t time.Time) *time.Time {
+	return &t
+}
+
+type typedContent struct {
+	io.Reader
+	contentType string
+}
+
+func (typedContent) Close() error {
+	return nil
+}
+
+func (c typedContent) ContentType() string {
+	return c.contentType
+}
+
+func TestS3EventProcessorFormats(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+
+	expected := []weatherapi.WeatherAPIRequest{
+		{Lon: "1", Lat: "2", Metadata: map[string]string{"name": "a"}, Row: 1},
+		{Lon: "3", Lat: "4", Metadata: map[string]string{"name": "b"}, Row: 2},
+	}
+	tests := []struct {
+		description string
+		key         string
+		contentType string
+		content     string
+		expected    []weatherapi.WeatherAPIRequest
+	}{
+		{
+			description: "given a TSV file, rows are queued",
+			key:         "data.tsv",
+			content:     "lon\tlat\tname\n1\t2\ta\n3\t4\tb",
+			expected:    expected,
+		},
+		{
+			description: "given a JSON Lines file, rows are queued",
+			key:         "data.jsonl",
+			content:     "{\"lat\":2,\"lon\":1,\"name\":\"a\"}\n{\"lat\":4,\"lon\":3,\"name\":\"b\"}\n",
+			expected:    expected,
+		},
+		{
+			description: "given a GeoJSON file, points are queued",
+			key:         "data.geojson",
+			content: `{"type":"FeatureCollection","features":[
+{"type":"Feature","geometry":{"type":"Point","coordinates":[1,2]},"properties":{"name":"a"}},
+{"type":"Feature","geometry":{"type":"Point","coordinates":[3,4]},"properties":{"name":"b"}}]}`,
+			expected: expected,
+		},
+		{
+			description: "given GeoJSON properties named like coordinates, they're kept as metadata",
+			key:         "data.geojson",
+			content: `{"type":"FeatureCollection","features":[
+{"type":"Feature","geometry":{"type":"Point","coordinates":[1,2]},"properties":{"lat":"51.5","x":"530000","y":"180000"}}]}`,
+			expected: []weatherapi.WeatherAPIRequest{
+				{Lon: "1", Lat: "2", Metadata: map[string]string{"lat": "51.5", "x": "530000", "y": "180000"}, Row: 1},
+			},
+		},
+		{
+			description: "given no extension, the content type is used",
+			key:         "weather-data/export",
+			contentType: "application/x-ndjson",
+			content:     "{\"lat\":2,\"lon\":1,\"name\":\"a\"}\n{\"lat\":4,\"lon\":3,\"name\":\"b\"}",
+			expected:    expected,
+		},
+		{
+			description: "given an unsupported file, nothing is queued",
+			key:         "data.txt",
+			contentType: "text/plain",
+			content:     "lon,lat,name\n1,2,a",
+		},
+	}
+
+	for _, tt := range tests {
+		var messages []weatherapi.WeatherAPIRequest
+		fetcher := func(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error) {
+			rc = typedContent{Reader: strings.NewReader(tt.content), contentType: tt.contentType}
+			return
+		}
+		messageQueue := func(ctx context.Context, message string) (messageId string, err error) {
+			var req weatherapi.WeatherAPIRequest
+			if err = json.Unmarshal([]byte(message), &req); err != nil {
+				return
+			}
+			messages = append(messages, req)
+			messageId = uuid.New().String()
+			return
+		}
+		ep := NewS3EventProcessor(fetcher, messageQueue, logger)
+		if _, err := ep.Process(context.Background(), buildS3Event(tt.key)); err != nil {
+			t.Errorf("%s: unable to process: %s", tt.description, err.Error())
+		}
+		if !cmp.Equal(messages, tt.expected, cmpopts.IgnoreFields(weatherapi.WeatherAPIRequest{}, "JobId")) {
+			t.Errorf("%s: got %v, expected %v", tt.description, messages, tt.expected)
+		}
+	}
+}
+
+func buildS3Event(keys ...string) (e events.S3Event) {
+	for _, k := range keys {
+		e.Records = append(e.Records, events.S3EventRecord{
+			S3: events.S3Entity{
+				Bucket: events.S3Bucket{
+					Name: "weather-data-bucket",
+				},
+				Object: events.S3Object{
+					Key:           k,
+					URLDecodedKey: k,
+				},
+			},
+		})
+	}
+	return
+}
+
+func TestS3EventProcessorBatchQueue(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+
+	tests := []struct {
+		description        string
+		rows               int
+		batchQueue         MessageBatchQueueFunc
+		expectedCount      int
+		expectedBatchSizes []int
+	}{
+		{
+			description: "given more rows than fit in a batch, rows are sent in batches of 10",
+			rows:        25,
+			batchQueue: func(ctx context.Context, messages []string) (results []messagequeue.BatchResult, err error) {
+				for range messages {
+					results = append(results, messagequeue.BatchResult{MessageId: uuid.New().String()})
+				}
+				return
+			},
+			expectedCount:      25,
+			expectedBatchSizes: []int{10, 10, 5},
+		},
+		{
+			description: "given a batch entry fails, only that row is not delivered",
+			rows:        3,
+			batchQueue: func(ctx context.Context, messages []string) (results []messagequeue.BatchResult, err error) {
+				results = []messagequeue.BatchResult{
+					{MessageId: uuid.New().String()},
+					{Err: errors.New("throttled")},
+					{MessageId: uuid.New().String()},
+				}
+				return
+			},
+			expectedCount:      2,
+			expectedBatchSizes: []int{3},
+		},
+		{
+			description: "given the batch call fails, no messages delivered",
+			rows:        3,
+			batchQueue: func(ctx context.Context, messages []string) (results []messagequeue.BatchResult, err error) {
+				err = errors.New("message queue unavailable")
+				return
+			},
+			expectedCount:      0,
+			expectedBatchSizes: []int{3},
+		},
+	}
+
+	for _, tt := range tests {
+		content := "lon,lat\n" + strings.Repeat("1,2\n", tt.rows)
+		fetcher := func(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error) {
+			rc = io.NopCloser(strings.NewReader(content))
+			return
+		}
+		messageQueue := func(ctx context.Context, message string) (messageId string, err error) {
+			t.Errorf("%s: single message queue used when batch queue configured", tt.description)
+			return
+		}
+		var batchSizes []int
+		ep := NewS3EventProcessor(fetcher, messageQueue, logger)
+		ep.MessageBatchQueue = func(ctx context.Context, messages []string) ([]messagequeue.BatchResult, error) {
+			batchSizes = append(batchSizes, len(messages))
+			return tt.batchQueue(ctx, messages)
+		}
+		messages, err := ep.Process(context.Background(), buildS3Event("data.csv"))
+		if err != nil {
+			t.Errorf("%s: unable to process: %s", tt.description, err.Error())
+		}
+		if len(messages) != tt.expectedCount {
+			t.Errorf("%s: expected %d messageId's, got %d", tt.description, tt.expectedCount, len(messages))
+		}
+		if !cmp.Equal(batchSizes, tt.expectedBatchSizes) {
+			t.Errorf("%s: got batch sizes %v, expected %v", tt.description, batchSizes, tt.expectedBatchSizes)
+		}
+	}
+}
+
+type jobCall struct {
+	jobId     string
+	sourceKey string
+	expected  int
+	truncated bool
+	row       int
+	succeeded bool
+}
+
+type recordingJobTracker struct {
+	expected []jobCall
+	rows     []jobCall
+}
+
+func (r *recordingJobTracker) SetExpected(ctx context.Context, jobId, sourceKey string, expected int, truncated bool) error {
+	r.expected = append(r.expected, jobCall{jobId: jobId, sourceKey: sourceKey, expected: expected, truncated: truncated})
+	return nil
+}
+
+func (r *recordingJobTracker) RecordRow(ctx context.Context, jobId string, row int, succeeded bool) error {
+	r.rows = append(r.rows, jobCall{jobId: jobId, row: row, succeeded: succeeded})
+	return nil
+}
+
+func TestS3EventProcessorJobs(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+
+	tests := []struct {
+		description      string
+		reader           func() io.Reader
+		expectedRows     []jobCall
+		expectedExpected []jobCall
+	}{
+		{
+			description: "given bad and unqueueable rows, they are recorded as failed and the row count is set",
+			reader: func() io.Reader {
+				return strings.NewReader("lon,lat\n1,2\n,\n99,9\n3,4")
+			},
+			expectedRows:     []jobCall{{row: 2}, {row: 3}},
+			expectedExpected: []jobCall{{sourceKey: "data.csv", expected: 4}},
+		},
+		{
+			description: "given the file can't be read to the end, the rows read are expected and the job is truncated",
+			reader: func() io.Reader {
+				return io.MultiReader(strings.NewReader("lon,lat\n1,2\n"), iotest.ErrReader(errors.New("connection reset")))
+			},
+			expectedExpected: []jobCall{{sourceKey: "data.csv", expected: 1, truncated: true}},
+		},
+	}
+
+	for _, tt := range tests {
+		tracker := &recordingJobTracker{}
+		var jobIds []string
+		fetcher := func(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error) {
+			rc = io.NopCloser(tt.reader())
+			return
+		}
+		messageQueue := func(ctx context.Context, message string) (messageId string, err error) {
+			var req weatherapi.WeatherAPIRequest
+			if err = json.Unmarshal([]byte(message), &req); err != nil {
+				return
+			}
+			jobIds = append(jobIds, req.JobId)
+			if req.Lon == "99" {
+				err = errors.New("message queue unavailable")
+				return
+			}
+			messageId = uuid.New().String()
+			return
+		}
+		ep := NewS3EventProcessor(fetcher, messageQueue, logger)
+		ep.Jobs = tracker
+		if _, err := ep.Process(context.Background(), buildS3Event("data.csv")); err != nil {
+			t.Errorf("%s: unable to process: %s", tt.description, err.Error())
+		}
+		for _, id := range jobIds {
+			if id == "" || id != jobIds[0] {
+				t.Errorf("%s: expected every row to share a job id, got %v", tt.description, jobIds)
+				break
+			}
+		}
+		ignoreJobId := cmp.Comparer(func(a, b jobCall) bool {
+			a.jobId, b.jobId = "", ""
+			return a == b
+		})
+		if !cmp.Equal(tracker.rows, tt.expectedRows, ignoreJobId) {
+			t.Errorf("%s: got rows %+v, expected %+v", tt.description, tracker.rows, tt.expectedRows)
+		}
+		if !cmp.Equal(tracker.expected, tt.expectedExpected, ignoreJobId) {
+			t.Errorf("%s: got expected counts %+v, expected %+v", tt.description, tracker.expected, tt.expectedExpected)
+		}
+	}
+}
+
+func TestS3EventProcessorRejects(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+
+	tests := []struct {
+		description  string
+		key          string
+		file         string
+		maxRejects   int
+		expectedKey  string
+		expectedData string
+	}{
+		{
+			description: "given bad and unqueueable rows, they are written with their line and reason",
+			key:         "weather-data/data.csv",
+			file:        "lon,lat,name\n1,2,ok\nabc,2,bad\n\n99,9,\"two\nlines\"\n3,4,ok",
+			expectedKey: "rejects/weather-data/data.csv",
+			expectedData: "line,reason,lon,lat,name\n" +
+				"3,\"row 2: invalid lon \"\"abc\"\": not a number\",abc,2,bad\n" +
+				"5,message queue unavailable,99,9,\"two\nlines\"\n",
+		},
+		{
+			description: "given a row with a bad quote, it's rejected and the rows after it are queued",
+			key:         "data.csv",
+			file:        "lon,lat\n1,2\n3,4\"x\n5,6\n7,8",
+			expectedKey: "rejects/data.csv",
+			expectedData: "line,reason,lon,lat\n" +
+				"3,\"column 4: bare \"\" in non-quoted-field\",3\n",
+		},
+		{
+			description: "given the coordinate columns are missing, the heading row is rejected",
+			key:         "data.csv",
+			file:        "a,b\n1,2",
+			expectedKey: "rejects/data.csv",
+			expectedData: "line,reason,a,b\n" +
+				"1,\"longitude column not found, expected one of [lon longitude lng long x]\",a,b\n",
+		},
+		{
+			description: "given a file that isn't CSV, the rejects are written as CSV with a .csv extension",
+			key:         "weather-data/data.jsonl",
+			file:        "{\"lon\":1,\"lat\":2}\n{\"lon\":\"abc\",\"lat\":2}\n",
+			expectedKey: "rejects/weather-data/data.jsonl.csv",
+			expectedData: "line,reason,lon,lat\n" +
+				"2,\"row 2: invalid lon \"\"abc\"\": not a number\",abc,2\n",
+		},
+		{
+			description: "given more rejected rows than are kept, the rest are counted in the last row",
+			key:         "data.csv",
+			file:        "lon,lat\nabc,2\n1,2\nabc,3\nabc,4\nabc,5",
+			maxRejects:  2,
+			expectedKey: "rejects/data.csv",
+			expectedData: "line,reason,lon,lat\n" +
+				"2,\"row 1: invalid lon \"\"abc\"\": not a number\",abc,2\n" +
+				"4,\"row 3: invalid lon \"\"abc\"\": not a number\",abc,3\n" +
+				",\"2 more rows were rejected, only the first 2 are listed\"\n",
+		},
+		{
+			description: "given a key that resolves outside the rejects prefix, nothing is written",
+			key:         "weather-data/../../results/data.csv",
+			file:        "lon,lat\nabc,2",
+		},
+		{
+			description: "given every row is queued, nothing is written",
+			key:         "data.csv",
+			file:        "lon,lat\n1,2",
+		},
+	}
+
+	for _, tt := range tests {
+		fetcher := func(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error) {
+			rc = io.NopCloser(strings.NewReader(tt.file))
+			return
+		}
+		messageQueue := func(ctx context.Context, message string) (messageId string, err error) {
+			if strings.Contains(message, `"lon":"99"`) {
+				err = errors.New("message queue unavailable")
+				return
+			}
+			messageId = uuid.New().String()
+			return
+		}
+		written := map[string]string{}
+		ep := NewS3EventProcessor(fetcher, messageQueue, logger)
+		if tt.maxRejects > 0 {
+			ep.MaxRejects = tt.maxRejects
+		}
+		ep.Rejects = func(ctx context.Context, key string, data []byte) (err error) {
+			written[key] = string(data)
+			return
+		}
+		ep.Process(context.Background(), buildS3Event(tt.key))
+		expected := map[string]string{}
+		if tt.expectedKey != "" {
+			expected[tt.expectedKey] = tt.expectedData
+		}
+		if diff := cmp.Diff(expected, written); diff != "" {
+			t.Errorf("%s: unexpected rejects: %s", tt.description, diff)
+		}
+	}
+}
+
+func TestS3EventProcessorConcurrency(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+	content := "lon,lat\n" + strings.Repeat("1,2\n", 100) + "bad,\n"
+	fetcher := func(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error) {
+		rc = io.NopCloser(strings.NewReader(content))
+		return
+	}
+	var inFlight, maxInFlight int32
+	messageQueue := func(ctx context.Context, message string) (messageId string, err error) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		messageId = uuid.New().String()
+		return
+	}
+	tracker := &syncJobTracker{}
+	ep := NewS3EventProcessor(fetcher, messageQueue, logger)
+	ep.Concurrency = 4
+	ep.Jobs = tracker
+
+	messages, err := ep.Process(context.Background(), buildS3Event("data.csv"))
+	if err != nil {
+		t.Fatalf("unable to process: %v", err)
+	}
+	if len(messages) != 100 {
+		t.Errorf("expected 100 messageId's, got %d", len(messages))
+	}
+	if maxInFlight < 2 || maxInFlight > 4 {
+		t.Errorf("expected between 2 and 4 messages in flight, got %d", maxInFlight)
+	}
+	if tracker.failed != 1 || tracker.expected != 101 {
+		t.Errorf("expected 1 failed row of 101, got %d failed of %d", tracker.failed, tracker.expected)
+	}
+}
+
+func TestS3EventProcessorDeadline(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+	fetcher := func(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error) {
+		rc = io.NopCloser(io.MultiReader(strings.NewReader("lon,lat\n"), slowRowReader{}))
+		return
+	}
+	messageQueue := func(ctx context.Context, message string) (messageId string, err error) {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		messageId = uuid.New().String()
+		return
+	}
+	tracker := &syncJobTracker{}
+	var rejects string
+	ep := NewS3EventProcessor(fetcher, messageQueue, logger)
+	ep.Jobs = tracker
+	ep.Rejects = func(ctx context.Context, key string, data []byte) (err error) {
+		rejects = string(data)
+		return
+	}
+	ep.DeadlineMargin = 150 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	messages, err := ep.Process(ctx, buildS3Event("data.csv"))
+	if err != nil {
+		t.Fatalf("unable to process: %v", err)
+	}
+	if len(messages) == 0 {
+		t.Error("expected rows read before the deadline to be queued")
+	}
+	// the job expects the rows that were read, so it completes, and is marked as truncated.
+	if !tracker.truncated || tracker.expected != len(messages) {
+		t.Errorf("got a row count of %d (truncated: %v), expected the %d rows read and truncated", tracker.expected, tracker.truncated, len(messages))
+	}
+	expectedRejects := fmt.Sprintf("line,reason,lon,lat\n%d,\"reading stopped after row %d, the rest of the file wasn't queued: context deadline exceeded\"\n", len(messages)+2, len(messages))
+	if diff := cmp.Diff(expectedRejects, rejects); diff != "" {
+		t.Errorf("unexpected rejects: %s", diff)
+	}
+}
+
+func TestS3EventProcessorEventObject(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+	tests := []struct {
+		description string
+		event       string
+		expected    []string
+	}{
+		{
+			description: "given a key with encoded characters, the decoded key is fetched from the event's bucket",
+			event: `{"Records":[{"s3":{"bucket":{"name":"uploads"},` +
+				`"object":{"key":"weather-data/my+file%281%29.csv","versionId":"3HL4kqtJlcpXroDTDmJ","eTag":"0123456789abcdef"}}}]}`,
+			expected: []string{"uploads", "weather-data/my file(1).csv", "3HL4kqtJlcpXroDTDmJ", "0123456789abcdef"},
+		},
+		{
+			description: "given an object without a version, none is asked for",
+			event:       `{"Records":[{"s3":{"bucket":{"name":"uploads"},"object":{"key":"sample.csv"}}}]}`,
+			expected:    []string{"uploads", "sample.csv", "", ""},
+		},
+	}
+	for _, tt := range tests {
+		var e events.S3Event
+		if err := json.Unmarshal([]byte(tt.event), &e); err != nil {
+			t.Fatalf("%s: unable to decode event: %v", tt.description, err)
+		}
+		var fetched []string
+		fetcher := func(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error) {
+			fetched = []string{bucket, key, versionId, eTag}
+			rc = io.NopCloser(strings.NewReader("lon,lat\n1,2\n"))
+			return
+		}
+		messageQueue := func(ctx context.Context, message string) (messageId string, err error) {
+			messageId = uuid.New().String()
+			return
+		}
+		ep := NewS3EventProcessor(fetcher, messageQueue, logger)
+		if _, err := ep.Process(context.Background(), e); err != nil {
+			t.Errorf("%s: unable to process: %v", tt.description, err)
+		}
+		if diff := cmp.Diff(tt.expected, fetched); diff != "" {
+			t.Errorf("%s: unexpected fetch: %s", tt.description, diff)
+		}
+	}
+}
+
+// slowRowReader never ends, producing a row every few milliseconds.
+type slowRowReader struct{}
+
+func (slowRowReader) Read(p []byte) (int, error) {
+	time.Sleep(5 * time.Millisecond)
+	return copy(p, "1,2\n"), nil
+}
+
+type syncJobTracker struct {
+	mu        sync.Mutex
+	expected  int
+	truncated bool
+	failed    int
+}
+
+func (s *syncJobTracker) SetExpected(ctx context.Context, jobId, sourceKey string, expected int, truncated bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expected = expected
+	s.truncated = truncated
+	return nil
+}
+
+func (s *syncJobTracker) RecordRow(ctx context.Context, jobId string, row int, succeeded bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !succeeded {
+		s.failed++
+	}
+	return nil
+}
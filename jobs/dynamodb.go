@@ -0,0 +1,163 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// jobTTL matches the lifecycle of the data bucket, there's no point tracking a job once its
+// results have expired.
+const jobTTL = 7 * 24 * time.Hour
+
+// DynamoDBStore keeps job progress in a DynamoDB table with a string partition key "pk" and sort
+// key "sk". Each job has a counter item, plus an item per row so duplicate deliveries can be
+// detected.
+type DynamoDBStore struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoDBStore(cfg aws.Config, tableName string) (s DynamoDBStore) {
+	s.client = dynamodb.NewFromConfig(cfg)
+	s.tableName = tableName
+	return
+}
+
+func (d DynamoDBStore) SetExpected(ctx context.Context, jobId, sourceKey string, expected int, truncated bool) (s Status, err error) {
+	res, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(d.tableName),
+		Key:              jobItemKey(jobId),
+		UpdateExpression: aws.String("SET source_key = :k, expected = :e, ingested = :t, truncated = :tr, expires_at = if_not_exists(expires_at, :x)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":k":  &types.AttributeValueMemberS{Value: sourceKey},
+			":e":  numberValue(expected),
+			":t":  &types.AttributeValueMemberBOOL{Value: true},
+			":tr": &types.AttributeValueMemberBOOL{Value: truncated},
+			":x":  expiresAt(),
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if err != nil {
+		return
+	}
+	s = statusFromItem(jobId, res.Attributes)
+	return
+}
+
+func (d DynamoDBStore) RecordRow(ctx context.Context, jobId string, row int, succeeded bool) (s Status, err error) {
+	counter := "failed"
+	if succeeded {
+		counter = "succeeded"
+	}
+	// the row item and counter are written together, so a row is only ever counted once.
+	_, err = d.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{
+				Put: &types.Put{
+					TableName: aws.String(d.tableName),
+					Item: map[string]types.AttributeValue{
+						"pk":         &types.AttributeValueMemberS{Value: jobId},
+						"sk":         &types.AttributeValueMemberS{Value: "row#" + strconv.Itoa(row)},
+						"succeeded":  &types.AttributeValueMemberBOOL{Value: succeeded},
+						"expires_at": expiresAt(),
+					},
+					ConditionExpression: aws.String("attribute_not_exists(pk)"),
+				},
+			},
+			{
+				Update: &types.Update{
+					TableName:        aws.String(d.tableName),
+					Key:              jobItemKey(jobId),
+					UpdateExpression: aws.String("ADD " + counter + " :one SET expires_at = if_not_exists(expires_at, :x)"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":one": numberValue(1),
+						":x":   expiresAt(),
+					},
+				},
+			},
+		},
+	})
+	if err != nil && !isDuplicateRow(err) {
+		return
+	}
+	res, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.tableName),
+		Key:            jobItemKey(jobId),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return
+	}
+	s = statusFromItem(jobId, res.Item)
+	return
+}
+
+func (d DynamoDBStore) SetManifestWritten(ctx context.Context, jobId string) (err error) {
+	_, err = d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(d.tableName),
+		Key:              jobItemKey(jobId),
+		UpdateExpression: aws.String("SET manifest_written = :t"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":t": &types.AttributeValueMemberBOOL{Value: true},
+		},
+	})
+	return
+}
+
+func isDuplicateRow(err error) bool {
+	var tce *types.TransactionCanceledException
+	if !errors.As(err, &tce) || len(tce.CancellationReasons) == 0 {
+		return false
+	}
+	return aws.ToString(tce.CancellationReasons[0].Code) == "ConditionalCheckFailed"
+}
+
+func jobItemKey(jobId string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"pk": &types.AttributeValueMemberS{Value: jobId},
+		"sk": &types.AttributeValueMemberS{Value: "job"},
+	}
+}
+
+func numberValue(n int) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.Itoa(n)}
+}
+
+func expiresAt() types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(jobTTL).Unix(), 10)}
+}
+
+func statusFromItem(jobId string, item map[string]types.AttributeValue) (s Status) {
+	s.JobId = jobId
+	if v, ok := item["source_key"].(*types.AttributeValueMemberS); ok {
+		s.SourceKey = v.Value
+	}
+	if v, ok := item["ingested"].(*types.AttributeValueMemberBOOL); ok {
+		s.Ingested = v.Value
+	}
+	if v, ok := item["truncated"].(*types.AttributeValueMemberBOOL); ok {
+		s.Truncated = v.Value
+	}
+	if v, ok := item["manifest_written"].(*types.AttributeValueMemberBOOL); ok {
+		s.ManifestWritten = v.Value
+	}
+	s.Expected = intFromItem(item, "expected")
+	s.Succeeded = intFromItem(item, "succeeded")
+	s.Failed = intFromItem(item, "failed")
+	return
+}
+
+func intFromItem(item map[string]types.AttributeValue, name string) int {
+	v, ok := item[name].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0
+	}
+	n, _ := strconv.Atoi(v.Value)
+	return n
+}
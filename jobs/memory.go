@@ -0,0 +1,70 @@
+package jobs
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryStore is a Store for tests and local runs. It's safe for concurrent use.
+type MemoryStore struct {
+	mu   sync.Mutex
+	jobs map[string]*memoryJob
+}
+
+type memoryJob struct {
+	status Status
+	rows   map[int]bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		jobs: make(map[string]*memoryJob),
+	}
+}
+
+func (m *MemoryStore) SetExpected(ctx context.Context, jobId, sourceKey string, expected int, truncated bool) (s Status, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j := m.job(jobId)
+	j.status.SourceKey = sourceKey
+	j.status.Expected = expected
+	j.status.Truncated = truncated
+	j.status.Ingested = true
+	s = j.status
+	return
+}
+
+func (m *MemoryStore) RecordRow(ctx context.Context, jobId string, row int, succeeded bool) (s Status, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j := m.job(jobId)
+	if _, ok := j.rows[row]; !ok {
+		j.rows[row] = succeeded
+		if succeeded {
+			j.status.Succeeded++
+		} else {
+			j.status.Failed++
+		}
+	}
+	s = j.status
+	return
+}
+
+func (m *MemoryStore) SetManifestWritten(ctx context.Context, jobId string) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.job(jobId).status.ManifestWritten = true
+	return
+}
+
+func (m *MemoryStore) job(jobId string) *memoryJob {
+	j, ok := m.jobs[jobId]
+	if !ok {
+		j = &memoryJob{
+			status: Status{JobId: jobId},
+			rows:   make(map[int]bool),
+		}
+		m.jobs[jobId] = j
+	}
+	return j
+}
@@ -0,0 +1,40 @@
+package jobs
+
+import (
+	"context"
+)
+
+// Status is the progress of a single input file through the pipeline.
+type Status struct {
+	JobId     string `json:"job_id"`
+	SourceKey string `json:"source_key"`
+	// Ingested is set once the file has been read and Expected is final.
+	Ingested bool `json:"ingested"`
+	// Truncated is set when reading stopped before the end of the file, e.g. because ingest ran out
+	// of time. Expected is then the rows that were read, the rest are missing from the results.
+	Truncated bool `json:"truncated"`
+	Expected  int  `json:"expected"`
+	Succeeded int  `json:"succeeded"`
+	Failed    int  `json:"failed"`
+	// ManifestWritten is set once the manifest of the completed job has been written.
+	ManifestWritten bool `json:"-"`
+}
+
+// Complete reports whether every row of the job has been accounted for.
+func (s Status) Complete() bool {
+	return s.Ingested && s.Succeeded+s.Failed >= s.Expected
+}
+
+// Store keeps track of row outcomes for each job. Rows may be recorded before the expected count is
+// known, as messages can be processed before the rest of the file has been read.
+type Store interface {
+	// SetExpected records the number of rows in the job, once the source file has been read, and
+	// whether it was read to the end.
+	SetExpected(ctx context.Context, jobId, sourceKey string, expected int, truncated bool) (s Status, err error)
+	// RecordRow records the final outcome of a row. Recording the same row again has no effect, as
+	// messages can be delivered more than once.
+	RecordRow(ctx context.Context, jobId string, row int, succeeded bool) (s Status, err error)
+	// SetManifestWritten records that the manifest of the job has been written, so rows delivered
+	// again after it's complete don't write it again.
+	SetManifestWritten(ctx context.Context, jobId string) (err error)
+}
@@ -0,0 +1,80 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"time"
+
+	"github.com/antonielabuschagne/data-loader/results"
+)
+
+// Manifest is written alongside a job's results once every row has been accounted for, as the
+// signal that the job is complete.
+type Manifest struct {
+	Status
+	ResultsPrefix string    `json:"results_prefix"`
+	CompletedAt   time.Time `json:"completed_at"`
+}
+
+// Tracker records job progress in a Store and writes the manifest to <prefix>/<job>/_manifest.json
+// when a job completes.
+type Tracker struct {
+	Store  Store
+	Writer results.DataWriterFunc
+	Prefix string
+	// JobPrefix is optional, it's where the results and manifest of a job are written when the
+	// results aren't under <prefix>/<job>, e.g. results.ParquetSink.JobPrefix.
+	JobPrefix func(jobId string) string
+}
+
+func NewTracker(store Store, w results.DataWriterFunc, prefix string) (t Tracker) {
+	t.Store = store
+	t.Writer = w
+	t.Prefix = prefix
+	return
+}
+
+func (t Tracker) SetExpected(ctx context.Context, jobId, sourceKey string, expected int, truncated bool) (err error) {
+	s, err := t.Store.SetExpected(ctx, jobId, sourceKey, expected, truncated)
+	if err != nil {
+		return
+	}
+	return t.writeManifestIfComplete(ctx, s)
+}
+
+func (t Tracker) RecordRow(ctx context.Context, jobId string, row int, succeeded bool) (err error) {
+	s, err := t.Store.RecordRow(ctx, jobId, row, succeeded)
+	if err != nil {
+		return
+	}
+	return t.writeManifestIfComplete(ctx, s)
+}
+
+// writeManifestIfComplete writes the manifest for a job that has just completed. It's recorded as
+// written afterwards, so a failed write is tried again when the row is retried, but rows delivered
+// again later don't rewrite it. Concurrent updates can both see the job complete, so the manifest
+// may still be written twice, with the same counts.
+func (t Tracker) writeManifestIfComplete(ctx context.Context, s Status) (err error) {
+	if !s.Complete() || s.ManifestWritten {
+		return
+	}
+	prefix := path.Join(t.Prefix, s.JobId)
+	if t.JobPrefix != nil {
+		prefix = t.JobPrefix(s.JobId)
+	}
+	m := Manifest{
+		Status:        s,
+		ResultsPrefix: prefix + "/",
+		CompletedAt:   time.Now().UTC(),
+	}
+	d, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	// the manifest is named so Athena ignores it when the results are queried.
+	if err = t.Writer(ctx, path.Join(prefix, "_manifest.json"), d); err != nil {
+		return
+	}
+	return t.Store.SetManifestWritten(ctx, s.JobId)
+}
@@ -0,0 +1,172 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type rowResult struct {
+	row       int
+	succeeded bool
+}
+
+func TestTracker(t *testing.T) {
+	tests := []struct {
+		description      string
+		expected         int
+		truncated        bool
+		setExpectedFirst bool
+		rows             []rowResult
+		expectedManifest *Status
+	}{
+		{
+			description:      "given every row is recorded after the file is read, manifest is written",
+			expected:         3,
+			setExpectedFirst: true,
+			rows:             []rowResult{{1, true}, {2, false}, {3, true}},
+			expectedManifest: &Status{JobId: "job", SourceKey: "weather-data/foo.csv", Ingested: true, Expected: 3, Succeeded: 2, Failed: 1},
+		},
+		{
+			description:      "given rows finish before the file is read, manifest is written once the count is known",
+			expected:         2,
+			rows:             []rowResult{{1, true}, {2, true}},
+			expectedManifest: &Status{JobId: "job", SourceKey: "weather-data/foo.csv", Ingested: true, Expected: 2, Succeeded: 2},
+		},
+		{
+			description:      "given a row is delivered twice, it's only counted once",
+			expected:         2,
+			setExpectedFirst: true,
+			rows:             []rowResult{{1, true}, {1, true}},
+		},
+		{
+			description:      "given a row is delivered again after the job completes, manifest is only written once",
+			expected:         2,
+			setExpectedFirst: true,
+			rows:             []rowResult{{1, true}, {2, false}, {2, false}, {1, true}},
+			expectedManifest: &Status{JobId: "job", SourceKey: "weather-data/foo.csv", Ingested: true, Expected: 2, Succeeded: 1, Failed: 1},
+		},
+		{
+			description:      "given a file that wasn't read to the end, manifest is written for the rows read and marked truncated",
+			expected:         2,
+			truncated:        true,
+			setExpectedFirst: true,
+			rows:             []rowResult{{1, true}, {2, true}},
+			expectedManifest: &Status{JobId: "job", SourceKey: "weather-data/foo.csv", Ingested: true, Truncated: true, Expected: 2, Succeeded: 2},
+		},
+		{
+			description:      "given an empty file, manifest is written straight away",
+			expected:         0,
+			setExpectedFirst: true,
+			expectedManifest: &Status{JobId: "job", SourceKey: "weather-data/foo.csv", Ingested: true},
+		},
+	}
+
+	for _, tt := range tests {
+		written := map[string][]byte{}
+		var writes int
+		tracker := NewTracker(NewMemoryStore(), func(ctx context.Context, key string, data []byte) (err error) {
+			written[key] = data
+			writes++
+			return
+		}, "results")
+		ctx := context.Background()
+
+		if tt.setExpectedFirst {
+			if err := tracker.SetExpected(ctx, "job", "weather-data/foo.csv", tt.expected, tt.truncated); err != nil {
+				t.Fatalf("%s: unable to set expected: %v", tt.description, err)
+			}
+		}
+		for _, r := range tt.rows {
+			if err := tracker.RecordRow(ctx, "job", r.row, r.succeeded); err != nil {
+				t.Fatalf("%s: unable to record row: %v", tt.description, err)
+			}
+		}
+		if !tt.setExpectedFirst {
+			if err := tracker.SetExpected(ctx, "job", "weather-data/foo.csv", tt.expected, tt.truncated); err != nil {
+				t.Fatalf("%s: unable to set expected: %v", tt.description, err)
+			}
+		}
+
+		data, ok := written["results/job/_manifest.json"]
+		if tt.expectedManifest == nil {
+			if ok {
+				t.Errorf("%s: expected no manifest, got %s", tt.description, data)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: expected manifest to be written", tt.description)
+			continue
+		}
+		if writes != 1 {
+			t.Errorf("%s: expected manifest to be written once, got %d", tt.description, writes)
+		}
+		var m Manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatalf("%s: unable to unmarshal manifest: %v", tt.description, err)
+		}
+		if !cmp.Equal(m.Status, *tt.expectedManifest) {
+			t.Errorf("%s: got %+v, expected %+v", tt.description, m.Status, *tt.expectedManifest)
+		}
+		if m.ResultsPrefix != "results/job/" {
+			t.Errorf("%s: got results prefix %q", tt.description, m.ResultsPrefix)
+		}
+	}
+}
+
+func TestTrackerManifestRetry(t *testing.T) {
+	var writes int
+	tracker := NewTracker(NewMemoryStore(), func(ctx context.Context, key string, data []byte) (err error) {
+		writes++
+		if writes == 1 {
+			err = errors.New("slow down")
+		}
+		return
+	}, "results")
+	ctx := context.Background()
+	if err := tracker.SetExpected(ctx, "job", "weather-data/foo.csv", 1, false); err != nil {
+		t.Fatalf("unable to set expected: %v", err)
+	}
+	if err := tracker.RecordRow(ctx, "job", 1, true); err == nil {
+		t.Fatal("expected the failed manifest write to be returned")
+	}
+	// the message is retried, so the row is recorded again.
+	if err := tracker.RecordRow(ctx, "job", 1, true); err != nil {
+		t.Fatalf("unable to record row: %v", err)
+	}
+	if err := tracker.RecordRow(ctx, "job", 1, true); err != nil {
+		t.Fatalf("unable to record row: %v", err)
+	}
+	if writes != 2 {
+		t.Errorf("expected the manifest to be written again after failing, then left alone, got %d writes", writes)
+	}
+}
+
+func TestTrackerJobPrefix(t *testing.T) {
+	written := map[string][]byte{}
+	tracker := NewTracker(NewMemoryStore(), func(ctx context.Context, key string, data []byte) (err error) {
+		written[key] = data
+		return
+	}, "results")
+	tracker.JobPrefix = func(jobId string) string {
+		return "results/job=" + jobId
+	}
+	if err := tracker.SetExpected(context.Background(), "job", "weather-data/foo.csv", 0, false); err != nil {
+		t.Fatalf("unable to set expected: %v", err)
+	}
+	data, ok := written["results/job=job/_manifest.json"]
+	if !ok {
+		t.Fatalf("expected manifest to be written under the job prefix, got %v", written)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("unable to unmarshal manifest: %v", err)
+	}
+	if m.ResultsPrefix != "results/job=job/" {
+		t.Errorf("got results prefix %q", m.ResultsPrefix)
+	}
+}
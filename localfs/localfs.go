@@ -0,0 +1,95 @@
+// Package localfs reads and writes the data and results of the pipeline locally rather than in
+// S3, for tests and local runs. Keys are slash separated paths, as they are in a bucket.
+package localfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// NewDataFetcher returns a fetcher reading the file at each key of fsys, e.g. os.DirFS or
+// fstest.MapFS. There's only the one bucket and version of each file, so the bucket, version id
+// and ETag are ignored.
+func NewDataFetcher(fsys fs.FS) func(context.Context, string, string, string, string) (io.ReadCloser, error) {
+	return func(ctx context.Context, bucket, key, versionId, eTag string) (io.ReadCloser, error) {
+		return fsys.Open(key)
+	}
+}
+
+// NewDirDataFetcher returns a fetcher reading the file at each key under dir.
+func NewDirDataFetcher(dir string) func(context.Context, string, string, string, string) (io.ReadCloser, error) {
+	return NewDataFetcher(os.DirFS(dir))
+}
+
+// NewDirDataWriter returns a writer creating the file at each key under dir, along with any
+// directories it's in.
+func NewDirDataWriter(dir string) func(context.Context, string, []byte) error {
+	return func(ctx context.Context, key string, data []byte) error {
+		if !fs.ValidPath(key) {
+			return fmt.Errorf("invalid key %q", key)
+		}
+		name := filepath.Join(dir, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			return err
+		}
+		return os.WriteFile(name, data, 0o644)
+	}
+}
+
+// MemoryStore holds objects in memory by key, it can be written to by results sinks and the job
+// tracker, and read from as a data fetcher. It's safe for concurrent use.
+type MemoryStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		objects: make(map[string][]byte),
+	}
+}
+
+// Fetch returns the object at key, or an error wrapping fs.ErrNotExist. Like NewDataFetcher, the
+// bucket, version id and ETag are ignored.
+func (m *MemoryStore) Fetch(ctx context.Context, bucket, key, versionId, eTag string) (rc io.ReadCloser, err error) {
+	data, ok := m.Get(key)
+	if !ok {
+		err = &fs.PathError{Op: "open", Path: key, Err: fs.ErrNotExist}
+		return
+	}
+	rc = io.NopCloser(bytes.NewReader(data))
+	return
+}
+
+// Write stores data at key, replacing any object already there.
+func (m *MemoryStore) Write(ctx context.Context, key string, data []byte) (err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = append([]byte(nil), data...)
+	return
+}
+
+func (m *MemoryStore) Get(key string) (data []byte, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok = m.objects[key]
+	return
+}
+
+// Keys returns the keys of every object, sorted.
+func (m *MemoryStore) Keys() (keys []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k := range m.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
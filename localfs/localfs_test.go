@@ -0,0 +1,74 @@
+package localfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func read(t *testing.T, description string, fetch func(context.Context, string, string, string, string) (io.ReadCloser, error), key string) string {
+	rc, err := fetch(context.Background(), "bucket", key, "", "")
+	if err != nil {
+		t.Fatalf("%s: unable to fetch %s: %v", description, key, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("%s: unable to read %s: %v", description, key, err)
+	}
+	return string(data)
+}
+
+func TestDirDataWriterAndFetcher(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	write := NewDirDataWriter(dir)
+	fetch := NewDirDataFetcher(dir)
+
+	if err := write(ctx, "results/job/a.jsonl", []byte("{}\n")); err != nil {
+		t.Fatalf("unable to write: %v", err)
+	}
+	if got := read(t, "given a file was written", fetch, "results/job/a.jsonl"); got != "{}\n" {
+		t.Errorf("got %q, expected the data written", got)
+	}
+	if err := write(ctx, "../outside", []byte("x")); err == nil {
+		t.Error("expected an error for a key outside the directory")
+	}
+	if _, err := fetch(ctx, "bucket", "missing.csv", "", ""); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v fetching a missing file, expected it not to exist", err)
+	}
+}
+
+func TestDataFetcher(t *testing.T) {
+	fetch := NewDataFetcher(fstest.MapFS{
+		"weather-data/sample.csv": {Data: []byte("lon,lat\n1,2\n")},
+	})
+	if got := read(t, "given a file system", fetch, "weather-data/sample.csv"); got != "lon,lat\n1,2\n" {
+		t.Errorf("got %q, expected the file", got)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemoryStore()
+	data := []byte("lon,lat\n")
+	if err := m.Write(ctx, "b.csv", data); err != nil {
+		t.Fatalf("unable to write: %v", err)
+	}
+	data[0] = 'x'
+	m.Write(ctx, "a.csv", nil)
+	if got := read(t, "given an object was written", m.Fetch, "b.csv"); got != "lon,lat\n" {
+		t.Errorf("got %q, expected the data as it was written", got)
+	}
+	if diff := cmp.Diff([]string{"a.csv", "b.csv"}, m.Keys()); diff != "" {
+		t.Errorf("unexpected keys: %s", diff)
+	}
+	if _, err := m.Fetch(ctx, "bucket", "missing.csv", "", ""); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v fetching a missing object, expected it not to exist", err)
+	}
+}
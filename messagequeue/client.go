@@ -2,9 +2,18 @@ package messagequeue
 
 import (
 	"context"
+	"fmt"
+	"strconv"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+const (
+	// MaxBatchEntries and MaxBatchBytes are the SQS limits for a single SendMessageBatch call.
+	MaxBatchEntries = 10
+	MaxBatchBytes   = 256 * 1024
 )
 
 type MessageQueue struct {
@@ -12,6 +21,13 @@ type MessageQueue struct {
 	queueUrl string
 }
 
+// BatchResult is the outcome of sending a single message as part of a batch. Err is set when the
+// message wasn't queued.
+type BatchResult struct {
+	MessageId string
+	Err       error
+}
+
 func NewMessageQueue(cfg aws.Config, queueUrl string) (mq MessageQueue) {
 	mq.client = sqs.NewFromConfig(cfg)
 	mq.queueUrl = queueUrl
@@ -31,3 +47,72 @@ func (mq MessageQueue) SendMessage(ctx context.Context, message string) (message
 	messageId = *resp.MessageId
 	return
 }
+
+// SendMessageBatch sends messages using as few SendMessageBatch calls as the SQS limits allow.
+// There's a result for every message, in the same order as messages, so callers can tell which
+// ones failed. err is only returned when a call fails outright, in which case every message not
+// yet sent is marked as failed with it.
+func (mq MessageQueue) SendMessageBatch(ctx context.Context, messages []string) (results []BatchResult, err error) {
+	results = make([]BatchResult, len(messages))
+	batch := make([]int, 0, MaxBatchEntries)
+	var size int
+	for i, m := range messages {
+		if len(m) > MaxBatchBytes {
+			results[i].Err = fmt.Errorf("message is %d bytes, larger than the %d byte limit", len(m), MaxBatchBytes)
+			continue
+		}
+		if len(batch) == MaxBatchEntries || size+len(m) > MaxBatchBytes {
+			if err = mq.sendBatch(ctx, messages, batch, results); err != nil {
+				failRemaining(results, batch[0], err)
+				return
+			}
+			batch = batch[:0]
+			size = 0
+		}
+		batch = append(batch, i)
+		size += len(m)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	if err = mq.sendBatch(ctx, messages, batch, results); err != nil {
+		failRemaining(results, batch[0], err)
+	}
+	return
+}
+
+// sendBatch sends the messages at the given indexes, recording the outcome of each in results.
+func (mq MessageQueue) sendBatch(ctx context.Context, messages []string, indexes []int, results []BatchResult) (err error) {
+	entries := make([]types.SendMessageBatchRequestEntry, len(indexes))
+	for i, idx := range indexes {
+		entries[i] = types.SendMessageBatchRequestEntry{
+			Id:           aws.String(strconv.Itoa(idx)),
+			DelaySeconds: 10,
+			MessageBody:  aws.String(messages[idx]),
+		}
+	}
+	resp, err := mq.client.SendMessageBatch(ctx, &sqs.SendMessageBatchInput{
+		Entries:  entries,
+		QueueUrl: aws.String(mq.queueUrl),
+	})
+	if err != nil {
+		return
+	}
+	for _, s := range resp.Successful {
+		idx, _ := strconv.Atoi(aws.ToString(s.Id))
+		results[idx].MessageId = aws.ToString(s.MessageId)
+	}
+	for _, f := range resp.Failed {
+		idx, _ := strconv.Atoi(aws.ToString(f.Id))
+		results[idx].Err = fmt.Errorf("sqs rejected message: %s: %s", aws.ToString(f.Code), aws.ToString(f.Message))
+	}
+	return
+}
+
+func failRemaining(results []BatchResult, from int, err error) {
+	for i := from; i < len(results); i++ {
+		if results[i].Err == nil {
+			results[i].Err = err
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package messagequeue
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSendMessageBatch(t *testing.T) {
+	small := func(n int) (messages []string) {
+		for i := 0; i < n; i++ {
+			messages = append(messages, fmt.Sprintf(`{"row": %d}`, i))
+		}
+		return
+	}
+	messageIds := func(from, to int) (ids []string) {
+		for i := from; i < to; i++ {
+			ids = append(ids, "m-"+strconv.Itoa(i))
+		}
+		return
+	}
+	ids := func(from, to int) (ids []string) {
+		for i := from; i < to; i++ {
+			ids = append(ids, strconv.Itoa(i))
+		}
+		return
+	}
+
+	tests := []struct {
+		description string
+		messages    []string
+		// failIds are reported as failed by SQS, failCall is the call that fails outright.
+		failIds  map[string]bool
+		failCall int
+		// expectedBatches are the ids sent in each call.
+		expectedBatches [][]string
+		// expectedMessageIds are the message ids of the results, empty for those with an error.
+		expectedMessageIds []string
+		expectedError      bool
+	}{
+		{
+			description:        "given more messages than fit in a batch, they're split every 10",
+			messages:           small(12),
+			expectedBatches:    [][]string{ids(0, 10), ids(10, 12)},
+			expectedMessageIds: messageIds(0, 12),
+		},
+		{
+			description:        "given messages that together are larger than a batch, they're split before the byte limit",
+			messages:           []string{strings.Repeat("a", 100*1024), strings.Repeat("b", 100*1024), strings.Repeat("c", 100*1024)},
+			expectedBatches:    [][]string{ids(0, 2), ids(2, 3)},
+			expectedMessageIds: messageIds(0, 3),
+		},
+		{
+			description:        "given a message just over the byte limit, it fails without being sent and one at the limit is sent on its own",
+			messages:           []string{"a", strings.Repeat("b", MaxBatchBytes+1), strings.Repeat("c", MaxBatchBytes), "d"},
+			expectedBatches:    [][]string{{"0"}, {"2"}, {"3"}},
+			expectedMessageIds: []string{"m-0", "", "m-2", "m-3"},
+		},
+		{
+			description:        "given SQS fails some messages of a batch, only those have an error",
+			messages:           small(3),
+			failIds:            map[string]bool{"1": true},
+			expectedBatches:    [][]string{ids(0, 3)},
+			expectedMessageIds: []string{"m-0", "", "m-2"},
+		},
+		{
+			description:        "given the first call fails outright, every message has an error",
+			messages:           small(12),
+			failCall:           1,
+			expectedBatches:    [][]string{ids(0, 10)},
+			expectedMessageIds: make([]string, 12),
+			expectedError:      true,
+		},
+		{
+			description:        "given a later call fails outright, the messages already sent keep their ids",
+			messages:           small(12),
+			failCall:           2,
+			expectedBatches:    [][]string{ids(0, 10), ids(10, 12)},
+			expectedMessageIds: append(messageIds(0, 10), "", ""),
+			expectedError:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		var batches [][]string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := r.ParseForm(); err != nil {
+				t.Errorf("%s: unable to parse request: %v", tt.description, err)
+			}
+			var batch []string
+			for i := 1; r.Form.Has(fmt.Sprintf("SendMessageBatchRequestEntry.%d.Id", i)); i++ {
+				batch = append(batch, r.Form.Get(fmt.Sprintf("SendMessageBatchRequestEntry.%d.Id", i)))
+			}
+			batches = append(batches, batch)
+			w.Header().Set("Content-Type", "text/xml")
+			if len(batches) == tt.failCall {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprint(w, `<ErrorResponse><Error><Type>Receiver</Type><Code>InternalError</Code><Message>unavailable</Message></Error><RequestId>1</RequestId></ErrorResponse>`)
+				return
+			}
+			// the results are in reverse order, to be matched back to the messages by id.
+			var entries strings.Builder
+			for i := len(batch) - 1; i >= 0; i-- {
+				id := batch[i]
+				if tt.failIds[id] {
+					fmt.Fprintf(&entries, `<BatchResultErrorEntry><Id>%s</Id><Code>InvalidMessageContents</Code><Message>invalid</Message><SenderFault>true</SenderFault></BatchResultErrorEntry>`, id)
+					continue
+				}
+				fmt.Fprintf(&entries, `<SendMessageBatchResultEntry><Id>%s</Id><MessageId>m-%s</MessageId></SendMessageBatchResultEntry>`, id, id)
+			}
+			fmt.Fprintf(w, `<SendMessageBatchResponse><SendMessageBatchResult>%s</SendMessageBatchResult><ResponseMetadata><RequestId>1</RequestId></ResponseMetadata></SendMessageBatchResponse>`, entries.String())
+		}))
+		mq := MessageQueue{
+			client: sqs.New(sqs.Options{
+				Region:                           "eu-west-1",
+				Credentials:                      aws.AnonymousCredentials{},
+				EndpointResolver:                 sqs.EndpointResolverFromURL(server.URL),
+				Retryer:                          aws.NopRetryer{},
+				DisableMessageChecksumValidation: true,
+			}),
+			queueUrl: server.URL + "/queue",
+		}
+
+		results, err := mq.SendMessageBatch(context.Background(), tt.messages)
+		server.Close()
+		if (err != nil) != tt.expectedError {
+			t.Errorf("%s: unexpected error %v", tt.description, err)
+		}
+		if diff := cmp.Diff(tt.expectedBatches, batches); diff != "" {
+			t.Errorf("%s: unexpected batches: %s", tt.description, diff)
+		}
+		if len(results) != len(tt.messages) {
+			t.Fatalf("%s: got %d results for %d messages", tt.description, len(results), len(tt.messages))
+		}
+		for i, r := range results {
+			if r.MessageId != tt.expectedMessageIds[i] {
+				t.Errorf("%s: message %d: got id %q, expected %q", tt.description, i, r.MessageId, tt.expectedMessageIds[i])
+			}
+			if (r.Err != nil) != (tt.expectedMessageIds[i] == "") {
+				t.Errorf("%s: message %d: unexpected error %v", tt.description, i, r.Err)
+			}
+		}
+	}
+}
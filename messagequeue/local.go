@@ -0,0 +1,247 @@
+package messagequeue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+)
+
+// ErrInvalidReceipt is returned for a receipt handle that doesn't belong to a message in flight,
+// e.g. because it's been delivered again since.
+var ErrInvalidReceipt = errors.New("receipt handle is invalid")
+
+// DefaultVisibilityTimeout is how long a received message is hidden for, the same as SQS.
+const DefaultVisibilityTimeout = 30 * time.Second
+
+// LocalQueue is a message queue for tests and local runs with the delivery semantics of SQS: a
+// received message is hidden for the visibility timeout, and delivered again unless it's deleted
+// first. It's held in memory, or in a file so messages survive a restart. It's safe for
+// concurrent use, but a file should only be opened by one process at a time.
+type LocalQueue struct {
+	VisibilityTimeout time.Duration
+	// MaxReceiveCount is optional. When set, a message that's been received that many times is moved
+	// to the dead letter queue instead of being delivered again.
+	MaxReceiveCount int
+
+	mu    sync.Mutex
+	path  string
+	state localQueueState
+	now   func() time.Time
+}
+
+// localQueueState is everything about a queue that's saved to its file.
+type localQueueState struct {
+	Messages    []localMessage `json:"messages"`
+	DeadLetters []localMessage `json:"dead_letters,omitempty"`
+}
+
+type localMessage struct {
+	MessageId     string    `json:"message_id"`
+	Body          string    `json:"body"`
+	SentAt        time.Time `json:"sent_at"`
+	ReceiveCount  int       `json:"receive_count"`
+	VisibleAt     time.Time `json:"visible_at"`
+	ReceiptHandle string    `json:"receipt_handle,omitempty"`
+}
+
+func NewLocalQueue() *LocalQueue {
+	return &LocalQueue{
+		VisibilityTimeout: DefaultVisibilityTimeout,
+		now:               time.Now,
+	}
+}
+
+// OpenLocalQueue returns a queue saved to the file at path after every change, starting with the
+// messages already in it when it exists.
+func OpenLocalQueue(path string) (q *LocalQueue, err error) {
+	q = NewLocalQueue()
+	q.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		err = q.save()
+		return
+	}
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &q.state); err != nil {
+		err = fmt.Errorf("unable to read queue file %s: %w", path, err)
+	}
+	return
+}
+
+func (q *LocalQueue) SendMessage(ctx context.Context, message string) (messageId string, err error) {
+	if len(message) > MaxBatchBytes {
+		err = fmt.Errorf("message is %d bytes, larger than the %d byte limit", len(message), MaxBatchBytes)
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := len(q.state.Messages)
+	messageId = q.add(message)
+	if err = q.save(); err != nil {
+		q.state.Messages = q.state.Messages[:n]
+		messageId = ""
+	}
+	return
+}
+
+// SendMessageBatch queues the messages together, so either all of the messages within the size
+// limit are queued or, when the queue can't be saved, none are.
+func (q *LocalQueue) SendMessageBatch(ctx context.Context, messages []string) (results []BatchResult, err error) {
+	results = make([]BatchResult, len(messages))
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := len(q.state.Messages)
+	for i, m := range messages {
+		if len(m) > MaxBatchBytes {
+			results[i].Err = fmt.Errorf("message is %d bytes, larger than the %d byte limit", len(m), MaxBatchBytes)
+			continue
+		}
+		results[i].MessageId = q.add(m)
+	}
+	if err = q.save(); err != nil {
+		q.state.Messages = q.state.Messages[:n]
+		for i := range results {
+			results[i] = BatchResult{Err: err}
+		}
+	}
+	return
+}
+
+func (q *LocalQueue) add(message string) (messageId string) {
+	now := q.now()
+	messageId = uuid.New().String()
+	q.state.Messages = append(q.state.Messages, localMessage{
+		MessageId: messageId,
+		Body:      message,
+		SentAt:    now,
+		VisibleAt: now,
+	})
+	return
+}
+
+// Receive returns up to max of the visible messages, oldest first, hiding them for the visibility
+// timeout. It doesn't wait for messages, there are none when the queue is empty or every message
+// is in flight. The messages are shaped like those of an SQS event, so they can be handed to the
+// message handler as they are.
+func (q *LocalQueue) Receive(ctx context.Context, max int) (messages []events.SQSMessage, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := q.now()
+	kept := q.state.Messages[:0]
+	var deadLettered bool
+	for _, m := range q.state.Messages {
+		if len(messages) == max || now.Before(m.VisibleAt) {
+			kept = append(kept, m)
+			continue
+		}
+		if q.MaxReceiveCount > 0 && m.ReceiveCount >= q.MaxReceiveCount {
+			m.ReceiptHandle = ""
+			q.state.DeadLetters = append(q.state.DeadLetters, m)
+			deadLettered = true
+			continue
+		}
+		m.ReceiveCount++
+		m.VisibleAt = now.Add(q.VisibilityTimeout)
+		m.ReceiptHandle = uuid.New().String()
+		kept = append(kept, m)
+		messages = append(messages, m.event())
+	}
+	q.state.Messages = kept
+	// the queue is polled, so it's only saved when something has changed.
+	if len(messages) > 0 || deadLettered {
+		err = q.save()
+	}
+	return
+}
+
+// Delete removes a message once it's been processed, so it isn't delivered again.
+func (q *LocalQueue) Delete(ctx context.Context, receiptHandle string) (err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i, err := q.inFlight(receiptHandle)
+	if err != nil {
+		return
+	}
+	q.state.Messages = append(q.state.Messages[:i], q.state.Messages[i+1:]...)
+	return q.save()
+}
+
+// ChangeVisibility hides a message in flight for timeout from now, e.g. 0 makes it visible again
+// straight away.
+func (q *LocalQueue) ChangeVisibility(ctx context.Context, receiptHandle string, timeout time.Duration) (err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i, err := q.inFlight(receiptHandle)
+	if err != nil {
+		return
+	}
+	q.state.Messages[i].VisibleAt = q.now().Add(timeout)
+	return q.save()
+}
+
+func (q *LocalQueue) inFlight(receiptHandle string) (i int, err error) {
+	now := q.now()
+	for i, m := range q.state.Messages {
+		if receiptHandle != "" && m.ReceiptHandle == receiptHandle && now.Before(m.VisibleAt) {
+			return i, nil
+		}
+	}
+	return -1, ErrInvalidReceipt
+}
+
+// Len is the number of messages waiting to be delivered or in flight, not counting dead letters.
+func (q *LocalQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.state.Messages)
+}
+
+// DeadLetters returns the messages that were received MaxReceiveCount times without being deleted.
+func (q *LocalQueue) DeadLetters() (messages []events.SQSMessage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, m := range q.state.DeadLetters {
+		messages = append(messages, m.event())
+	}
+	return
+}
+
+// save writes the queue to its file, if it has one. The file is replaced in one go, so it's never
+// left half written.
+func (q *LocalQueue) save() (err error) {
+	if q.path == "" {
+		return
+	}
+	data, err := json.Marshal(q.state)
+	if err != nil {
+		return
+	}
+	tmp := q.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o644); err != nil {
+		return
+	}
+	return os.Rename(tmp, q.path)
+}
+
+func (m localMessage) event() events.SQSMessage {
+	return events.SQSMessage{
+		MessageId:     m.MessageId,
+		ReceiptHandle: m.ReceiptHandle,
+		Body:          m.Body,
+		Attributes: map[string]string{
+			"ApproximateReceiveCount": strconv.Itoa(m.ReceiveCount),
+			"SentTimestamp":           strconv.FormatInt(m.SentAt.UnixMilli(), 10),
+		},
+		EventSource: "aws:sqs",
+	}
+}
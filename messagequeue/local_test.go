@@ -0,0 +1,136 @@
+package messagequeue
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestLocalQueue(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 4, 20, 10, 0, 0, 0, time.UTC)
+	q := NewLocalQueue()
+	q.now = func() time.Time { return now }
+	q.VisibilityTimeout = time.Minute
+	q.MaxReceiveCount = 2
+
+	receive := func(description string, expected ...string) (messages []events.SQSMessage) {
+		messages, err := q.Receive(ctx, 10)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", description, err)
+		}
+		var bodies []string
+		for _, m := range messages {
+			bodies = append(bodies, m.Body)
+		}
+		if strings.Join(bodies, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s: got messages %v, expected %v", description, bodies, expected)
+		}
+		return
+	}
+
+	if _, err := q.SendMessage(ctx, "a"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	results, err := q.SendMessageBatch(ctx, []string{"b", strings.Repeat("x", MaxBatchBytes+1)})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if results[0].MessageId == "" || results[1].Err == nil {
+		t.Errorf("expected only the message within the size limit to be queued, got %+v", results)
+	}
+
+	messages := receive("given messages were sent, they're received in order", "a", "b")
+	receive("given the messages are in flight, they aren't received again")
+	if err := q.Delete(ctx, messages[0].ReceiptHandle); err != nil {
+		t.Errorf("unexpected error deleting: %v", err)
+	}
+	now = now.Add(time.Minute)
+	messages = receive("given the visibility timeout has passed, messages that weren't deleted are received again", "b")
+	if count := messages[0].Attributes["ApproximateReceiveCount"]; count != "2" {
+		t.Errorf("got receive count %s, expected 2", count)
+	}
+	if err := q.ChangeVisibility(ctx, messages[0].ReceiptHandle, 0); err != nil {
+		t.Errorf("unexpected error changing visibility: %v", err)
+	}
+	receive("given a message was received the most times allowed, it's moved to the dead letter queue")
+	if dead := q.DeadLetters(); len(dead) != 1 || dead[0].Body != "b" {
+		t.Errorf("got dead letters %+v, expected b", dead)
+	}
+	if q.Len() != 0 {
+		t.Errorf("got %d messages, expected none", q.Len())
+	}
+	if err := q.Delete(ctx, messages[0].ReceiptHandle); !errors.Is(err, ErrInvalidReceipt) {
+		t.Errorf("got error %v deleting a dead letter, expected %v", err, ErrInvalidReceipt)
+	}
+}
+
+func TestOpenLocalQueue(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "queue.json")
+	q, err := OpenLocalQueue(path)
+	if err != nil {
+		t.Fatalf("unable to open queue: %v", err)
+	}
+	if _, err = q.SendMessageBatch(ctx, []string{"a", "b"}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	messages, err := q.Receive(ctx, 1)
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("expected a message, got %v, %v", messages, err)
+	}
+
+	reopened, err := OpenLocalQueue(path)
+	if err != nil {
+		t.Fatalf("unable to reopen queue: %v", err)
+	}
+	if reopened.Len() != 2 {
+		t.Errorf("got %d messages after reopening, expected 2", reopened.Len())
+	}
+	if err = reopened.Delete(ctx, messages[0].ReceiptHandle); err != nil {
+		t.Errorf("expected a message in flight to be deleted after reopening, got %v", err)
+	}
+	received, err := reopened.Receive(ctx, 10)
+	if err != nil || len(received) != 1 || received[0].Body != "b" {
+		t.Errorf("expected only b to be received after reopening, got %v, %v", received, err)
+	}
+}
+
+func TestLocalQueueReceiveSaves(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "queue.json")
+	q, err := OpenLocalQueue(path)
+	if err != nil {
+		t.Fatalf("unable to open queue: %v", err)
+	}
+	if _, err = q.SendMessage(ctx, "a"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err = q.Receive(ctx, 1); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// with the only message in flight there's nothing to receive, so the file isn't written again.
+	if err = os.Remove(path); err != nil {
+		t.Fatalf("unable to remove queue file: %v", err)
+	}
+	if messages, err := q.Receive(ctx, 1); err != nil || len(messages) != 0 {
+		t.Fatalf("expected no messages, got %v, %v", messages, err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the queue not to be saved when nothing was received, got %v", err)
+	}
+	q.MaxReceiveCount = 1
+	q.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if messages, err := q.Receive(ctx, 1); err != nil || len(messages) != 0 {
+		t.Fatalf("expected the message to be dead lettered, got %v, %v", messages, err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected the queue to be saved when a message was dead lettered, got %v", err)
+	}
+}
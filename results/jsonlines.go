@@ -0,0 +1,69 @@
+package results
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// JSONLinesSink buffers records and writes them out as JSON Lines objects on each flush, one per
+// job under <prefix>/<job>/. Records that aren't part of a job are written under <prefix>/<date>/.
+// It's safe for concurrent use.
+type JSONLinesSink struct {
+	Writer DataWriterFunc
+	Prefix string
+
+	mu         sync.Mutex
+	partitions map[string]*bytes.Buffer
+}
+
+func NewJSONLinesSink(w DataWriterFunc, prefix string) *JSONLinesSink {
+	return &JSONLinesSink{
+		Writer:     w,
+		Prefix:     prefix,
+		partitions: make(map[string]*bytes.Buffer),
+	}
+}
+
+func (s *JSONLinesSink) Write(ctx context.Context, r Record) (err error) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	partition := r.Request.JobId
+	if partition == "" {
+		partition = r.FetchedAt.UTC().Format("2006-01-02")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buf, ok := s.partitions[partition]
+	if !ok {
+		buf = &bytes.Buffer{}
+		s.partitions[partition] = buf
+	}
+	buf.Write(line)
+	buf.WriteByte('\n')
+	return
+}
+
+// Flush writes any buffered records. The buffer is cleared even when a write fails, as the
+// messages behind those records are expected to be redelivered and processed again.
+func (s *JSONLinesSink) Flush(ctx context.Context) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var failed int
+	for partition, buf := range s.partitions {
+		key := path.Join(s.Prefix, partition, fmt.Sprintf("%s.jsonl", uuid.New().String()))
+		if writeErr := s.Writer(ctx, key, buf.Bytes()); writeErr != nil {
+			failed++
+			err = fmt.Errorf("unable to write %d of %d result objects, %s: %w", failed, len(s.partitions), key, writeErr)
+		}
+	}
+	s.partitions = make(map[string]*bytes.Buffer)
+	return
+}
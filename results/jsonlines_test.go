@@ -0,0 +1,100 @@
+package results
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antonielabuschagne/data-loader/weatherapi"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestJSONLinesSink(t *testing.T) {
+	written := map[string][]byte{}
+	sink := NewJSONLinesSink(func(ctx context.Context, key string, data []byte) (err error) {
+		written[key] = append([]byte(nil), data...)
+		return
+	}, "results")
+
+	fetchedAt := time.Date(2023, 4, 20, 10, 0, 0, 0, time.UTC)
+	records := []Record{
+		{Request: weatherapi.WeatherAPIRequest{Lon: "1", Lat: "2"}, FetchedAt: fetchedAt},
+		{Request: weatherapi.WeatherAPIRequest{Lon: "3", Lat: "4", Metadata: map[string]string{"store": "A1"}}, FetchedAt: fetchedAt},
+	}
+	for _, r := range records {
+		if err := sink.Write(context.Background(), r); err != nil {
+			t.Fatalf("unable to write record: %v", err)
+		}
+	}
+	if err := sink.Flush(context.Background()); err != nil {
+		t.Fatalf("unable to flush: %v", err)
+	}
+	if err := sink.Flush(context.Background()); err != nil {
+		t.Fatalf("unable to flush empty sink: %v", err)
+	}
+
+	if len(written) != 1 {
+		t.Fatalf("expected 1 object written, got %d", len(written))
+	}
+	for key, data := range written {
+		if !strings.HasPrefix(key, "results/2023-04-20/") || !strings.HasSuffix(key, ".jsonl") {
+			t.Errorf("unexpected key %q", key)
+		}
+		var got []Record
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var r Record
+			if err := json.Unmarshal([]byte(line), &r); err != nil {
+				t.Fatalf("unable to unmarshal line %q: %v", line, err)
+			}
+			got = append(got, r)
+		}
+		if !cmp.Equal(got, records) {
+			t.Errorf("got %v, expected %v", got, records)
+		}
+	}
+}
+
+func TestJSONLinesSinkFlushError(t *testing.T) {
+	var writes int
+	sink := NewJSONLinesSink(func(ctx context.Context, key string, data []byte) (err error) {
+		writes++
+		return errors.New("access denied")
+	}, "results")
+	if err := sink.Write(context.Background(), Record{}); err != nil {
+		t.Fatalf("unable to write record: %v", err)
+	}
+	if err := sink.Flush(context.Background()); err == nil {
+		t.Error("expected flush error")
+	}
+	// the failed records are retried through SQS, so they shouldn't be written again.
+	if err := sink.Flush(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if writes != 1 {
+		t.Errorf("expected 1 write, got %d", writes)
+	}
+}
+
+func TestJSONLinesSinkPartitionsByJob(t *testing.T) {
+	lines := map[string]int{}
+	sink := NewJSONLinesSink(func(ctx context.Context, key string, data []byte) (err error) {
+		lines[path.Dir(key)] += strings.Count(string(data), "\n")
+		return
+	}, "results")
+	for _, job := range []string{"job-a", "job-b", "job-a"} {
+		if err := sink.Write(context.Background(), Record{Request: weatherapi.WeatherAPIRequest{JobId: job}}); err != nil {
+			t.Fatalf("unable to write record: %v", err)
+		}
+	}
+	if err := sink.Flush(context.Background()); err != nil {
+		t.Fatalf("unable to flush: %v", err)
+	}
+	expected := map[string]int{"results/job-a": 2, "results/job-b": 1}
+	if !cmp.Equal(lines, expected) {
+		t.Errorf("got %v, expected %v", lines, expected)
+	}
+}
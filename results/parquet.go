@@ -0,0 +1,235 @@
+package results
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/antonielabuschagne/data-loader/weatherapi"
+	"github.com/google/uuid"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// ParquetRecord is the schema of the Parquet files written by ParquetSink. Columns are only ever
+// added to it, so tables defined over earlier files keep working. The job id and date aren't
+// columns, they're the partitions the files are written under.
+type ParquetRecord struct {
+	Row      int64             `parquet:"name=row, type=INT64"`
+	Lat      string            `parquet:"name=lat, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Lon      string            `parquet:"name=lon, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Metadata map[string]string `parquet:"name=metadata, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	// FetchedAt is in milliseconds since the unix epoch.
+	FetchedAt int64          `parquet:"name=fetched_at, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Weather   ParquetWeather `parquet:"name=weather"`
+	Units     string         `parquet:"name=units, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Lang      string         `parquet:"name=lang, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Provider  string         `parquet:"name=provider, type=BYTE_ARRAY, convertedtype=UTF8"`
+	// At is the time the weather was requested for, in milliseconds since the unix epoch. It's null
+	// for the current weather.
+	At *int64 `parquet:"name=at, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=OPTIONAL"`
+}
+
+// ParquetWeather mirrors weatherapi.Observation, in the shape of the OpenWeatherMap response it
+// was first written from.
+type ParquetWeather struct {
+	Coordinates ParquetCoordinates `parquet:"name=coord"`
+	Main        ParquetMain        `parquet:"name=main"`
+	Conditions  []ParquetCondition `parquet:"name=conditions, type=LIST"`
+	Visibility  int64              `parquet:"name=visibility, type=INT64"`
+	Wind        ParquetWind        `parquet:"name=wind"`
+	Clouds      int64              `parquet:"name=clouds, type=INT64"`
+	// precipitation is null, rather than 0, when the API didn't report any.
+	Rain1h  *float64 `parquet:"name=rain_1h, type=DOUBLE, repetitiontype=OPTIONAL"`
+	Rain3h  *float64 `parquet:"name=rain_3h, type=DOUBLE, repetitiontype=OPTIONAL"`
+	Snow1h  *float64 `parquet:"name=snow_1h, type=DOUBLE, repetitiontype=OPTIONAL"`
+	Snow3h  *float64 `parquet:"name=snow_3h, type=DOUBLE, repetitiontype=OPTIONAL"`
+	DT      int64    `parquet:"name=dt, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Country string   `parquet:"name=country, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Sunrise int64    `parquet:"name=sunrise, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Sunset  int64    `parquet:"name=sunset, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	// Timezone is the shift from UTC in seconds.
+	Timezone int64  `parquet:"name=timezone, type=INT64"`
+	CityID   int64  `parquet:"name=city_id, type=INT64"`
+	CityName string `parquet:"name=city_name, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+type ParquetCoordinates struct {
+	Lon float64 `parquet:"name=lon, type=DOUBLE"`
+	Lat float64 `parquet:"name=lat, type=DOUBLE"`
+}
+
+type ParquetMain struct {
+	Temp      float64 `parquet:"name=temp, type=DOUBLE"`
+	TempMin   float64 `parquet:"name=temp_min, type=DOUBLE"`
+	TempMax   float64 `parquet:"name=temp_max, type=DOUBLE"`
+	FeelsLike float64 `parquet:"name=feels_like, type=DOUBLE"`
+	Humidity  int64   `parquet:"name=humidity, type=INT64"`
+	Pressure  int64   `parquet:"name=pressure, type=INT64"`
+	SeaLevel  int64   `parquet:"name=sea_level, type=INT64"`
+	GrndLevel int64   `parquet:"name=grnd_level, type=INT64"`
+}
+
+type ParquetWind struct {
+	Speed float64 `parquet:"name=speed, type=DOUBLE"`
+	Deg   int64   `parquet:"name=deg, type=INT64"`
+	Gust  float64 `parquet:"name=gust, type=DOUBLE"`
+}
+
+// ParquetCondition mirrors weatherapi.Condition.
+type ParquetCondition struct {
+	ID          int64  `parquet:"name=id, type=INT64"`
+	Main        string `parquet:"name=main, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Description string `parquet:"name=description, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Icon        string `parquet:"name=icon, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+func NewParquetRecord(r Record) (p ParquetRecord) {
+	p.Row = int64(r.Request.Row)
+	p.Lat = r.Request.Lat
+	p.Lon = r.Request.Lon
+	p.Metadata = r.Request.Metadata
+	p.FetchedAt = r.FetchedAt.UnixMilli()
+	p.Units = string(r.Units)
+	p.Lang = r.Lang
+	p.Provider = string(r.Weather.Provider)
+	if r.Request.At != nil {
+		at := r.Request.At.UnixMilli()
+		p.At = &at
+	}
+	p.Weather.Coordinates.Lon = r.Weather.Coordinates.Lon
+	p.Weather.Coordinates.Lat = r.Weather.Coordinates.Lat
+	m := r.Weather.Main
+	p.Weather.Main = ParquetMain{
+		Temp:      m.Temp,
+		TempMin:   m.TempMin,
+		TempMax:   m.TempMax,
+		FeelsLike: m.FeelsLike,
+		Humidity:  m.Humidity,
+		Pressure:  m.Pressure,
+		SeaLevel:  m.SeaLevel,
+		GrndLevel: m.GrndLevel,
+	}
+	for _, w := range r.Weather.Conditions {
+		p.Weather.Conditions = append(p.Weather.Conditions, newParquetCondition(w))
+	}
+	p.Weather.Visibility = r.Weather.Visibility
+	p.Weather.Wind = ParquetWind(r.Weather.Wind)
+	p.Weather.Clouds = r.Weather.Clouds
+	if rain := r.Weather.Rain; rain != nil {
+		p.Weather.Rain1h, p.Weather.Rain3h = rain.OneHour, rain.ThreeHours
+	}
+	if snow := r.Weather.Snow; snow != nil {
+		p.Weather.Snow1h, p.Weather.Snow3h = snow.OneHour, snow.ThreeHours
+	}
+	p.Weather.DT = unixMilli(&r.Weather.Time)
+	p.Weather.Country = r.Weather.Location.Country
+	p.Weather.Sunrise = unixMilli(r.Weather.Sunrise)
+	p.Weather.Sunset = unixMilli(r.Weather.Sunset)
+	p.Weather.Timezone = r.Weather.Timezone
+	p.Weather.CityID = r.Weather.Location.ID
+	p.Weather.CityName = r.Weather.Location.Name
+	return
+}
+
+// unixMilli converts a time to the milliseconds of a Parquet timestamp, leaving no time as 0 as
+// it's always been for times the weather API didn't report.
+func unixMilli(t *time.Time) int64 {
+	if t == nil || t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func newParquetCondition(c weatherapi.Condition) ParquetCondition {
+	return ParquetCondition{ID: c.Code, Main: c.Main, Description: c.Description, Icon: c.Icon}
+}
+
+// noJobPartition is the job partition of records that aren't part of a job, it's the name Hive
+// (and so Athena) gives to a partition with no value.
+const noJobPartition = "__HIVE_DEFAULT_PARTITION__"
+
+// ParquetSink buffers records and writes them out as a Parquet file on each flush, one per job and
+// day under <prefix>/job=<job>/date=<date>/, so they can be queried as a partitioned table. It's
+// safe for concurrent use.
+type ParquetSink struct {
+	Writer DataWriterFunc
+	Prefix string
+
+	mu         sync.Mutex
+	partitions map[string][]ParquetRecord
+}
+
+func NewParquetSink(w DataWriterFunc, prefix string) *ParquetSink {
+	return &ParquetSink{
+		Writer:     w,
+		Prefix:     prefix,
+		partitions: make(map[string][]ParquetRecord),
+	}
+}
+
+// JobPrefix returns where the files of a job are written.
+func (s *ParquetSink) JobPrefix(jobId string) string {
+	return ParquetJobPrefix(s.Prefix, jobId)
+}
+
+// ParquetJobPrefix returns where a ParquetSink writing under prefix puts the files of a job.
+func ParquetJobPrefix(prefix, jobId string) string {
+	if jobId == "" {
+		jobId = noJobPartition
+	}
+	return path.Join(prefix, "job="+jobId)
+}
+
+func (s *ParquetSink) Write(ctx context.Context, r Record) (err error) {
+	partition := path.Join(s.JobPrefix(r.Request.JobId), "date="+r.FetchedAt.UTC().Format("2006-01-02"))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.partitions[partition] = append(s.partitions[partition], NewParquetRecord(r))
+	return
+}
+
+// Flush writes a new file for each partition with buffered records. When only some of them can be
+// written the whole batch is processed again, and the files that were written are left where they
+// are, so a row can have more than one result. Queries should take one per job partition and row,
+// e.g. the latest fetched_at. The buffer is cleared either way.
+func (s *ParquetSink) Flush(ctx context.Context) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var failed int
+	for partition, records := range s.partitions {
+		key := path.Join(partition, fmt.Sprintf("%s.parquet", uuid.New().String()))
+		data, writeErr := encodeParquet(records)
+		if writeErr == nil {
+			writeErr = s.Writer(ctx, key, data)
+		}
+		if writeErr != nil {
+			failed++
+			err = fmt.Errorf("unable to write %d of %d result objects, %s: %w", failed, len(s.partitions), key, writeErr)
+		}
+	}
+	s.partitions = make(map[string][]ParquetRecord)
+	return
+}
+
+func encodeParquet(records []ParquetRecord) (data []byte, err error) {
+	var buf bytes.Buffer
+	pw, err := writer.NewParquetWriterFromWriter(&buf, new(ParquetRecord), 1)
+	if err != nil {
+		return
+	}
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	for _, r := range records {
+		if err = pw.Write(r); err != nil {
+			return
+		}
+	}
+	if err = pw.WriteStop(); err != nil {
+		return
+	}
+	data = buf.Bytes()
+	return
+}
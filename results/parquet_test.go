@@ -0,0 +1,151 @@
+package results
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antonielabuschagne/data-loader/weatherapi"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+// parquetFile is an in-memory source.ParquetFile, for reading back what's been written.
+type parquetFile struct {
+	*bytes.Reader
+	data []byte
+}
+
+func newParquetFile(data []byte) parquetFile {
+	return parquetFile{Reader: bytes.NewReader(data), data: data}
+}
+
+// Open returns a new reader over the same data, as each column is read separately.
+func (f parquetFile) Open(name string) (source.ParquetFile, error) {
+	return newParquetFile(f.data), nil
+}
+
+func (f parquetFile) Create(name string) (source.ParquetFile, error) {
+	return nil, errors.New("read only")
+}
+
+func (f parquetFile) Write(p []byte) (int, error) {
+	return 0, errors.New("read only")
+}
+
+func (f parquetFile) Close() error {
+	return nil
+}
+
+func readParquet(t *testing.T, data []byte) (records []ParquetRecord) {
+	pr, err := reader.NewParquetReader(newParquetFile(data), new(ParquetRecord), 1)
+	if err != nil {
+		t.Fatalf("unable to open parquet file: %v", err)
+	}
+	defer pr.ReadStop()
+	records = make([]ParquetRecord, pr.GetNumRows())
+	if err = pr.Read(&records); err != nil {
+		t.Fatalf("unable to read parquet file: %v", err)
+	}
+	return
+}
+
+func TestParquetSink(t *testing.T) {
+	written := map[string][]byte{}
+	sink := NewParquetSink(func(ctx context.Context, key string, data []byte) (err error) {
+		written[key] = append([]byte(nil), data...)
+		return
+	}, "results")
+
+	fetchedAt := time.Date(2023, 4, 20, 10, 0, 0, 0, time.UTC)
+	rain := 0.45
+	weather := weatherapi.WeatherAPIResponse{
+		Coordinates: weatherapi.Coordinates{Lon: -0.1, Lat: 51.5},
+		Main:        weatherapi.Main{Temp: 284.2, TempMin: 283.1, TempMax: 285.6, FeelsLike: 283.5, Humidity: 81, Pressure: 1012},
+		WeatherResults: []weatherapi.Weather{
+			{ID: 500, Main: "Rain", Description: "light rain", Icon: "10d"},
+		},
+		Wind:     weatherapi.Wind{Speed: 4.1, Deg: 240},
+		Rain:     &weatherapi.Precipitation{OneHour: &rain},
+		DT:       1681984500,
+		Sys:      weatherapi.Sys{Country: "GB", Sunrise: 1681966380, Sunset: 1682017620},
+		CityName: "London",
+	}.Observation()
+	records := []Record{
+		{
+			Request:   weatherapi.WeatherAPIRequest{Lon: "-0.1", Lat: "51.5", JobId: "job-a", Row: 1, Metadata: map[string]string{"store": "A1"}},
+			Weather:   weather,
+			FetchedAt: fetchedAt,
+		},
+		{
+			Request:   weatherapi.WeatherAPIRequest{Lon: "-0.1", Lat: "51.5", JobId: "job-a", Row: 2, At: &fetchedAt},
+			Weather:   weather,
+			FetchedAt: fetchedAt,
+		},
+		{
+			Request:   weatherapi.WeatherAPIRequest{Lon: "-0.1", Lat: "51.5", JobId: "job-a", Row: 3},
+			FetchedAt: fetchedAt.Add(24 * time.Hour),
+		},
+		{
+			Request:   weatherapi.WeatherAPIRequest{Lon: "1", Lat: "2"},
+			FetchedAt: fetchedAt,
+		},
+	}
+	for _, r := range records {
+		if err := sink.Write(context.Background(), r); err != nil {
+			t.Fatalf("unable to write record: %v", err)
+		}
+	}
+	if err := sink.Flush(context.Background()); err != nil {
+		t.Fatalf("unable to flush: %v", err)
+	}
+	if err := sink.Flush(context.Background()); err != nil {
+		t.Fatalf("unable to flush empty sink: %v", err)
+	}
+
+	got := map[string][]ParquetRecord{}
+	for key, data := range written {
+		if !strings.HasSuffix(key, ".parquet") {
+			t.Errorf("unexpected key %q", key)
+		}
+		got[path.Dir(key)] = readParquet(t, data)
+	}
+	expected := map[string][]ParquetRecord{
+		"results/job=job-a/date=2023-04-20":                      {NewParquetRecord(records[0]), NewParquetRecord(records[1])},
+		"results/job=job-a/date=2023-04-21":                      {NewParquetRecord(records[2])},
+		"results/job=__HIVE_DEFAULT_PARTITION__/date=2023-04-20": {NewParquetRecord(records[3])},
+	}
+	if diff := cmp.Diff(expected, got, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("unexpected records: %s", diff)
+	}
+	if sink.JobPrefix("job-a") != "results/job=job-a" {
+		t.Errorf("unexpected job prefix %q", sink.JobPrefix("job-a"))
+	}
+}
+
+func TestParquetSinkFlushError(t *testing.T) {
+	var writes int
+	sink := NewParquetSink(func(ctx context.Context, key string, data []byte) (err error) {
+		writes++
+		return errors.New("access denied")
+	}, "results")
+	if err := sink.Write(context.Background(), Record{}); err != nil {
+		t.Fatalf("unable to write record: %v", err)
+	}
+	if err := sink.Flush(context.Background()); err == nil {
+		t.Error("expected flush error")
+	}
+	// the failed records are retried through SQS, so they shouldn't be written again.
+	if err := sink.Flush(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if writes != 1 {
+		t.Errorf("expected 1 write, got %d", writes)
+	}
+}
@@ -0,0 +1,22 @@
+package results
+
+import (
+	"context"
+	"time"
+
+	"github.com/antonielabuschagne/data-loader/weatherapi"
+)
+
+// Record is a processed message enriched with the weather for its coordinates.
+type Record struct {
+	Request weatherapi.WeatherAPIRequest `json:"request"`
+	// Weather is the same shape whichever provider it came from.
+	Weather weatherapi.Observation `json:"weather"`
+	// Units and Lang are what the weather was requested in, after any defaults were applied.
+	Units     weatherapi.Units `json:"units"`
+	Lang      string           `json:"lang,omitempty"`
+	FetchedAt time.Time        `json:"fetched_at"`
+}
+
+// DataWriterFunc stores data under the given key, e.g. as an S3 object.
+type DataWriterFunc func(ctx context.Context, key string, data []byte) (err error)
@@ -1,23 +1,71 @@
 package s3client
 
 import (
+	"bytes"
 	"context"
 	"io"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
-func NewS3DataFetcher(cfg aws.Config, bucket string) func(context.Context, string) (io.ReadCloser, error) {
+// NewS3DataFetcher returns a fetcher for objects in any bucket the credentials can read. With a
+// version id that version is fetched, and with an ETag the fetch fails if the object has changed,
+// which covers buckets without versioning.
+func NewS3DataFetcher(cfg aws.Config) func(context.Context, string, string, string, string) (io.ReadCloser, error) {
 	client := s3.NewFromConfig(cfg)
-	return func(ctx context.Context, key string) (io.ReadCloser, error) {
-		res, err := client.GetObject(ctx, &s3.GetObjectInput{
+	return func(ctx context.Context, bucket, key, versionId, eTag string) (io.ReadCloser, error) {
+		in := &s3.GetObjectInput{
 			Bucket: aws.String(bucket),
 			Key:    aws.String(key),
-		})
+		}
+		if versionId != "" {
+			in.VersionId = aws.String(versionId)
+		}
+		if eTag != "" {
+			// events have the ETag without the quotes it has everywhere else.
+			if !strings.HasPrefix(eTag, `"`) {
+				eTag = `"` + eTag + `"`
+			}
+			in.IfMatch = aws.String(eTag)
+		}
+		res, err := client.GetObject(ctx, in)
 		if err != nil {
 			return nil, err
 		}
-		return res.Body, nil
+		return object{
+			ReadCloser:      res.Body,
+			contentType:     aws.ToString(res.ContentType),
+			contentEncoding: aws.ToString(res.ContentEncoding),
+		}, nil
+	}
+}
+
+// object is the body of an S3 object along with the content type and encoding it was uploaded
+// with, so files without a recognised extension can still be decoded.
+type object struct {
+	io.ReadCloser
+	contentType     string
+	contentEncoding string
+}
+
+func (o object) ContentType() string {
+	return o.contentType
+}
+
+func (o object) ContentEncoding() string {
+	return o.contentEncoding
+}
+
+func NewS3DataWriter(cfg aws.Config, bucket string) func(context.Context, string, []byte) error {
+	client := s3.NewFromConfig(cfg)
+	return func(ctx context.Context, key string, data []byte) error {
+		_, err := client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(data),
+		})
+		return err
 	}
 }
@@ -0,0 +1,86 @@
+package weatherapi
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a CircuitBreaker.
+type BreakerState string
+
+const (
+	// BreakerClosed lets every call through.
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen lets no calls through until the cooldown has passed.
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets calls through to find out if the provider has recovered, a failure opens
+	// the circuit again and a success closes it.
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// CircuitBreaker stops calls to a provider after a run of failures, so they don't each have to
+// wait for it to fail. It's safe for concurrent use, and its state lasts as long as the process, so
+// it's carried between invocations of a warm Lambda function.
+type CircuitBreaker struct {
+	// Threshold is the number of failures in a row that opens the circuit.
+	Threshold int
+	// Cooldown is how long the circuit stays open before calls are tried again.
+	Cooldown time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	now      func() time.Time
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		Threshold: threshold,
+		Cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+func DefaultCircuitBreaker() *CircuitBreaker {
+	return NewCircuitBreaker(5, 30*time.Second)
+}
+
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state()
+}
+
+func (b *CircuitBreaker) state() BreakerState {
+	switch {
+	case b.failures < b.Threshold:
+		return BreakerClosed
+	case b.now().Sub(b.openedAt) < b.Cooldown:
+		return BreakerOpen
+	default:
+		return BreakerHalfOpen
+	}
+}
+
+// Allow reports whether a call can be made.
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state() != BreakerOpen
+}
+
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+}
+
+func (b *CircuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= b.Threshold {
+		// this also restarts the cooldown when a call fails while half open.
+		b.openedAt = b.now()
+	}
+}
@@ -0,0 +1,36 @@
+package weatherapi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2023, 4, 20, 10, 0, 0, 0, time.UTC)
+	b := NewCircuitBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	expectState := func(description string, expected BreakerState) {
+		if got := b.State(); got != expected {
+			t.Errorf("%s: got state %q, expected %q", description, got, expected)
+		}
+		if allowed := b.Allow(); allowed != (expected != BreakerOpen) {
+			t.Errorf("%s: got allowed %v", description, allowed)
+		}
+	}
+
+	b.Failure()
+	expectState("given a failure below the threshold, the circuit is closed", BreakerClosed)
+	b.Success()
+	b.Failure()
+	expectState("given a success in between, failures aren't counted together", BreakerClosed)
+	b.Failure()
+	expectState("given failures reaching the threshold, the circuit opens", BreakerOpen)
+	now = now.Add(time.Minute)
+	expectState("given the cooldown has passed, the circuit is half open", BreakerHalfOpen)
+	b.Failure()
+	expectState("given a failure while half open, the circuit opens again", BreakerOpen)
+	now = now.Add(time.Minute)
+	b.Success()
+	expectState("given a success while half open, the circuit closes", BreakerClosed)
+}
@@ -3,66 +3,327 @@ package weatherapi
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joerdav/zapray"
+	"go.uber.org/zap"
 )
 
+// WeatherAPIClient is safe for concurrent use, as long as its fields aren't changed once requests
+// are being made.
 type WeatherAPIClient struct {
 	Client *http.Client
-	URL    *url.URL
-	APIKey string
-	Log    *zapray.Logger
+	// URL is the current weather endpoint, it's never modified by the client.
+	URL *url.URL
+	// ForecastURL and HistoryURL are the forecast and historical (One Call timemachine) endpoints,
+	// by default they're alongside URL as they are for OpenWeatherMap.
+	ForecastURL *url.URL
+	HistoryURL  *url.URL
+	APIKey      string
+	Log         *zapray.Logger
+	Retry       RetryPolicy
+	// Limiter is optional, when set every attempt waits for it before calling the API.
+	Limiter Limiter
+	// Defaults are used for any options a request doesn't set.
+	Defaults Options
+}
+
+// RetryPolicy controls how failed requests are retried. Delays grow exponentially from BaseDelay up
+// to MaxDelay, with full jitter so concurrent callers don't retry in lockstep.
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt, so 1 disables retries.
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    10 * time.Second,
+	}
+}
+
+// APIError is returned when the API responds with a non-2xx status code.
+type APIError struct {
+	StatusCode int
+	Body       string
+	// RetryAfter is the delay requested by the API, if any.
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("api failed to respond with a 2xx status code, got: %d. body: %s", e.StatusCode, e.Body)
+}
+
+// Retryable reports whether the request might succeed if tried again. Rate limiting and server
+// errors are retryable, anything else (e.g. a bad API key or unknown location) is permanent.
+func (e *APIError) Retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusRequestTimeout || e.StatusCode >= 500
+}
+
+// IsRetryable reports whether err is worth retrying: a retryable API error, or a failure to reach
+// the API at all.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable()
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// IsPermanent reports whether err is an API error that trying again won't fix, e.g. an unknown
+// location. Errors that aren't from the API, such as a deadline or a failed write, aren't permanent.
+func IsPermanent(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && !apiErr.Retryable()
 }
 
 func NewWeatherAPIClient(apiKey string, baseUrl string, log *zapray.Logger) (c WeatherAPIClient, err error) {
-	url, err := url.Parse(baseUrl)
+	endpoint, err := url.Parse(baseUrl)
 	if err != nil {
 		return
 	}
 	c.Log = log
-	c.URL = url
+	c.URL = endpoint
+	c.ForecastURL = endpoint.ResolveReference(&url.URL{Path: "forecast"})
+	c.HistoryURL = endpoint.ResolveReference(&url.URL{Path: "../3.0/onecall/timemachine"})
 	c.APIKey = apiKey
 	c.Client = &http.Client{
 		Timeout: 20 * time.Second,
 	}
+	c.Retry = DefaultRetryPolicy()
+	c.Defaults = DefaultOptions()
 	return
 }
 
-func (c *WeatherAPIClient) buildUrl(params map[string]string) *url.URL {
-	url := c.URL
+// buildUrl returns a new URL for each request, leaving the endpoint URLs untouched so the client
+// can be shared between goroutines.
+func (c *WeatherAPIClient) buildUrl(endpoint *url.URL, params map[string]string) *url.URL {
+	params["appid"] = c.APIKey
+	return withQuery(endpoint, params)
+}
 
-	q := url.Query()
-	q.Set("appid", c.APIKey)
+// withQuery returns a copy of endpoint with params added to its query.
+func withQuery(endpoint *url.URL, params map[string]string) *url.URL {
+	u := *endpoint
+	q := u.Query()
 	for k, v := range params {
 		q.Set(k, v)
 	}
-	url.RawQuery = q.Encode()
-	return url
+	u.RawQuery = q.Encode()
+	return &u
 }
 
-func (c *WeatherAPIClient) GetWeatherForLatLong(ctx context.Context, lon, lat string) (result WeatherAPIResponse, err error) {
-	reqUrl := c.buildUrl(map[string]string{"lon": lon, "lat": lat})
+func (c *WeatherAPIClient) params(lon, lat string, opts Options) map[string]string {
+	params := map[string]string{"lon": lon, "lat": lat}
+	if opts.Units != "" {
+		params["units"] = string(opts.Units)
+	}
+	if opts.Lang != "" {
+		params["lang"] = opts.Lang
+	}
+	return params
+}
 
-	c.Log.Info("sending weatherapi request")
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqUrl.String(), nil)
+// GetWeatherForLatLong returns the current weather, or when opts.At is set the historical weather
+// or forecast for that time.
+func (c *WeatherAPIClient) GetWeatherForLatLong(ctx context.Context, lon, lat string, opts Options) (result WeatherAPIResponse, err error) {
+	opts = opts.WithDefaults(c.Defaults)
+	mode, err := OpenWeatherMapCoverage.ModeAt(opts.At, time.Now())
 	if err != nil {
 		return
 	}
-	res, err := c.Client.Do(req)
+	var ok bool
+	switch mode {
+	case ModeForecast:
+		var forecast ForecastResponse
+		if forecast, err = c.GetForecast(ctx, lon, lat, opts); err != nil {
+			return
+		}
+		if result, ok = forecast.At(opts.At); !ok {
+			err = fmt.Errorf("no forecast found for %s", opts.At.Format(time.RFC3339))
+		}
+	case ModeHistorical:
+		var history TimeMachineResponse
+		if history, err = c.GetHistorical(ctx, lon, lat, opts); err != nil {
+			return
+		}
+		if result, ok = history.Weather(); !ok {
+			err = fmt.Errorf("no historical weather found for %s", opts.At.Format(time.RFC3339))
+		}
+	default:
+		err = c.call(ctx, c.buildUrl(c.URL, c.params(lon, lat, opts)), &result)
+	}
+	return
+}
+
+// GetForecast returns the 5 day/3 hour forecast, opts.At is ignored.
+func (c *WeatherAPIClient) GetForecast(ctx context.Context, lon, lat string, opts Options) (result ForecastResponse, err error) {
+	opts = opts.WithDefaults(c.Defaults)
+	err = c.call(ctx, c.buildUrl(c.ForecastURL, c.params(lon, lat, opts)), &result)
+	return
+}
+
+// GetHistorical returns the weather at opts.At.
+func (c *WeatherAPIClient) GetHistorical(ctx context.Context, lon, lat string, opts Options) (result TimeMachineResponse, err error) {
+	opts = opts.WithDefaults(c.Defaults)
+	params := c.params(lon, lat, opts)
+	params["dt"] = strconv.FormatInt(opts.At.Unix(), 10)
+	err = c.call(ctx, c.buildUrl(c.HistoryURL, params), &result)
+	return
+}
+
+func (c *WeatherAPIClient) Name() ProviderName {
+	return OpenWeatherMap
+}
+
+// Observe is GetWeatherForLatLong as a Provider.
+func (c *WeatherAPIClient) Observe(ctx context.Context, lon, lat string, opts Options) (o Observation, err error) {
+	res, err := c.GetWeatherForLatLong(ctx, lon, lat, opts)
+	if err != nil {
+		return
+	}
+	o = res.Observation()
+	return
+}
+
+func (c *WeatherAPIClient) call(ctx context.Context, reqUrl *url.URL, result interface{}) error {
+	return call(ctx, c.Client, c.Log, c.Retry, c.Limiter, reqUrl, result)
+}
+
+// call gets reqUrl into result, retrying and waiting for the limiter as configured. It's shared by
+// the provider clients.
+func call(ctx context.Context, client *http.Client, log *zapray.Logger, retry RetryPolicy, limiter Limiter, reqUrl *url.URL, result interface{}) (err error) {
+	for attempt := 1; ; attempt++ {
+		if limiter != nil {
+			if err = limiter.Wait(ctx); err != nil {
+				return
+			}
+		}
+		log.Info("sending weatherapi request", zap.Int("attempt", attempt), zap.String("host", reqUrl.Host), zap.String("path", reqUrl.Path))
+		err = get(ctx, client, reqUrl.String(), result)
+		if err == nil || !IsRetryable(err) || attempt >= retry.MaxAttempts {
+			return
+		}
+		delay := retry.delay(attempt)
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+			if apiErr.RetryAfter > retry.MaxDelay {
+				// waiting that long would tie up the invocation, leave it to the queue to redeliver.
+				return
+			}
+			delay = apiErr.RetryAfter
+		}
+		log.Warn("weatherapi request failed, retrying", zap.String("error", err.Error()), zap.Duration("delay", delay))
+		if waitErr := sleep(ctx, delay); waitErr != nil {
+			return
+		}
+	}
+}
+
+func get(ctx context.Context, client *http.Client, reqUrl string, result interface{}) (err error) {
+	// the url errors from building and sending the request include the url, and with it the API key.
+	defer func() {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = redact(urlErr.URL)
+		}
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqUrl, nil)
+	if err != nil {
+		return
+	}
+	res, err := client.Do(req)
 	if err != nil {
 		return
 	}
 	defer res.Body.Close()
 	if statusOK := res.StatusCode >= 200 && res.StatusCode < 300; !statusOK {
 		body, _ := io.ReadAll(res.Body)
-		err = fmt.Errorf("api failed to respond with a 2xx status code, got: %d. body: %s", res.StatusCode, string(body))
+		err = &APIError{
+			StatusCode: res.StatusCode,
+			Body:       string(body),
+			RetryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+		}
 		return
 	}
-	err = json.NewDecoder(res.Body).Decode(&result)
+	err = json.NewDecoder(res.Body).Decode(result)
 	return
 }
+
+// secretParams are the query parameters that hold API keys.
+var secretParams = []string{"appid", "apikey"}
+
+// redact returns rawUrl with the values of any secretParams replaced, or without its query if it
+// can't be parsed.
+func redact(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		withoutQuery, _, _ := strings.Cut(rawUrl, "?")
+		return withoutQuery
+	}
+	q := u.Query()
+	for _, p := range secretParams {
+		if q.Has(p) {
+			q.Set(p, "redacted")
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// delay returns how long to wait before the next attempt, picked at random up to the exponential
+// backoff for the attempt just made.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	backoff := p.MaxDelay
+	if attempt < 32 {
+		if d := p.BaseDelay << (attempt - 1); d > 0 && d < p.MaxDelay {
+			backoff = d
+		}
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// parseRetryAfter handles both forms of the Retry-After header: a number of seconds or an HTTP date.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -6,10 +6,17 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/joerdav/zapray"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestGetWeatherForLatLong(t *testing.T) {
@@ -38,7 +45,7 @@ func TestGetWeatherForLatLong(t *testing.T) {
 			t.Error(err)
 		}
 
-		res, err := client.GetWeatherForLatLong(context.Background(), "1", "2")
+		res, err := client.GetWeatherForLatLong(context.Background(), "1", "2", Options{})
 		if tt.expectedError != "" {
 			if err.Error() != tt.expectedError {
 				t.Errorf("got error %q, but expected error %q", err, tt.expectedError)
@@ -85,7 +92,7 @@ func marshalResponse(t *testing.T, res WeatherAPIResponse) string {
 
 func buildGoodWeatherResponse() WeatherAPIResponse {
 	return WeatherAPIResponse{
-		Coorinates: Coorinates{
+		Coordinates: Coordinates{
 			Lon: 1,
 			Lat: 2,
 		},
@@ -106,3 +113,298 @@ func buildGoodWeatherResponse() WeatherAPIResponse {
 		},
 	}
 }
+
+type testResponse struct {
+	code       int
+	body       string
+	retryAfter string
+}
+
+func TestGetWeatherForLatLongRetries(t *testing.T) {
+	tests := []struct {
+		description   string
+		responses     []testResponse
+		expectedCalls int
+		expectedError bool
+	}{
+		{
+			description:   "given transient server errors, request is retried until it succeeds",
+			responses:     []testResponse{{code: http.StatusServiceUnavailable}, {code: http.StatusBadGateway}, {code: http.StatusOK, body: marshalResponse(t, buildGoodWeatherResponse())}},
+			expectedCalls: 3,
+		},
+		{
+			description:   "given server errors on every attempt, request gives up after max attempts",
+			responses:     []testResponse{{code: http.StatusInternalServerError}, {code: http.StatusInternalServerError}, {code: http.StatusInternalServerError}, {code: http.StatusOK}},
+			expectedCalls: 3,
+			expectedError: true,
+		},
+		{
+			description:   "given an invalid API key, request isn't retried",
+			responses:     []testResponse{{code: http.StatusUnauthorized}, {code: http.StatusOK}},
+			expectedCalls: 1,
+			expectedError: true,
+		},
+		{
+			description:   "given an unknown location, request isn't retried",
+			responses:     []testResponse{{code: http.StatusNotFound}, {code: http.StatusOK}},
+			expectedCalls: 1,
+			expectedError: true,
+		},
+		{
+			description:   "given rate limiting with a short Retry-After, request is retried",
+			responses:     []testResponse{{code: http.StatusTooManyRequests, retryAfter: "1"}, {code: http.StatusOK, body: marshalResponse(t, buildGoodWeatherResponse())}},
+			expectedCalls: 2,
+		},
+		{
+			description:   "given rate limiting with a Retry-After longer than the max delay, request isn't retried",
+			responses:     []testResponse{{code: http.StatusTooManyRequests, retryAfter: "120"}, {code: http.StatusOK}},
+			expectedCalls: 1,
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		var calls int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			res := tt.responses[calls]
+			calls++
+			if res.retryAfter != "" {
+				w.Header().Set("Retry-After", res.retryAfter)
+			}
+			w.WriteHeader(res.code)
+			_, _ = w.Write([]byte(res.body))
+		}))
+		client, err := buildWeatherApiClient(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Retry = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Second}
+
+		_, err = client.GetWeatherForLatLong(context.Background(), "1", "2", Options{})
+		server.Close()
+		if tt.expectedError && err == nil {
+			t.Errorf("%s: expected error", tt.description)
+		}
+		if !tt.expectedError && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.description, err)
+		}
+		if calls != tt.expectedCalls {
+			t.Errorf("%s: expected %d calls, got %d", tt.description, tt.expectedCalls, calls)
+		}
+	}
+}
+
+func TestGetWeatherForLatLongRedactsAPIKey(t *testing.T) {
+	// nothing is listening once the server is closed, so every attempt fails with a url error.
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	core, logs := observer.New(zap.DebugLevel)
+	client, err := NewWeatherAPIClient("secret-key", server.URL, zapray.New(core))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Retry = RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	_, err = client.GetWeatherForLatLong(context.Background(), "1", "2", Options{})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !IsRetryable(err) {
+		t.Errorf("expected a retryable error, got %v", err)
+	}
+	if strings.Contains(err.Error(), "secret-key") {
+		t.Errorf("expected the API key to be redacted from the error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "appid=redacted") {
+		t.Errorf("expected the error to include the redacted url, got %v", err)
+	}
+	for _, entry := range logs.All() {
+		for k, v := range entry.ContextMap() {
+			if s, ok := v.(string); ok && strings.Contains(s, "secret-key") {
+				t.Errorf("expected the API key to be redacted from the %q log, got %s: %s", entry.Message, k, s)
+			}
+		}
+	}
+	if logs.FilterMessage("weatherapi request failed, retrying").Len() != 1 {
+		t.Errorf("expected 1 retry to be logged, got %d", logs.FilterMessage("weatherapi request failed, retrying").Len())
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 10, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt := 1; attempt < 40; attempt++ {
+		limit := p.MaxDelay
+		if attempt < 5 {
+			limit = p.BaseDelay << (attempt - 1)
+		}
+		if d := p.delay(attempt); d < 0 || d > limit {
+			t.Errorf("attempt %d: delay %v outside of [0, %v]", attempt, d, limit)
+		}
+	}
+}
+
+func TestGetWeatherForLatLongConcurrent(t *testing.T) {
+	// the server echoes back the coordinates it was asked for, so crossed requests can be detected.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("appid") != "apikey" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		lon, _ := strconv.ParseFloat(q.Get("lon"), 64)
+		lat, _ := strconv.ParseFloat(q.Get("lat"), 64)
+		res := WeatherAPIResponse{Coordinates: Coordinates{Lon: lon, Lat: lat}}
+		_ = json.NewEncoder(w).Encode(res)
+	}))
+	defer server.Close()
+	client, err := buildWeatherApiClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseUrl := client.URL.String()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lon, lat := strconv.Itoa(i), strconv.Itoa(i+100)
+			res, err := client.GetWeatherForLatLong(context.Background(), lon, lat, Options{})
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			if res.Coordinates.Lon != float64(i) || res.Coordinates.Lat != float64(i+100) {
+				t.Errorf("requested %s,%s but got %v", lon, lat, res.Coordinates)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if client.URL.String() != baseUrl {
+		t.Errorf("expected base URL to be unchanged, got %s", client.URL)
+	}
+}
+
+func TestGetWeatherForLatLongOptions(t *testing.T) {
+	tests := []struct {
+		description   string
+		defaults      Options
+		opts          Options
+		expectedUnits string
+		expectedLang  string
+	}{
+		{
+			description:   "given no options, the client defaults are sent",
+			defaults:      Options{Units: UnitsMetric, Lang: "de"},
+			expectedUnits: "metric",
+			expectedLang:  "de",
+		},
+		{
+			description:   "given request options, they override the client defaults",
+			defaults:      Options{Units: UnitsMetric, Lang: "de"},
+			opts:          Options{Units: UnitsImperial, Lang: "pt_br"},
+			expectedUnits: "imperial",
+			expectedLang:  "pt_br",
+		},
+		{
+			description:   "given no defaults or options, standard units are sent without a language",
+			defaults:      DefaultOptions(),
+			expectedUnits: "standard",
+		},
+	}
+
+	for _, tt := range tests {
+		var query url.Values
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query = r.URL.Query()
+			_ = json.NewEncoder(w).Encode(buildGoodWeatherResponse())
+		}))
+		client, err := buildWeatherApiClient(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Defaults = tt.defaults
+		if _, err = client.GetWeatherForLatLong(context.Background(), "1", "2", tt.opts); err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.description, err)
+		}
+		server.Close()
+		if got := query.Get("units"); got != tt.expectedUnits {
+			t.Errorf("%s: got units %q, expected %q", tt.description, got, tt.expectedUnits)
+		}
+		if got, ok := query["lang"]; tt.expectedLang == "" && ok || tt.expectedLang != "" && query.Get("lang") != tt.expectedLang {
+			t.Errorf("%s: got lang %q, expected %q", tt.description, got, tt.expectedLang)
+		}
+	}
+}
+
+func TestGetWeatherForLatLongModes(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	tests := []struct {
+		description   string
+		at            time.Time
+		expectedPath  string
+		expectedDT    int64
+		expectedError bool
+	}{
+		{
+			description:  "given no time, the current weather endpoint is used",
+			expectedPath: "/data/2.5/weather",
+			expectedDT:   1,
+		},
+		{
+			description:  "given a time tomorrow, the closest forecast is returned",
+			at:           now.Add(25 * time.Hour),
+			expectedPath: "/data/2.5/forecast",
+			expectedDT:   now.Add(24 * time.Hour).Unix(),
+		},
+		{
+			description:  "given a time in the past, the timemachine endpoint is used",
+			at:           time.Date(2022, 2, 26, 15, 0, 0, 0, time.UTC),
+			expectedPath: "/data/3.0/onecall/timemachine",
+			expectedDT:   time.Date(2022, 2, 26, 15, 0, 0, 0, time.UTC).Unix(),
+		},
+		{
+			description:   "given a time beyond the forecast, no request is made",
+			at:            now.Add(10 * 24 * time.Hour),
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		var path string
+		var query url.Values
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path, query = r.URL.Path, r.URL.Query()
+			dt, _ := strconv.ParseInt(query.Get("dt"), 10, 64)
+			var res interface{}
+			switch r.URL.Path {
+			case "/data/2.5/forecast":
+				res = ForecastResponse{List: []Forecast{{DT: now.Add(24 * time.Hour).Unix()}, {DT: now.Add(27 * time.Hour).Unix()}}}
+			case "/data/3.0/onecall/timemachine":
+				res = TimeMachineResponse{Data: []HistoricalWeather{{DT: dt}}}
+			default:
+				res = WeatherAPIResponse{DT: 1}
+			}
+			_ = json.NewEncoder(w).Encode(res)
+		}))
+		client, err := buildWeatherApiClient(server.URL + "/data/2.5/weather")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := client.GetWeatherForLatLong(context.Background(), "1", "2", Options{At: tt.at})
+		server.Close()
+		if (err != nil) != tt.expectedError {
+			t.Errorf("%s: unexpected error: %v", tt.description, err)
+			continue
+		}
+		if path != tt.expectedPath {
+			t.Errorf("%s: got path %q, expected %q", tt.description, path, tt.expectedPath)
+		}
+		if res.DT != tt.expectedDT {
+			t.Errorf("%s: got weather for %d, expected %d", tt.description, res.DT, tt.expectedDT)
+		}
+		if tt.expectedPath != "" && query.Get("units") != "standard" {
+			t.Errorf("%s: expected units to be sent, got %v", tt.description, query)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package weatherapi
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoDBLimiterBackend keeps SharedLimiter counters in a DynamoDB table with a string partition
+// key "pk" and TTL attribute "expires_at", so a rate limit is shared by every instance of the
+// message handler rather than applying to each of them.
+type DynamoDBLimiterBackend struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoDBLimiterBackend(cfg aws.Config, tableName string) (b DynamoDBLimiterBackend) {
+	b.client = dynamodb.NewFromConfig(cfg)
+	b.tableName = tableName
+	return
+}
+
+func (d DynamoDBLimiterBackend) Increment(ctx context.Context, key string, expiresAt time.Time) (count int, err error) {
+	res, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.tableName),
+		Key: map[string]types.AttributeValue{
+			"pk": &types.AttributeValueMemberS{Value: key},
+		},
+		UpdateExpression: aws.String("ADD #count :one SET expires_at = :expires_at"),
+		ExpressionAttributeNames: map[string]string{
+			"#count": "count",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":        &types.AttributeValueMemberN{Value: "1"},
+			":expires_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return
+	}
+	n, ok := res.Attributes["count"].(*types.AttributeValueMemberN)
+	if !ok {
+		err = fmt.Errorf("rate limit counter %s has no count", key)
+		return
+	}
+	count, err = strconv.Atoi(n.Value)
+	return
+}
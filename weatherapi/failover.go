@@ -0,0 +1,93 @@
+package weatherapi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/joerdav/zapray"
+	"go.uber.org/zap"
+)
+
+// ObserveFunc gets the weather from a provider, e.g. Provider.Observe.
+type ObserveFunc func(ctx context.Context, lon, lat string, opts Options) (Observation, error)
+
+// FailoverProvider is one of the providers tried by Failover.
+type FailoverProvider struct {
+	Name    ProviderName
+	Observe ObserveFunc
+	// Coverage is the range of times the provider has weather for, it's skipped for any others.
+	Coverage Coverage
+	Breaker  *CircuitBreaker
+}
+
+// Failover is a Provider that tries each of its providers in order until one returns the weather.
+// Providers with an open circuit breaker are skipped, as are those that don't cover the time asked
+// for; only retryable errors count towards opening the breaker. The observation records which
+// provider it came from.
+type Failover struct {
+	Providers []FailoverProvider
+	Log       *zapray.Logger
+}
+
+// NewFailover returns a Failover trying the providers in the order given, each with a default
+// circuit breaker.
+func NewFailover(log *zapray.Logger, providers ...Provider) (f *Failover) {
+	f = &Failover{Log: log}
+	for _, p := range providers {
+		f.Providers = append(f.Providers, FailoverProvider{
+			Name:     p.Name(),
+			Observe:  p.Observe,
+			Coverage: p.Name().Coverage(),
+			Breaker:  DefaultCircuitBreaker(),
+		})
+	}
+	return
+}
+
+// Name is the names of the providers, in the order they're tried.
+func (f *Failover) Name() ProviderName {
+	names := make([]string, len(f.Providers))
+	for i, p := range f.Providers {
+		names[i] = string(p.Name)
+	}
+	return ProviderName(strings.Join(names, ","))
+}
+
+func (f *Failover) Observe(ctx context.Context, lon, lat string, opts Options) (o Observation, err error) {
+	now := time.Now()
+	var failures []string
+	for _, p := range f.Providers {
+		if _, coverageErr := p.Coverage.ModeAt(opts.At, now); coverageErr != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", p.Name, coverageErr))
+			continue
+		}
+		if !p.Breaker.Allow() {
+			f.Log.Warn("weather provider circuit open, skipping", zap.String("provider", string(p.Name)))
+			failures = append(failures, fmt.Sprintf("%s: circuit open", p.Name))
+			continue
+		}
+		o, err = p.Observe(ctx, lon, lat, opts)
+		if err == nil {
+			p.Breaker.Success()
+			if o.Provider == "" {
+				o.Provider = p.Name
+			}
+			return
+		}
+		if ctx.Err() != nil {
+			// the caller gave up, which says nothing about the provider.
+			return
+		}
+		// an error that trying again won't fix, e.g. an unknown location, doesn't mean the provider
+		// is unavailable, though the next provider might still have the weather.
+		if IsRetryable(err) {
+			p.Breaker.Failure()
+		}
+		f.Log.Warn("weather provider failed, trying the next", zap.String("provider", string(p.Name)), zap.String("error", err.Error()), zap.String("breaker", string(p.Breaker.State())))
+		failures = append(failures, fmt.Sprintf("%s: %v", p.Name, err))
+	}
+	err = fmt.Errorf("no weather provider returned the weather, %s", strings.Join(failures, "; "))
+	return
+}
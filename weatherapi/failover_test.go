@@ -0,0 +1,155 @@
+package weatherapi
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/joerdav/zapray"
+)
+
+// fakeProvider returns the weather or fails, counting its calls.
+type fakeProvider struct {
+	name  ProviderName
+	err   error
+	calls int
+}
+
+func (p *fakeProvider) Name() ProviderName {
+	return p.name
+}
+
+func (p *fakeProvider) Observe(ctx context.Context, lon, lat string, opts Options) (o Observation, err error) {
+	p.calls++
+	if p.err != nil {
+		err = p.err
+		return
+	}
+	o.Provider = p.name
+	return
+}
+
+func TestFailover(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+	tests := []struct {
+		description      string
+		primaryErr       error
+		secondaryErr     error
+		opts             Options
+		expectedProvider ProviderName
+		expectedCalls    [2]int
+		expectedError    bool
+	}{
+		{
+			description:      "given the first provider succeeds, the rest aren't tried",
+			expectedProvider: OpenWeatherMap,
+			expectedCalls:    [2]int{1, 0},
+		},
+		{
+			description:      "given the first provider fails, the next is used",
+			primaryErr:       &APIError{StatusCode: 503},
+			expectedProvider: OpenMeteo,
+			expectedCalls:    [2]int{1, 1},
+		},
+		{
+			description:   "given every provider fails, an error is returned",
+			primaryErr:    &APIError{StatusCode: 503},
+			secondaryErr:  errors.New("connection refused"),
+			expectedCalls: [2]int{1, 1},
+			expectedError: true,
+		},
+		{
+			description:      "given a time only the second provider covers, the first isn't tried",
+			opts:             Options{At: time.Now().Add(10 * 24 * time.Hour)},
+			expectedProvider: OpenMeteo,
+			expectedCalls:    [2]int{0, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		primary := &fakeProvider{name: OpenWeatherMap, err: tt.primaryErr}
+		secondary := &fakeProvider{name: OpenMeteo, err: tt.secondaryErr}
+		f := NewFailover(logger, primary, secondary)
+		o, err := f.Observe(context.Background(), "1", "2", tt.opts)
+		if (err != nil) != tt.expectedError {
+			t.Errorf("%s: unexpected error: %v", tt.description, err)
+		}
+		if o.Provider != tt.expectedProvider {
+			t.Errorf("%s: got provider %q, expected %q", tt.description, o.Provider, tt.expectedProvider)
+		}
+		if calls := [2]int{primary.calls, secondary.calls}; calls != tt.expectedCalls {
+			t.Errorf("%s: got calls %v, expected %v", tt.description, calls, tt.expectedCalls)
+		}
+	}
+}
+
+func TestFailoverCircuitBreaker(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+	tests := []struct {
+		description   string
+		primaryErr    error
+		expectedCalls int
+		expectedState BreakerState
+	}{
+		{
+			description:   "given a provider keeps failing, its circuit opens and it stops being called",
+			primaryErr:    &APIError{StatusCode: 429},
+			expectedCalls: 2,
+			expectedState: BreakerOpen,
+		},
+		{
+			description:   "given a provider keeps returning errors that won't go away if retried, its circuit stays closed",
+			primaryErr:    &APIError{StatusCode: 404, Body: "city not found"},
+			expectedCalls: 5,
+			expectedState: BreakerClosed,
+		},
+	}
+
+	for _, tt := range tests {
+		primary := &fakeProvider{name: OpenWeatherMap, err: tt.primaryErr}
+		secondary := &fakeProvider{name: OpenMeteo}
+		f := NewFailover(logger, primary, secondary)
+		f.Providers[0].Breaker = NewCircuitBreaker(2, time.Hour)
+
+		for i := 0; i < 5; i++ {
+			o, err := f.Observe(context.Background(), "1", "2", Options{})
+			if err != nil || o.Provider != OpenMeteo {
+				t.Fatalf("%s: unexpected result %v, %v", tt.description, o, err)
+			}
+		}
+		if primary.calls != tt.expectedCalls {
+			t.Errorf("%s: expected %d calls to the failing provider, got %d", tt.description, tt.expectedCalls, primary.calls)
+		}
+		if state := f.Providers[0].Breaker.State(); state != tt.expectedState {
+			t.Errorf("%s: expected the breaker to be %s, got %s", tt.description, tt.expectedState, state)
+		}
+		if f.Name() != "openweathermap,open-meteo" {
+			t.Errorf("%s: unexpected name %q", tt.description, f.Name())
+		}
+	}
+}
+
+func TestFailoverCancelled(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	primary := &fakeProvider{name: OpenWeatherMap, err: context.Canceled}
+	secondary := &fakeProvider{name: OpenMeteo}
+	f := NewFailover(logger, primary, secondary)
+	if _, err := f.Observe(ctx, "1", "2", Options{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the cancellation to be returned, got %v", err)
+	}
+	if secondary.calls != 0 || f.Providers[0].Breaker.State() != BreakerClosed {
+		t.Error("expected a cancellation not to fail over or count as a failure")
+	}
+}
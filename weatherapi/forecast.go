@@ -0,0 +1,98 @@
+package weatherapi
+
+import "time"
+
+// ForecastResponse is the OpenWeatherMap 5 day/3 hour forecast response, see
+// https://openweathermap.org/forecast5#fields_JSON.
+type ForecastResponse struct {
+	Cod     string     `json:"cod"`
+	Message float64    `json:"message"`
+	Count   int        `json:"cnt"`
+	List    []Forecast `json:"list"`
+	City    City       `json:"city"`
+}
+
+// Forecast is the weather forecast for a 3 hour period starting at DT.
+type Forecast struct {
+	DT             int64        `json:"dt"`
+	Main           ForecastMain `json:"main"`
+	WeatherResults []Weather    `json:"weather"`
+	Clouds         Clouds       `json:"clouds"`
+	Wind           Wind         `json:"wind"`
+	Visibility     int64        `json:"visibility"`
+	// Pop is the probability of precipitation, from 0 to 1.
+	Pop float64 `json:"pop"`
+	// Rain and Snow are the volume for the 3 hours, only present when some is expected.
+	Rain *Precipitation `json:"rain,omitempty"`
+	Snow *Precipitation `json:"snow,omitempty"`
+	Sys  ForecastSys    `json:"sys"`
+	// DTText is DT as "2006-01-02 15:04:05" in UTC.
+	DTText string `json:"dt_txt"`
+}
+
+type ForecastMain struct {
+	Main
+	// TempKF is the internal adjustment made to the temperature.
+	TempKF float64 `json:"temp_kf"`
+}
+
+type ForecastSys struct {
+	// Pod is the part of the day, d or n.
+	Pod string `json:"pod"`
+}
+
+type City struct {
+	ID          int64       `json:"id"`
+	Name        string      `json:"name"`
+	Coordinates Coordinates `json:"coord"`
+	Country     string      `json:"country"`
+	Population  int64       `json:"population"`
+	// Timezone is the shift from UTC in seconds.
+	Timezone int64 `json:"timezone"`
+	Sunrise  int64 `json:"sunrise"`
+	Sunset   int64 `json:"sunset"`
+}
+
+// At returns the forecast closest to t in the shape of a current weather response, so it can be
+// handled the same way. It returns false if t is after the end of the forecast.
+func (r ForecastResponse) At(t time.Time) (res WeatherAPIResponse, ok bool) {
+	if len(r.List) == 0 {
+		return
+	}
+	last := r.List[len(r.List)-1]
+	if t.Unix() > last.DT+int64(3*time.Hour/time.Second) {
+		return
+	}
+	closest := r.List[0]
+	for _, f := range r.List[1:] {
+		if abs(f.DT-t.Unix()) < abs(closest.DT-t.Unix()) {
+			closest = f
+		}
+	}
+	return closest.response(r.City), true
+}
+
+func (f Forecast) response(city City) WeatherAPIResponse {
+	return WeatherAPIResponse{
+		Coordinates:    city.Coordinates,
+		WeatherResults: f.WeatherResults,
+		Main:           f.Main.Main,
+		Visibility:     f.Visibility,
+		Wind:           f.Wind,
+		Clouds:         f.Clouds,
+		Rain:           f.Rain,
+		Snow:           f.Snow,
+		DT:             f.DT,
+		Sys:            Sys{Country: city.Country, Sunrise: city.Sunrise, Sunset: city.Sunset},
+		Timezone:       city.Timezone,
+		CityID:         city.ID,
+		CityName:       city.Name,
+	}
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
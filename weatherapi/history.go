@@ -0,0 +1,61 @@
+package weatherapi
+
+// TimeMachineResponse is the OpenWeatherMap One Call historical weather response, see
+// https://openweathermap.org/api/one-call-3#history.
+type TimeMachineResponse struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+	// Timezone is the IANA name of the timezone, e.g. Europe/London.
+	Timezone string `json:"timezone"`
+	// TimezoneOffset is the shift from UTC in seconds.
+	TimezoneOffset int64               `json:"timezone_offset"`
+	Data           []HistoricalWeather `json:"data"`
+}
+
+type HistoricalWeather struct {
+	DT        int64   `json:"dt"`
+	Sunrise   int64   `json:"sunrise"`
+	Sunset    int64   `json:"sunset"`
+	Temp      float64 `json:"temp"`
+	FeelsLike float64 `json:"feels_like"`
+	Pressure  int64   `json:"pressure"`
+	Humidity  int64   `json:"humidity"`
+	DewPoint  float64 `json:"dew_point"`
+	UVI       float64 `json:"uvi,omitempty"`
+	// Clouds is the cloud cover as a percentage.
+	Clouds         int64          `json:"clouds"`
+	Visibility     int64          `json:"visibility"`
+	WindSpeed      float64        `json:"wind_speed"`
+	WindDeg        int64          `json:"wind_deg"`
+	WindGust       float64        `json:"wind_gust,omitempty"`
+	WeatherResults []Weather      `json:"weather"`
+	Rain           *Precipitation `json:"rain,omitempty"`
+	Snow           *Precipitation `json:"snow,omitempty"`
+}
+
+// Weather returns the historical weather in the shape of a current weather response, so it can be
+// handled the same way. It returns false if there's no data.
+func (r TimeMachineResponse) Weather() (res WeatherAPIResponse, ok bool) {
+	if len(r.Data) == 0 {
+		return
+	}
+	w := r.Data[0]
+	return WeatherAPIResponse{
+		Coordinates:    Coordinates{Lon: r.Lon, Lat: r.Lat},
+		WeatherResults: w.WeatherResults,
+		Main: Main{
+			Temp:      w.Temp,
+			FeelsLike: w.FeelsLike,
+			Humidity:  w.Humidity,
+			Pressure:  w.Pressure,
+		},
+		Visibility: w.Visibility,
+		Wind:       Wind{Speed: w.WindSpeed, Deg: w.WindDeg, Gust: w.WindGust},
+		Clouds:     Clouds{All: w.Clouds},
+		Rain:       w.Rain,
+		Snow:       w.Snow,
+		DT:         w.DT,
+		Sys:        Sys{Sunrise: w.Sunrise, Sunset: w.Sunset},
+		Timezone:   r.TimezoneOffset,
+	}, true
+}
@@ -1,17 +1,81 @@
 package weatherapi
 
+import "time"
+
 type WeatherAPIRequest struct {
 	Lat string `json:"lat"`
 	Lon string `json:"lon"`
+	// Metadata holds any additional columns from the source row, keyed by column heading, so they
+	// can be carried through to the weather results.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// JobId and Row identify the source file and data row (starting at 1) the request came from.
+	JobId string `json:"job_id,omitempty"`
+	Row   int    `json:"row,omitempty"`
+	// Units and Lang override the defaults of the message handler for this request.
+	Units Units  `json:"units,omitempty"`
+	Lang  string `json:"lang,omitempty"`
+	// At is when the weather is wanted for, the current weather is used without it.
+	At *time.Time `json:"at,omitempty"`
+	// Rows are the other rows served by the request when identical or nearby coordinates are
+	// deduplicated as they're queued, the weather is written out for each of them too.
+	Rows []RequestRow `json:"rows,omitempty"`
+}
+
+// RequestRow is a source row sharing the weather of another row's request.
+type RequestRow struct {
+	Row      int               `json:"row"`
+	Lat      string            `json:"lat"`
+	Lon      string            `json:"lon"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// FanOut returns a request for each row the request serves, starting with its own, so each gets
+// its own result.
+func (r WeatherAPIRequest) FanOut() (requests []WeatherAPIRequest) {
+	req := r
+	req.Rows = nil
+	requests = append(requests, req)
+	for _, row := range r.Rows {
+		req.Row, req.Lat, req.Lon, req.Metadata = row.Row, row.Lat, row.Lon, row.Metadata
+		requests = append(requests, req)
+	}
+	return
 }
 
+func (r WeatherAPIRequest) Options() (opts Options) {
+	opts = Options{Units: r.Units, Lang: r.Lang}
+	if r.At != nil {
+		opts.At = *r.At
+	}
+	return
+}
+
+// WeatherAPIResponse is the OpenWeatherMap current weather response, see
+// https://openweathermap.org/current#fields_json. Fields the API leaves out when they don't apply
+// are pointers or omitted when empty, so a response survives being decoded and encoded again.
 type WeatherAPIResponse struct {
-	Coorinates     Coorinates `json:"coord"`
-	Main           Main       `json:"main"`
-	WeatherResults []Weather  `json:"weather"`
+	Coordinates    Coordinates `json:"coord"`
+	WeatherResults []Weather   `json:"weather"`
+	Base           string      `json:"base"`
+	Main           Main        `json:"main"`
+	// Visibility is in metres, up to 10km.
+	Visibility int64  `json:"visibility"`
+	Wind       Wind   `json:"wind"`
+	Clouds     Clouds `json:"clouds"`
+	// Rain and Snow are only present when there's been some.
+	Rain *Precipitation `json:"rain,omitempty"`
+	Snow *Precipitation `json:"snow,omitempty"`
+	// DT is the time the weather was calculated, in unix seconds (UTC).
+	DT  int64 `json:"dt"`
+	Sys Sys   `json:"sys"`
+	// Timezone is the shift from UTC in seconds.
+	Timezone int64  `json:"timezone"`
+	CityID   int64  `json:"id"`
+	CityName string `json:"name"`
+	Cod      int    `json:"cod"`
 }
 
-type Coorinates struct {
+type Coordinates struct {
 	Lon float64 `json:"lon"`
 	Lat float64 `json:"lat"`
 }
@@ -29,4 +93,57 @@ type Main struct {
 	TempMax   float64 `json:"temp_max"`
 	FeelsLike float64 `json:"feels_like"`
 	Humidity  int64   `json:"humidity"`
+	// Pressure is at sea level if there's no sea or ground level data, in hPa.
+	Pressure  int64 `json:"pressure"`
+	SeaLevel  int64 `json:"sea_level,omitempty"`
+	GrndLevel int64 `json:"grnd_level,omitempty"`
+}
+
+type Wind struct {
+	Speed float64 `json:"speed"`
+	// Deg is the direction the wind is coming from, in meteorological degrees.
+	Deg  int64   `json:"deg"`
+	Gust float64 `json:"gust,omitempty"`
+}
+
+type Clouds struct {
+	// All is the cloud cover as a percentage.
+	All int64 `json:"all"`
+}
+
+// Precipitation is the volume of rain or snow, in mm, for the last hour and last three hours.
+type Precipitation struct {
+	OneHour    *float64 `json:"1h,omitempty"`
+	ThreeHours *float64 `json:"3h,omitempty"`
+}
+
+type Sys struct {
+	Type    int64   `json:"type,omitempty"`
+	ID      int64   `json:"id,omitempty"`
+	Message float64 `json:"message,omitempty"`
+	Country string  `json:"country,omitempty"`
+	// Sunrise and Sunset are in unix seconds (UTC).
+	Sunrise int64 `json:"sunrise"`
+	Sunset  int64 `json:"sunset"`
+}
+
+// Observation returns the response as a provider-neutral observation.
+func (r WeatherAPIResponse) Observation() (o Observation) {
+	o.Provider = OpenWeatherMap
+	o.Time = time.Unix(r.DT, 0).UTC()
+	o.Coordinates = r.Coordinates
+	o.Location = Location{ID: r.CityID, Name: r.CityName, Country: r.Sys.Country}
+	for _, w := range r.WeatherResults {
+		o.Conditions = append(o.Conditions, Condition{Code: w.ID, Main: w.Main, Description: w.Description, Icon: w.Icon})
+	}
+	o.Main = r.Main
+	o.Visibility = r.Visibility
+	o.Wind = r.Wind
+	o.Clouds = r.Clouds.All
+	o.Rain = r.Rain
+	o.Snow = r.Snow
+	o.Sunrise = unixTime(r.Sys.Sunrise)
+	o.Sunset = unixTime(r.Sys.Sunset)
+	o.Timezone = r.Timezone
+	return
 }
@@ -0,0 +1,205 @@
+package weatherapi
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func float(f float64) *float64 {
+	return &f
+}
+
+// roundTrip checks every field of a fixture is modelled, by encoding the decoded value again and
+// comparing it to the fixture.
+func roundTrip(t *testing.T, description string, data []byte, v interface{}) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("%s: unable to marshal response: %v", description, err)
+	}
+	var expected, got interface{}
+	if err = json.Unmarshal(data, &expected); err != nil {
+		t.Fatalf("%s: unable to unmarshal fixture: %v", description, err)
+	}
+	if err = json.Unmarshal(encoded, &got); err != nil {
+		t.Fatalf("%s: unable to unmarshal encoded response: %v", description, err)
+	}
+	if diff := cmp.Diff(expected, got); diff != "" {
+		t.Errorf("%s: round trip changed the response: %s", description, diff)
+	}
+}
+
+func readFixture(t *testing.T, name string, v interface{}) (data []byte) {
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("unable to read fixture %s: %v", name, err)
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		t.Fatalf("unable to unmarshal fixture %s: %v", name, err)
+	}
+	return
+}
+
+func TestWeatherAPIResponseFixtures(t *testing.T) {
+	tests := []struct {
+		description string
+		fixture     string
+		check       func(res WeatherAPIResponse) bool
+	}{
+		{
+			description: "given rain, wind and precipitation are decoded",
+			fixture:     "current_rain.json",
+			check: func(res WeatherAPIResponse) bool {
+				return res.Wind == Wind{Speed: 0.62, Deg: 349, Gust: 1.18} &&
+					cmp.Equal(res.Rain, &Precipitation{OneHour: float(3.16)}) &&
+					res.Snow == nil &&
+					res.Main.Pressure == 1015 && res.Main.GrndLevel == 933 &&
+					res.Coordinates == Coordinates{Lon: 10.99, Lat: 44.34} &&
+					res.CityName == "Zocca" && res.DT == 1661870592
+			},
+		},
+		{
+			description: "given snow, both volumes are decoded",
+			fixture:     "current_snow.json",
+			check: func(res WeatherAPIResponse) bool {
+				return cmp.Equal(res.Snow, &Precipitation{OneHour: float(0.89), ThreeHours: float(2.1)}) &&
+					res.Rain == nil &&
+					len(res.WeatherResults) == 2 &&
+					res.Timezone == -25200
+			},
+		},
+		{
+			description: "given a clear sky, optional fields are left empty",
+			fixture:     "current_clear.json",
+			check: func(res WeatherAPIResponse) bool {
+				return res.Rain == nil && res.Snow == nil &&
+					res.Wind.Gust == 0 &&
+					res.Sys == Sys{Country: "AU", Sunrise: 1685565311, Sunset: 1685605911} &&
+					res.Clouds.All == 0
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		var res WeatherAPIResponse
+		data := readFixture(t, tt.fixture, &res)
+		if !tt.check(res) {
+			t.Errorf("%s: unexpected response %+v", tt.description, res)
+		}
+		roundTrip(t, tt.description, data, res)
+	}
+}
+
+func TestForecastResponseAt(t *testing.T) {
+	var forecast ForecastResponse
+	data := readFixture(t, "forecast.json", &forecast)
+	roundTrip(t, "forecast fixture", data, forecast)
+
+	tests := []struct {
+		description string
+		at          time.Time
+		expectedDT  int64
+		expectedOk  bool
+	}{
+		{
+			description: "given a time between forecasts, the closest is returned",
+			at:          time.Unix(1661882400+1000, 0),
+			expectedDT:  1661882400,
+			expectedOk:  true,
+		},
+		{
+			description: "given a time before the forecast, the first is returned",
+			at:          time.Unix(1661871600-7200, 0),
+			expectedDT:  1661871600,
+			expectedOk:  true,
+		},
+		{
+			description: "given a time after the forecast, nothing is returned",
+			at:          time.Unix(1661893200+4*3600, 0),
+		},
+	}
+
+	for _, tt := range tests {
+		res, ok := forecast.At(tt.at)
+		if ok != tt.expectedOk {
+			t.Errorf("%s: got ok %v, expected %v", tt.description, ok, tt.expectedOk)
+			continue
+		}
+		if ok && res.DT != tt.expectedDT {
+			t.Errorf("%s: got forecast for %d, expected %d", tt.description, res.DT, tt.expectedDT)
+		}
+	}
+
+	res, _ := forecast.At(time.Unix(1661871600, 0))
+	expected := WeatherAPIResponse{
+		Coordinates:    Coordinates{Lon: 10.99, Lat: 44.34},
+		WeatherResults: []Weather{{ID: 500, Main: "Rain", Description: "light rain", Icon: "10d"}},
+		Main:           Main{Temp: 296.76, FeelsLike: 296.98, TempMin: 296.76, TempMax: 297.87, Pressure: 1015, SeaLevel: 1015, GrndLevel: 933, Humidity: 69},
+		Visibility:     10000,
+		Wind:           Wind{Speed: 0.62, Deg: 349, Gust: 1.18},
+		Clouds:         Clouds{All: 100},
+		Rain:           &Precipitation{ThreeHours: float(0.26)},
+		DT:             1661871600,
+		Sys:            Sys{Country: "IT", Sunrise: 1661834187, Sunset: 1661882248},
+		Timezone:       7200,
+		CityID:         3163858,
+		CityName:       "Zocca",
+	}
+	if diff := cmp.Diff(expected, res); diff != "" {
+		t.Errorf("unexpected forecast response: %s", diff)
+	}
+}
+
+func TestTimeMachineResponseWeather(t *testing.T) {
+	var history TimeMachineResponse
+	data := readFixture(t, "timemachine.json", &history)
+	roundTrip(t, "timemachine fixture", data, history)
+
+	res, ok := history.Weather()
+	if !ok {
+		t.Fatal("expected historical weather")
+	}
+	expected := WeatherAPIResponse{
+		Coordinates:    Coordinates{Lon: 21.0122, Lat: 52.2297},
+		WeatherResults: []Weather{{ID: 800, Main: "Clear", Description: "clear sky", Icon: "01d"}},
+		Main:           Main{Temp: 279.13, FeelsLike: 276.44, Pressure: 1029, Humidity: 64},
+		Visibility:     10000,
+		Wind:           Wind{Speed: 3.6, Deg: 340},
+		DT:             1645888976,
+		Sys:            Sys{Sunrise: 1645853361, Sunset: 1645891727},
+		Timezone:       3600,
+	}
+	if diff := cmp.Diff(expected, res); diff != "" {
+		t.Errorf("unexpected historical response: %s", diff)
+	}
+	if _, ok = (TimeMachineResponse{}).Weather(); ok {
+		t.Error("expected no weather without data")
+	}
+}
+
+func TestWeatherAPIResponseObservation(t *testing.T) {
+	var res WeatherAPIResponse
+	readFixture(t, "current_rain.json", &res)
+	expected := Observation{
+		Provider:    OpenWeatherMap,
+		Time:        time.Unix(1661870592, 0).UTC(),
+		Coordinates: Coordinates{Lon: 10.99, Lat: 44.34},
+		Location:    Location{ID: 3163858, Name: "Zocca", Country: "IT"},
+		Conditions:  []Condition{{Code: 501, Main: "Rain", Description: "moderate rain", Icon: "10d"}},
+		Main:        Main{Temp: 298.48, FeelsLike: 298.74, TempMin: 297.56, TempMax: 300.05, Pressure: 1015, Humidity: 64, SeaLevel: 1015, GrndLevel: 933},
+		Visibility:  10000,
+		Wind:        Wind{Speed: 0.62, Deg: 349, Gust: 1.18},
+		Clouds:      100,
+		Rain:        &Precipitation{OneHour: float(3.16)},
+		Sunrise:     unixTime(1661834187),
+		Sunset:      unixTime(1661882248),
+		Timezone:    7200,
+	}
+	if diff := cmp.Diff(expected, res.Observation()); diff != "" {
+		t.Errorf("unexpected observation: %s", diff)
+	}
+}
@@ -0,0 +1,81 @@
+package weatherapi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mode is which kind of lookup the weather comes from.
+type Mode string
+
+const (
+	// ModeCurrent is the weather now.
+	ModeCurrent Mode = "current"
+	// ModeForecast is the forecast for a time in the future.
+	ModeForecast Mode = "forecast"
+	// ModeHistorical is the weather at a time in the past.
+	ModeHistorical Mode = "historical"
+)
+
+// Coverage is the range of times a provider has weather for.
+type Coverage struct {
+	// HistoryStart is the earliest time there's historical weather for.
+	HistoryStart time.Time
+	// ForecastRange is how far ahead the forecast goes.
+	ForecastRange time.Duration
+}
+
+// ModeAt returns the mode to use for the weather at a time, given the time now. A zero time is the
+// current weather.
+func (c Coverage) ModeAt(at, now time.Time) (m Mode, err error) {
+	switch {
+	case at.IsZero():
+		m = ModeCurrent
+	case at.Before(c.HistoryStart):
+		err = fmt.Errorf("%s is before historical weather starts on %s", at.Format(time.RFC3339), c.HistoryStart.Format("2006-01-02"))
+	case !at.After(now):
+		m = ModeHistorical
+	case at.After(now.Add(c.ForecastRange)):
+		err = fmt.Errorf("%s is beyond the %d day forecast", at.Format(time.RFC3339), c.ForecastRange/(24*time.Hour))
+	default:
+		m = ModeForecast
+	}
+	return
+}
+
+// timeLayouts are the formats accepted by ParseTime, times without a zone are taken to be UTC.
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+}
+
+// ParseTime parses an RFC 3339 timestamp, a date and time without a zone (taken to be UTC), unix
+// seconds, or a date on its own, which is taken to be midday UTC so the weather is from the middle
+// of the day wherever the coordinates are. An empty value is allowed, it means the current weather.
+func ParseTime(v string) (t time.Time, err error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return
+	}
+	if secs, parseErr := strconv.ParseInt(v, 10, 64); parseErr == nil {
+		t = time.Unix(secs, 0).UTC()
+		return
+	}
+	for _, layout := range timeLayouts {
+		if t, err = time.Parse(layout, v); err == nil {
+			t = t.UTC()
+			return
+		}
+	}
+	if t, err = time.Parse("2006-01-02", v); err == nil {
+		t = t.Add(12 * time.Hour)
+		return
+	}
+	err = fmt.Errorf("time %q isn't a timestamp or date, e.g. 2023-04-20T10:00:00Z or 2023-04-20", v)
+	return
+}
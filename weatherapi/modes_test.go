@@ -0,0 +1,101 @@
+package weatherapi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestModeAt(t *testing.T) {
+	now := time.Date(2023, 4, 20, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		description   string
+		at            time.Time
+		expected      Mode
+		expectedError bool
+	}{
+		{
+			description: "given no time, the current weather is used",
+			expected:    ModeCurrent,
+		},
+		{
+			description: "given a time in the past, historical weather is used",
+			at:          now.Add(-time.Hour),
+			expected:    ModeHistorical,
+		},
+		{
+			description: "given a time in the next 5 days, the forecast is used",
+			at:          now.Add(4 * 24 * time.Hour),
+			expected:    ModeForecast,
+		},
+		{
+			description:   "given a time beyond the forecast, an error is returned",
+			at:            now.Add(6 * 24 * time.Hour),
+			expectedError: true,
+		},
+		{
+			description:   "given a time before historical weather starts, an error is returned",
+			at:            time.Date(1970, 1, 2, 0, 0, 0, 0, time.UTC),
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		mode, err := OpenWeatherMapCoverage.ModeAt(tt.at, now)
+		if (err != nil) != tt.expectedError {
+			t.Errorf("%s: unexpected error: %v", tt.description, err)
+			continue
+		}
+		if mode != tt.expected {
+			t.Errorf("%s: got %q, expected %q", tt.description, mode, tt.expected)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		description   string
+		value         string
+		expected      time.Time
+		expectedError bool
+	}{
+		{
+			description: "given an RFC 3339 timestamp, it's converted to UTC",
+			value:       "2023-04-20T12:30:00+02:00",
+			expected:    time.Date(2023, 4, 20, 10, 30, 0, 0, time.UTC),
+		},
+		{
+			description: "given a time without a zone, it's taken to be UTC",
+			value:       " 2023-04-20 10:30 ",
+			expected:    time.Date(2023, 4, 20, 10, 30, 0, 0, time.UTC),
+		},
+		{
+			description: "given unix seconds, they're converted",
+			value:       "1681986600",
+			expected:    time.Date(2023, 4, 20, 10, 30, 0, 0, time.UTC),
+		},
+		{
+			description: "given a date, midday UTC is used",
+			value:       "2023-04-20",
+			expected:    time.Date(2023, 4, 20, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			description: "given an empty value, the time is zero",
+		},
+		{
+			description:   "given something else, an error is returned",
+			value:         "20/04/2023",
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseTime(tt.value)
+		if (err != nil) != tt.expectedError {
+			t.Errorf("%s: unexpected error: %v", tt.description, err)
+			continue
+		}
+		if !got.Equal(tt.expected) {
+			t.Errorf("%s: got %s, expected %s", tt.description, got, tt.expected)
+		}
+	}
+}
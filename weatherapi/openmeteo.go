@@ -0,0 +1,251 @@
+package weatherapi
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/joerdav/zapray"
+)
+
+const (
+	DefaultOpenMeteoURL        = "https://api.open-meteo.com/v1/forecast"
+	DefaultOpenMeteoArchiveURL = "https://archive-api.open-meteo.com/v1/archive"
+)
+
+// openMeteoVariables are the hourly (or current) variables requested from Open-Meteo.
+const openMeteoVariables = "temperature_2m,relative_humidity_2m,apparent_temperature,rain,showers,snowfall,weather_code,cloud_cover,pressure_msl,surface_pressure,wind_speed_10m,wind_direction_10m,wind_gusts_10m"
+
+// OpenMeteoClient is a Provider for Open-Meteo, see https://open-meteo.com/en/docs. It doesn't
+// support languages, descriptions are always in English. Like WeatherAPIClient it's safe for
+// concurrent use, as long as its fields aren't changed once requests are being made.
+type OpenMeteoClient struct {
+	Client *http.Client
+	// URL is the forecast endpoint, which also has the recent past.
+	URL *url.URL
+	// ArchiveURL is the historical weather endpoint, used for anything older than ArchiveAfter.
+	// The archive lags a few days behind, so recent weather has to come from URL.
+	ArchiveURL   *url.URL
+	ArchiveAfter time.Duration
+	Log          *zapray.Logger
+	Retry        RetryPolicy
+	// Limiter is optional, when set every attempt waits for it before calling the API.
+	Limiter Limiter
+	// Defaults are used for any options a request doesn't set.
+	Defaults Options
+}
+
+func NewOpenMeteoClient(baseUrl, archiveUrl string, log *zapray.Logger) (c OpenMeteoClient, err error) {
+	if c.URL, err = url.Parse(baseUrl); err != nil {
+		return
+	}
+	if c.ArchiveURL, err = url.Parse(archiveUrl); err != nil {
+		return
+	}
+	c.ArchiveAfter = 30 * 24 * time.Hour
+	c.Log = log
+	c.Client = &http.Client{
+		Timeout: 20 * time.Second,
+	}
+	c.Retry = DefaultRetryPolicy()
+	c.Defaults = DefaultOptions()
+	return
+}
+
+func (c *OpenMeteoClient) Name() ProviderName {
+	return OpenMeteo
+}
+
+// Observe returns the current weather, or when opts.At is set the hour closest to it.
+func (c *OpenMeteoClient) Observe(ctx context.Context, lon, lat string, opts Options) (o Observation, err error) {
+	opts = opts.WithDefaults(c.Defaults)
+	now := time.Now()
+	mode, err := OpenMeteoCoverage.ModeAt(opts.At, now)
+	if err != nil {
+		return
+	}
+	params := map[string]string{
+		"latitude":   lat,
+		"longitude":  lon,
+		"timezone":   "auto",
+		"timeformat": "unixtime",
+		"daily":      "sunrise,sunset",
+	}
+	// Open-Meteo doesn't do Kelvin, standard units are converted from Celsius.
+	params["temperature_unit"], params["wind_speed_unit"] = "celsius", "ms"
+	if opts.Units == UnitsImperial {
+		params["temperature_unit"], params["wind_speed_unit"] = "fahrenheit", "mph"
+	}
+	endpoint := c.URL
+	if mode == ModeCurrent {
+		params["current"] = openMeteoVariables
+		params["forecast_days"] = "1"
+	} else {
+		// dates are in the local time of the coordinates, which isn't known yet, so the days either
+		// side are included to be sure the hour is covered.
+		params["hourly"] = openMeteoVariables
+		params["start_date"] = opts.At.UTC().AddDate(0, 0, -1).Format("2006-01-02")
+		params["end_date"] = opts.At.UTC().AddDate(0, 0, 1).Format("2006-01-02")
+		if mode == ModeHistorical && opts.At.Before(now.Add(-c.ArchiveAfter)) {
+			endpoint = c.ArchiveURL
+		}
+	}
+	var res openMeteoResponse
+	if err = call(ctx, c.Client, c.Log, c.Retry, c.Limiter, withQuery(endpoint, params), &res); err != nil {
+		return
+	}
+	values, ok := res.hour(opts.At)
+	if !ok {
+		err = fmt.Errorf("no weather found for %s", opts.At.Format(time.RFC3339))
+		return
+	}
+	o = res.observation(values, opts.Units)
+	return
+}
+
+// openMeteoResponse is decoded with timeformat=unixtime, so every value is a number. Values are
+// null when there's no data for them.
+type openMeteoResponse struct {
+	Latitude         float64               `json:"latitude"`
+	Longitude        float64               `json:"longitude"`
+	UTCOffsetSeconds int64                 `json:"utc_offset_seconds"`
+	Current          map[string]*float64   `json:"current"`
+	Hourly           map[string][]*float64 `json:"hourly"`
+	Daily            map[string][]*float64 `json:"daily"`
+}
+
+// hour returns the variables for the hour closest to at, or the current ones when at is zero.
+func (r openMeteoResponse) hour(at time.Time) (values map[string]*float64, ok bool) {
+	if at.IsZero() {
+		return r.Current, r.Current != nil
+	}
+	closest := -1
+	for i, t := range r.Hourly["time"] {
+		if t == nil {
+			continue
+		}
+		if closest == -1 || abs(int64(*t)-at.Unix()) < abs(int64(*r.Hourly["time"][closest])-at.Unix()) {
+			closest = i
+		}
+	}
+	if closest == -1 {
+		return
+	}
+	values = make(map[string]*float64, len(r.Hourly))
+	for name, v := range r.Hourly {
+		if closest < len(v) {
+			values[name] = v[closest]
+		}
+	}
+	return values, true
+}
+
+func (r openMeteoResponse) observation(values map[string]*float64, units Units) (o Observation) {
+	value := func(name string) float64 {
+		if v := values[name]; v != nil {
+			return *v
+		}
+		return 0
+	}
+	temperature := func(name string) float64 {
+		if units == UnitsStandard {
+			return value(name) + 273.15
+		}
+		return value(name)
+	}
+	o.Provider = OpenMeteo
+	o.Time = time.Unix(int64(value("time")), 0).UTC()
+	o.Coordinates = Coordinates{Lon: r.Longitude, Lat: r.Latitude}
+	if values["weather_code"] != nil {
+		o.Conditions = []Condition{wmoCondition(int64(value("weather_code")))}
+	}
+	// there's no spread of temperatures across the area, so the minimum and maximum are the same.
+	temp := temperature("temperature_2m")
+	o.Main = Main{
+		Temp:      temp,
+		TempMin:   temp,
+		TempMax:   temp,
+		FeelsLike: temperature("apparent_temperature"),
+		Humidity:  round(value("relative_humidity_2m")),
+		Pressure:  round(value("pressure_msl")),
+		SeaLevel:  round(value("pressure_msl")),
+		GrndLevel: round(value("surface_pressure")),
+	}
+	o.Wind = Wind{
+		Speed: value("wind_speed_10m"),
+		Deg:   round(value("wind_direction_10m")),
+		Gust:  value("wind_gusts_10m"),
+	}
+	o.Clouds = round(value("cloud_cover"))
+	if rain := value("rain") + value("showers"); rain > 0 {
+		o.Rain = &Precipitation{OneHour: &rain}
+	}
+	// snowfall is in cm.
+	if snow := value("snowfall") * 10; snow > 0 {
+		o.Snow = &Precipitation{OneHour: &snow}
+	}
+	o.Timezone = r.UTCOffsetSeconds
+	days := r.Daily["time"]
+	for i := len(days) - 1; i >= 0; i-- {
+		if days[i] == nil || int64(*days[i]) > o.Time.Unix() {
+			continue
+		}
+		if sunrise := r.Daily["sunrise"]; i < len(sunrise) && sunrise[i] != nil {
+			o.Sunrise = unixTime(int64(*sunrise[i]))
+		}
+		if sunset := r.Daily["sunset"]; i < len(sunset) && sunset[i] != nil {
+			o.Sunset = unixTime(int64(*sunset[i]))
+		}
+		break
+	}
+	return
+}
+
+func round(v float64) int64 {
+	return int64(math.Round(v))
+}
+
+// wmoConditions describes the WMO weather codes used by Open-Meteo, grouped like OpenWeatherMap's
+// conditions.
+var wmoConditions = map[int64]Condition{
+	0:  {Main: "Clear", Description: "clear sky"},
+	1:  {Main: "Clouds", Description: "mainly clear"},
+	2:  {Main: "Clouds", Description: "partly cloudy"},
+	3:  {Main: "Clouds", Description: "overcast"},
+	45: {Main: "Fog", Description: "fog"},
+	48: {Main: "Fog", Description: "depositing rime fog"},
+	51: {Main: "Drizzle", Description: "light drizzle"},
+	53: {Main: "Drizzle", Description: "moderate drizzle"},
+	55: {Main: "Drizzle", Description: "dense drizzle"},
+	56: {Main: "Drizzle", Description: "light freezing drizzle"},
+	57: {Main: "Drizzle", Description: "dense freezing drizzle"},
+	61: {Main: "Rain", Description: "slight rain"},
+	63: {Main: "Rain", Description: "moderate rain"},
+	65: {Main: "Rain", Description: "heavy rain"},
+	66: {Main: "Rain", Description: "light freezing rain"},
+	67: {Main: "Rain", Description: "heavy freezing rain"},
+	71: {Main: "Snow", Description: "slight snow fall"},
+	73: {Main: "Snow", Description: "moderate snow fall"},
+	75: {Main: "Snow", Description: "heavy snow fall"},
+	77: {Main: "Snow", Description: "snow grains"},
+	80: {Main: "Rain", Description: "slight rain showers"},
+	81: {Main: "Rain", Description: "moderate rain showers"},
+	82: {Main: "Rain", Description: "violent rain showers"},
+	85: {Main: "Snow", Description: "slight snow showers"},
+	86: {Main: "Snow", Description: "heavy snow showers"},
+	95: {Main: "Thunderstorm", Description: "thunderstorm"},
+	96: {Main: "Thunderstorm", Description: "thunderstorm with slight hail"},
+	99: {Main: "Thunderstorm", Description: "thunderstorm with heavy hail"},
+}
+
+func wmoCondition(code int64) (c Condition) {
+	c, ok := wmoConditions[code]
+	if !ok {
+		c = Condition{Main: "Unknown", Description: fmt.Sprintf("weather code %d", code)}
+	}
+	c.Code = code
+	return
+}
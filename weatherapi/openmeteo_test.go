@@ -0,0 +1,131 @@
+package weatherapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/joerdav/zapray"
+)
+
+func TestOpenMeteoClientObserve(t *testing.T) {
+	tests := []struct {
+		description   string
+		opts          Options
+		expectedPath  string
+		expectedQuery map[string]string
+		expected      Observation
+		expectedError bool
+	}{
+		{
+			description:   "given no time, the current weather is returned",
+			opts:          Options{Units: UnitsMetric},
+			expectedPath:  "/forecast",
+			expectedQuery: map[string]string{"latitude": "2", "longitude": "1", "current": openMeteoVariables, "temperature_unit": "celsius", "wind_speed_unit": "ms"},
+			expected: Observation{
+				Provider:    OpenMeteo,
+				Time:        time.Unix(1681984800, 0).UTC(),
+				Coordinates: Coordinates{Lon: 13.419998, Lat: 52.52},
+				Conditions:  []Condition{{Code: 61, Main: "Rain", Description: "slight rain"}},
+				Main:        Main{Temp: 13.2, TempMin: 13.2, TempMax: 13.2, FeelsLike: 11.9, Humidity: 71, Pressure: 1012, SeaLevel: 1012, GrndLevel: 1008},
+				Wind:        Wind{Speed: 4.1, Deg: 239, Gust: 9.2},
+				Clouds:      88,
+				Rain:        &Precipitation{OneHour: float(0.3 + 0.1)},
+				Sunrise:     unixTime(1681962574),
+				Sunset:      unixTime(1682014066),
+				Timezone:    7200,
+			},
+		},
+		{
+			description:   "given an old time, the closest hour is returned from the archive in Kelvin",
+			opts:          Options{At: time.Unix(1685581200+600, 0)},
+			expectedPath:  "/archive",
+			expectedQuery: map[string]string{"hourly": openMeteoVariables, "start_date": "2023-05-31", "end_date": "2023-06-02", "temperature_unit": "celsius"},
+			expected: Observation{
+				Provider:    OpenMeteo,
+				Time:        time.Unix(1685581200, 0).UTC(),
+				Coordinates: Coordinates{Lon: 151.25, Lat: -33.875},
+				Conditions:  []Condition{{Code: 1, Main: "Clouds", Description: "mainly clear"}},
+				Main:        Main{Temp: 12.8 + 273.15, TempMin: 12.8 + 273.15, TempMax: 12.8 + 273.15, FeelsLike: 11.2 + 273.15, Humidity: 77, Pressure: 1022, SeaLevel: 1022, GrndLevel: 1020},
+				Wind:        Wind{Speed: 2.9, Deg: 275, Gust: 6.1},
+				Clouds:      12,
+				Sunrise:     unixTime(1685565438),
+				Sunset:      unixTime(1685601930),
+				Timezone:    36000,
+			},
+		},
+		{
+			description:   "given imperial units, they're requested",
+			opts:          Options{Units: UnitsImperial, Lang: "de"},
+			expectedPath:  "/forecast",
+			expectedQuery: map[string]string{"temperature_unit": "fahrenheit", "wind_speed_unit": "mph"},
+		},
+		{
+			description:   "given a time beyond the forecast, no request is made",
+			opts:          Options{At: time.Now().Add(20 * 24 * time.Hour)},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		var path string
+		var query url.Values
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path, query = r.URL.Path, r.URL.Query()
+			fixture := "openmeteo_current.json"
+			if query.Get("hourly") != "" {
+				fixture = "openmeteo_hourly.json"
+			}
+			data, err := os.ReadFile(filepath.Join("testdata", fixture))
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = w.Write(data)
+		}))
+		logger, err := zapray.NewDevelopment()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := NewOpenMeteoClient(server.URL+"/forecast", server.URL+"/archive", logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o, err := client.Observe(context.Background(), "1", "2", tt.opts)
+		server.Close()
+		if (err != nil) != tt.expectedError {
+			t.Errorf("%s: unexpected error: %v", tt.description, err)
+			continue
+		}
+		if path != tt.expectedPath {
+			t.Errorf("%s: got path %q, expected %q", tt.description, path, tt.expectedPath)
+		}
+		for k, v := range tt.expectedQuery {
+			if query.Get(k) != v {
+				t.Errorf("%s: got %s %q, expected %q", tt.description, k, query.Get(k), v)
+			}
+		}
+		if tt.expected.Provider == "" {
+			continue
+		}
+		if diff := cmp.Diff(tt.expected, o, cmpopts.EquateApprox(0, 1e-9)); diff != "" {
+			t.Errorf("%s: unexpected observation: %s", tt.description, diff)
+		}
+	}
+}
+
+func TestWMOCondition(t *testing.T) {
+	if c := wmoCondition(95); c != (Condition{Code: 95, Main: "Thunderstorm", Description: "thunderstorm"}) {
+		t.Errorf("unexpected condition %+v", c)
+	}
+	if c := wmoCondition(42); c != (Condition{Code: 42, Main: "Unknown", Description: "weather code 42"}) {
+		t.Errorf("unexpected condition %+v", c)
+	}
+}
@@ -0,0 +1,71 @@
+package weatherapi
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Units are the units of measurement the API responds in, see https://openweathermap.org/current#data.
+type Units string
+
+const (
+	// UnitsStandard is Kelvin and metres/second, the API's default.
+	UnitsStandard Units = "standard"
+	// UnitsMetric is Celsius and metres/second.
+	UnitsMetric Units = "metric"
+	// UnitsImperial is Fahrenheit and miles/hour.
+	UnitsImperial Units = "imperial"
+)
+
+// ParseUnits parses units case-insensitively. An empty value is allowed, it means the default.
+func ParseUnits(v string) (u Units, err error) {
+	u = Units(strings.ToLower(strings.TrimSpace(v)))
+	switch u {
+	case "", UnitsStandard, UnitsMetric, UnitsImperial:
+		return
+	}
+	err = fmt.Errorf("units %q aren't supported, expected %s, %s or %s", v, UnitsStandard, UnitsMetric, UnitsImperial)
+	return
+}
+
+// langPattern matches the language codes the API accepts, e.g. en, de or zh_cn.
+var langPattern = regexp.MustCompile(`^[a-z]{2}(_[a-z]{2})?$`)
+
+// ParseLang parses a language code case-insensitively. An empty value is allowed, it means the
+// default.
+func ParseLang(v string) (lang string, err error) {
+	lang = strings.ToLower(strings.TrimSpace(v))
+	if lang != "" && !langPattern.MatchString(lang) {
+		err = fmt.Errorf("language %q isn't a valid language code, e.g. en or pt_br", v)
+	}
+	return
+}
+
+// Options change how the weather is returned. Empty fields take the value of the defaults.
+type Options struct {
+	Units Units
+	// Lang is the language of the weather descriptions.
+	Lang string
+	// At is when to get the weather for, either in the past or in the provider's forecast range.
+	// When it's zero the current weather is returned. It's never taken from the defaults.
+	At time.Time
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Units: UnitsStandard,
+	}
+}
+
+// WithDefaults returns o with any empty fields taken from d.
+func (o Options) WithDefaults(d Options) Options {
+	if o.Units == "" {
+		o.Units = d.Units
+	}
+	if o.Lang == "" {
+		o.Lang = d.Lang
+	}
+	return o
+}
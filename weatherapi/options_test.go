@@ -0,0 +1,45 @@
+package weatherapi
+
+import "testing"
+
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		description   string
+		units         string
+		lang          string
+		expected      Options
+		expectedError bool
+	}{
+		{
+			description: "given values in any case, they're normalised",
+			units:       " Metric ",
+			lang:        "PT_BR",
+			expected:    Options{Units: UnitsMetric, Lang: "pt_br"},
+		},
+		{
+			description: "given empty values, the options are empty",
+		},
+		{
+			description:   "given unknown units, an error is returned",
+			units:         "kelvin",
+			expectedError: true,
+		},
+		{
+			description:   "given an invalid language code, an error is returned",
+			lang:          "english",
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		units, unitsErr := ParseUnits(tt.units)
+		lang, langErr := ParseLang(tt.lang)
+		if gotError := unitsErr != nil || langErr != nil; gotError != tt.expectedError {
+			t.Errorf("%s: got errors %v and %v", tt.description, unitsErr, langErr)
+			continue
+		}
+		if got := (Options{Units: units, Lang: lang}); !tt.expectedError && got != tt.expected {
+			t.Errorf("%s: got %+v, expected %+v", tt.description, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package weatherapi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Provider is a source of weather, returning it as an Observation whatever the shape of the
+// provider's own API.
+type Provider interface {
+	Name() ProviderName
+	Observe(ctx context.Context, lon, lat string, opts Options) (Observation, error)
+}
+
+// ProviderName identifies a weather provider.
+type ProviderName string
+
+const (
+	// OpenWeatherMap is https://openweathermap.org, it needs an API key.
+	OpenWeatherMap ProviderName = "openweathermap"
+	// OpenMeteo is https://open-meteo.com, it doesn't need an API key.
+	OpenMeteo ProviderName = "open-meteo"
+)
+
+var (
+	OpenWeatherMapCoverage = Coverage{
+		HistoryStart:  time.Date(1979, 1, 1, 0, 0, 0, 0, time.UTC),
+		ForecastRange: 5 * 24 * time.Hour,
+	}
+	OpenMeteoCoverage = Coverage{
+		HistoryStart:  time.Date(1940, 1, 1, 0, 0, 0, 0, time.UTC),
+		ForecastRange: 16 * 24 * time.Hour,
+	}
+)
+
+// ParseProvider parses a provider name case-insensitively. An empty value is OpenWeatherMap.
+func ParseProvider(v string) (p ProviderName, err error) {
+	p = ProviderName(strings.ToLower(strings.TrimSpace(v)))
+	switch p {
+	case "":
+		p = OpenWeatherMap
+	case OpenWeatherMap, OpenMeteo:
+	default:
+		err = fmt.Errorf("weather provider %q isn't supported, expected %s or %s", v, OpenWeatherMap, OpenMeteo)
+	}
+	return
+}
+
+// ParseProviders parses a comma separated list of providers, in the order they should be tried. An
+// empty value is OpenWeatherMap on its own.
+func ParseProviders(v string) (providers []ProviderName, err error) {
+	seen := make(map[ProviderName]bool)
+	for _, name := range strings.Split(v, ",") {
+		var p ProviderName
+		if p, err = ParseProvider(name); err != nil {
+			return
+		}
+		if seen[p] {
+			err = fmt.Errorf("weather provider %q is listed more than once", p)
+			return
+		}
+		seen[p] = true
+		providers = append(providers, p)
+	}
+	return
+}
+
+// Coverage returns the range of times the provider has weather for.
+func (p ProviderName) Coverage() Coverage {
+	if p == OpenMeteo {
+		return OpenMeteoCoverage
+	}
+	return OpenWeatherMapCoverage
+}
+
+// Observation is the weather at a place and time, independent of the provider it came from.
+// Measurements are in the units it was requested in, except precipitation which is always in mm.
+type Observation struct {
+	Provider ProviderName `json:"provider"`
+	// Time is when the weather is for: when it was calculated for the current weather, or the start
+	// of the period for a forecast or historical weather.
+	Time        time.Time   `json:"time"`
+	Coordinates Coordinates `json:"coord"`
+	// Location is what the provider knows about the place, if anything.
+	Location   Location    `json:"location"`
+	Conditions []Condition `json:"conditions"`
+	Main       Main        `json:"main"`
+	// Visibility is in metres, it's 0 when the provider doesn't report it.
+	Visibility int64 `json:"visibility"`
+	Wind       Wind  `json:"wind"`
+	// Clouds is the cloud cover as a percentage.
+	Clouds int64          `json:"clouds"`
+	Rain   *Precipitation `json:"rain,omitempty"`
+	Snow   *Precipitation `json:"snow,omitempty"`
+	// Sunrise and Sunset are on the day of Time, when the provider reports them.
+	Sunrise *time.Time `json:"sunrise,omitempty"`
+	Sunset  *time.Time `json:"sunset,omitempty"`
+	// Timezone is the shift from UTC in seconds.
+	Timezone int64 `json:"timezone"`
+}
+
+type Location struct {
+	ID      int64  `json:"id,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Country string `json:"country,omitempty"`
+}
+
+// Condition describes the weather, e.g. Rain and "light rain". Code is the provider's own code for
+// it, an OpenWeatherMap condition id or a WMO weather code for Open-Meteo.
+type Condition struct {
+	Code        int64  `json:"code"`
+	Main        string `json:"main"`
+	Description string `json:"description"`
+	Icon        string `json:"icon,omitempty"`
+}
+
+// unixTime converts unix seconds to a time, leaving 0 as no time.
+func unixTime(seconds int64) *time.Time {
+	if seconds == 0 {
+		return nil
+	}
+	t := time.Unix(seconds, 0).UTC()
+	return &t
+}
+
+// WidestCoverage returns the range of times covered by any of the providers.
+func WidestCoverage(providers []ProviderName) (c Coverage) {
+	for i, p := range providers {
+		pc := p.Coverage()
+		if i == 0 || pc.HistoryStart.Before(c.HistoryStart) {
+			c.HistoryStart = pc.HistoryStart
+		}
+		if pc.ForecastRange > c.ForecastRange {
+			c.ForecastRange = pc.ForecastRange
+		}
+	}
+	return
+}
@@ -0,0 +1,56 @@
+package weatherapi
+
+import "testing"
+
+func TestParseProvider(t *testing.T) {
+	tests := []struct {
+		description   string
+		value         string
+		expected      ProviderName
+		expectedError bool
+	}{
+		{
+			description: "given no provider, OpenWeatherMap is used",
+			expected:    OpenWeatherMap,
+		},
+		{
+			description: "given a provider in any case, it's normalised",
+			value:       " Open-Meteo ",
+			expected:    OpenMeteo,
+		},
+		{
+			description:   "given an unknown provider, an error is returned",
+			value:         "metoffice",
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		p, err := ParseProvider(tt.value)
+		if (err != nil) != tt.expectedError {
+			t.Errorf("%s: unexpected error: %v", tt.description, err)
+		}
+		if err != nil {
+			continue
+		}
+		if p != tt.expected {
+			t.Errorf("%s: got %q, expected %q", tt.description, p, tt.expected)
+		}
+	}
+	if OpenMeteo.Coverage() != OpenMeteoCoverage || OpenWeatherMap.Coverage() != OpenWeatherMapCoverage {
+		t.Error("unexpected provider coverage")
+	}
+}
+
+func TestParseProviders(t *testing.T) {
+	providers, err := ParseProviders("openweathermap, Open-Meteo")
+	if err != nil || len(providers) != 2 || providers[0] != OpenWeatherMap || providers[1] != OpenMeteo {
+		t.Errorf("got %v, %v", providers, err)
+	}
+	if _, err = ParseProviders("open-meteo,open-meteo"); err == nil {
+		t.Error("expected an error for a repeated provider")
+	}
+	if c := WidestCoverage(providers); c.HistoryStart != OpenMeteoCoverage.HistoryStart || c.ForecastRange != OpenMeteoCoverage.ForecastRange {
+		t.Errorf("unexpected coverage %+v", c)
+	}
+}
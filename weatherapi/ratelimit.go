@@ -0,0 +1,148 @@
+package weatherapi
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned when a call can't be made within the rate limit before the context
+// deadline.
+var ErrRateLimited = errors.New("rate limit would be exceeded before the context deadline")
+
+// Limiter blocks until a call to the API is allowed.
+type Limiter interface {
+	Wait(ctx context.Context) error
+}
+
+// TokenBucket limits calls made by this process. Tokens refill at a steady rate up to the burst
+// size, and each call takes one. It's safe for concurrent use.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(callsPerMinute, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate:   float64(callsPerMinute) / 60,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *TokenBucket) Wait(ctx context.Context) (err error) {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	// the token is taken up front, so concurrent callers queue up behind each other.
+	b.tokens--
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if wait == 0 {
+		return
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+		err = ErrRateLimited
+	} else {
+		err = sleep(ctx, wait)
+	}
+	if err != nil {
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+	}
+	return
+}
+
+// LimiterBackend is a counter store shared between processes, e.g. Lambda invocations, so they can
+// share a rate limit.
+type LimiterBackend interface {
+	// Increment adds one to the counter stored under key, creating it if needed, and returns the new
+	// count. The counter isn't needed after expiresAt.
+	Increment(ctx context.Context, key string, expiresAt time.Time) (count int, err error)
+}
+
+// SharedLimiter allows Limit calls per Window across everything using the same backend and name,
+// counting calls in fixed windows.
+type SharedLimiter struct {
+	Backend LimiterBackend
+	Name    string
+	Limit   int
+	Window  time.Duration
+}
+
+func NewSharedLimiter(backend LimiterBackend, name string, callsPerMinute int) (l SharedLimiter) {
+	l.Backend = backend
+	l.Name = name
+	l.Limit = callsPerMinute
+	l.Window = time.Minute
+	return
+}
+
+func (l SharedLimiter) Wait(ctx context.Context) (err error) {
+	for {
+		window := time.Now().Truncate(l.Window)
+		next := window.Add(l.Window)
+		count, err := l.Backend.Increment(ctx, l.Name+"#"+window.UTC().Format(time.RFC3339), next)
+		if err != nil {
+			return err
+		}
+		if count <= l.Limit {
+			return nil
+		}
+		wait := time.Until(next)
+		if deadline, ok := ctx.Deadline(); ok && deadline.Before(next) {
+			return ErrRateLimited
+		}
+		if err = sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// MemoryLimiterBackend is a LimiterBackend for tests and local runs. It's safe for concurrent use.
+type MemoryLimiterBackend struct {
+	mu       sync.Mutex
+	counters map[string]memoryCounter
+}
+
+type memoryCounter struct {
+	count     int
+	expiresAt time.Time
+}
+
+func NewMemoryLimiterBackend() *MemoryLimiterBackend {
+	return &MemoryLimiterBackend{
+		counters: make(map[string]memoryCounter),
+	}
+}
+
+func (m *MemoryLimiterBackend) Increment(ctx context.Context, key string, expiresAt time.Time) (count int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for k, c := range m.counters {
+		if now.After(c.expiresAt) {
+			delete(m.counters, k)
+		}
+	}
+	c := m.counters[key]
+	c.count++
+	c.expiresAt = expiresAt
+	m.counters[key] = c
+	count = c.count
+	return
+}
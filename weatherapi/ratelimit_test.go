@@ -0,0 +1,73 @@
+package weatherapi
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	// 6000 calls a minute is a token every 10ms.
+	b := NewTokenBucket(6000, 2)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := b.Wait(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// the burst is free, the remaining two calls wait for a token each.
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("expected calls beyond the burst to wait, took %v", elapsed)
+	}
+
+	b = NewTokenBucket(1, 1)
+	if err := b.Wait(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := b.Wait(ctx); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("expected ErrRateLimited, got %v", err)
+	}
+}
+
+func TestSharedLimiter(t *testing.T) {
+	backend := NewMemoryLimiterBackend()
+	l := NewSharedLimiter(backend, "weatherapi", 2)
+	l.Window = time.Hour
+	// another limiter using the same backend shares the limit.
+	other := NewSharedLimiter(backend, "weatherapi", 2)
+	other.Window = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := other.Wait(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := l.Wait(ctx); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("expected ErrRateLimited, got %v", err)
+	}
+}
+
+func TestGetWeatherForLatLongRateLimited(t *testing.T) {
+	server := buildHttpTestServer(200, marshalResponse(t, buildGoodWeatherResponse()))
+	defer server.Close()
+	client, err := buildWeatherApiClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Limiter = NewTokenBucket(1, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := client.GetWeatherForLatLong(ctx, "1", "2", Options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := client.GetWeatherForLatLong(ctx, "1", "2", Options{}); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("expected ErrRateLimited, got %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package weathercache
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/antonielabuschagne/data-loader/weatherapi"
+	"github.com/joerdav/zapray"
+	"go.uber.org/zap"
+)
+
+// DefaultTTL is how long the weather is cached for unless the Cache says otherwise.
+const DefaultTTL = time.Hour
+
+// Backend stores cached observations by key. Observations past their TTL must not be returned.
+type Backend interface {
+	// Get returns the observation stored under key, ok is false when there's none.
+	Get(ctx context.Context, key string) (o weatherapi.Observation, ok bool, err error)
+	Set(ctx context.Context, key string, o weatherapi.Observation, ttl time.Duration) error
+}
+
+// Stats are the lookups made through a Cache since it was created.
+type Stats struct {
+	Hits   int64
+	Misses int64
+	// Errors are lookups or stores the backend failed, a failed lookup is also counted as a miss.
+	Errors int64
+}
+
+// Cache sits in front of a weather provider, so rows with the same, or nearby, coordinates only
+// call it once per TTL. Coordinates are rounded to the grid to look up the weather, and the weather
+// of the first coordinates fetched in a grid cell is used for the whole cell. It's safe for
+// concurrent use, as long as the backend is.
+type Cache struct {
+	Log     *zapray.Logger
+	Fetch   weatherapi.ObserveFunc
+	Backend Backend
+	// Grid is the size of a grid cell in decimal degrees, e.g. 0.01 is around 1km at the equator.
+	// With no grid only identical coordinates share the weather.
+	Grid float64
+	TTL  time.Duration
+
+	hits   atomic.Int64
+	misses atomic.Int64
+	errors atomic.Int64
+}
+
+func NewCache(log *zapray.Logger, fetch weatherapi.ObserveFunc, backend Backend) *Cache {
+	return &Cache{
+		Log:     log,
+		Fetch:   fetch,
+		Backend: backend,
+		TTL:     DefaultTTL,
+	}
+}
+
+// Observe returns the cached weather for the coordinates' grid cell, or fetches and caches it. A
+// failing backend doesn't fail the lookup, the weather is fetched instead.
+func (c *Cache) Observe(ctx context.Context, lon, lat string, opts weatherapi.Options) (o weatherapi.Observation, err error) {
+	key, err := c.Key(lon, lat, opts)
+	if err != nil {
+		// the provider gets to reject coordinates it can't use.
+		return c.Fetch(ctx, lon, lat, opts)
+	}
+	o, ok, err := c.Backend.Get(ctx, key)
+	if err != nil {
+		c.errors.Add(1)
+		c.Log.Warn("unable to read the weather cache", zap.String("error", err.Error()), zap.String("key", key))
+	}
+	if ok && err == nil {
+		c.hits.Add(1)
+		return
+	}
+	c.misses.Add(1)
+	o, err = c.Fetch(ctx, lon, lat, opts)
+	if err != nil {
+		return
+	}
+	if setErr := c.Backend.Set(ctx, key, o, c.TTL); setErr != nil {
+		c.errors.Add(1)
+		c.Log.Warn("unable to write the weather cache", zap.String("error", setErr.Error()), zap.String("key", key))
+	}
+	return
+}
+
+// Key is what the weather for the coordinates and options is cached under.
+func (c *Cache) Key(lon, lat string, opts weatherapi.Options) (key string, err error) {
+	lonCell, err := c.cell(lon)
+	if err != nil {
+		return
+	}
+	latCell, err := c.cell(lat)
+	if err != nil {
+		return
+	}
+	at := "now"
+	if !opts.At.IsZero() {
+		at = strconv.FormatInt(opts.At.Unix(), 10)
+	}
+	key = fmt.Sprintf("%s,%s|%s|%s|%s", lonCell, latCell, opts.Units, opts.Lang, at)
+	return
+}
+
+// cell is the grid cell a coordinate falls in, as the number of cells from 0 along with the grid
+// size, so the same cell has the same name however the coordinate was written.
+func (c *Cache) cell(coordinate string) (cell string, err error) {
+	v, err := strconv.ParseFloat(coordinate, 64)
+	if err != nil {
+		return
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		err = fmt.Errorf("invalid coordinate %q", coordinate)
+		return
+	}
+	if c.Grid <= 0 {
+		cell = strconv.FormatFloat(v, 'f', -1, 64)
+		return
+	}
+	cell = fmt.Sprintf("%d@%g", int64(math.Round(v/c.Grid)), c.Grid)
+	return
+}
+
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+		Errors: c.errors.Load(),
+	}
+}
@@ -0,0 +1,220 @@
+package weathercache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/antonielabuschagne/data-loader/weatherapi"
+	"github.com/joerdav/zapray"
+)
+
+// fakeBackend is a Backend held in a map, which can be made to fail.
+type fakeBackend struct {
+	items  map[string]weatherapi.Observation
+	ttls   map[string]time.Duration
+	getErr error
+	setErr error
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		items: make(map[string]weatherapi.Observation),
+		ttls:  make(map[string]time.Duration),
+	}
+}
+
+func (b *fakeBackend) Get(ctx context.Context, key string) (o weatherapi.Observation, ok bool, err error) {
+	if b.getErr != nil {
+		err = b.getErr
+		return
+	}
+	o, ok = b.items[key]
+	return
+}
+
+func (b *fakeBackend) Set(ctx context.Context, key string, o weatherapi.Observation, ttl time.Duration) error {
+	if b.setErr != nil {
+		return b.setErr
+	}
+	b.items[key] = o
+	b.ttls[key] = ttl
+	return nil
+}
+
+type lookup struct {
+	lon, lat string
+	opts     weatherapi.Options
+}
+
+func TestCacheObserve(t *testing.T) {
+	logger, err := zapray.NewDevelopment()
+	if err != nil {
+		t.Fatal("unable to create logger")
+	}
+	at := time.Date(2023, 4, 20, 10, 0, 0, 0, time.UTC)
+	metric := weatherapi.Options{Units: weatherapi.UnitsMetric}
+	tests := []struct {
+		description   string
+		grid          float64
+		lookups       []lookup
+		getErr        error
+		setErr        error
+		fetchErr      error
+		expectedCalls int
+		expectedStats Stats
+		expectedError bool
+	}{
+		{
+			description:   "given the same coordinates twice, the provider is called once",
+			lookups:       []lookup{{lon: "10.99", lat: "44.34"}, {lon: "10.99", lat: "44.34"}},
+			expectedCalls: 1,
+			expectedStats: Stats{Hits: 1, Misses: 1},
+		},
+		{
+			description:   "given the same coordinates written differently, the provider is called once",
+			lookups:       []lookup{{lon: "10.99", lat: "44.34"}, {lon: "10.9900", lat: "44.340"}},
+			expectedCalls: 1,
+			expectedStats: Stats{Hits: 1, Misses: 1},
+		},
+		{
+			description:   "given nearby coordinates and no grid, the provider is called for each",
+			lookups:       []lookup{{lon: "10.991", lat: "44.341"}, {lon: "10.992", lat: "44.342"}},
+			expectedCalls: 2,
+			expectedStats: Stats{Misses: 2},
+		},
+		{
+			description:   "given nearby coordinates in the same grid cell, the provider is called once",
+			grid:          0.01,
+			lookups:       []lookup{{lon: "10.991", lat: "44.341"}, {lon: "10.992", lat: "44.342"}},
+			expectedCalls: 1,
+			expectedStats: Stats{Hits: 1, Misses: 1},
+		},
+		{
+			description:   "given coordinates in neighbouring grid cells, the provider is called for each",
+			grid:          0.01,
+			lookups:       []lookup{{lon: "10.991", lat: "44.341"}, {lon: "10.999", lat: "44.341"}},
+			expectedCalls: 2,
+			expectedStats: Stats{Misses: 2},
+		},
+		{
+			description:   "given different units, the provider is called for each",
+			lookups:       []lookup{{lon: "10.99", lat: "44.34"}, {lon: "10.99", lat: "44.34", opts: metric}},
+			expectedCalls: 2,
+			expectedStats: Stats{Misses: 2},
+		},
+		{
+			description:   "given a time and the current weather, the provider is called for each",
+			lookups:       []lookup{{lon: "10.99", lat: "44.34"}, {lon: "10.99", lat: "44.34", opts: weatherapi.Options{At: at}}},
+			expectedCalls: 2,
+			expectedStats: Stats{Misses: 2},
+		},
+		{
+			description:   "given coordinates that aren't numbers, they're passed to the provider uncached",
+			lookups:       []lookup{{lon: "east", lat: "44.34"}, {lon: "east", lat: "44.34"}},
+			expectedCalls: 2,
+		},
+		{
+			description:   "given the backend can't be read, the weather is fetched",
+			lookups:       []lookup{{lon: "10.99", lat: "44.34"}, {lon: "10.99", lat: "44.34"}},
+			getErr:        errors.New("throttled"),
+			expectedCalls: 2,
+			expectedStats: Stats{Misses: 2, Errors: 2},
+		},
+		{
+			description:   "given the backend can't be written, the weather is still returned",
+			lookups:       []lookup{{lon: "10.99", lat: "44.34"}},
+			setErr:        errors.New("throttled"),
+			expectedCalls: 1,
+			expectedStats: Stats{Misses: 1, Errors: 1},
+		},
+		{
+			description:   "given the provider fails, nothing is cached",
+			lookups:       []lookup{{lon: "10.99", lat: "44.34"}, {lon: "10.99", lat: "44.34"}},
+			fetchErr:      errors.New("unavailable"),
+			expectedCalls: 2,
+			expectedStats: Stats{Misses: 2},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		backend := newFakeBackend()
+		backend.getErr = tt.getErr
+		backend.setErr = tt.setErr
+		var calls int
+		fetch := func(ctx context.Context, lon, lat string, opts weatherapi.Options) (o weatherapi.Observation, err error) {
+			calls++
+			if tt.fetchErr != nil {
+				err = tt.fetchErr
+				return
+			}
+			o.Provider = weatherapi.OpenWeatherMap
+			o.Location.Name = lon + "," + lat
+			return
+		}
+		c := NewCache(logger, fetch, backend)
+		c.Grid = tt.grid
+		var first weatherapi.Observation
+		for i, l := range tt.lookups {
+			o, err := c.Observe(context.Background(), l.lon, l.lat, l.opts)
+			if (err != nil) != tt.expectedError {
+				t.Errorf("%s: unexpected error %v", tt.description, err)
+			}
+			if i == 0 {
+				first = o
+			} else if tt.expectedCalls == 1 && o.Location != first.Location {
+				t.Errorf("%s: got weather for %q, expected the cached weather for %q", tt.description, o.Location.Name, first.Location.Name)
+			}
+		}
+		if calls != tt.expectedCalls {
+			t.Errorf("%s: got %d provider calls, expected %d", tt.description, calls, tt.expectedCalls)
+		}
+		if got := c.Stats(); got != tt.expectedStats {
+			t.Errorf("%s: got stats %+v, expected %+v", tt.description, got, tt.expectedStats)
+		}
+		for key, ttl := range backend.ttls {
+			if ttl != DefaultTTL {
+				t.Errorf("%s: %s cached for %v, expected %v", tt.description, key, ttl, DefaultTTL)
+			}
+		}
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	c := NewCache(nil, nil, nil)
+	c.Grid = 0.25
+	tests := []struct {
+		description string
+		lon, lat    string
+		expected    string
+	}{
+		{
+			description: "given coordinates, they're rounded to the nearest cell",
+			lon:         "10.13",
+			lat:         "-44.9",
+			expected:    "41@0.25,-180@0.25|||now",
+		},
+		{
+			description: "given coordinates on the edge of a cell, they're rounded away from zero",
+			lon:         "0.125",
+			lat:         "-0.125",
+			expected:    "1@0.25,-1@0.25|||now",
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := c.Key(tt.lon, tt.lat, weatherapi.Options{})
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.description, err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("%s: got key %q, expected %q", tt.description, got, tt.expected)
+		}
+	}
+	if _, err := c.Key("NaN", "44.34", weatherapi.Options{}); err == nil {
+		t.Error("expected an error for a coordinate that isn't a number")
+	}
+}
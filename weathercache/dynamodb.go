@@ -0,0 +1,68 @@
+package weathercache
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/antonielabuschagne/data-loader/weatherapi"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoDBBackend keeps cached observations in a DynamoDB table with a string partition key "pk"
+// and TTL attribute "expires_at", so they're shared by every instance of the message handler.
+// DynamoDB can take a while to delete expired items, so they're checked on the way out too.
+type DynamoDBBackend struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoDBBackend(cfg aws.Config, tableName string) (b DynamoDBBackend) {
+	b.client = dynamodb.NewFromConfig(cfg)
+	b.tableName = tableName
+	return
+}
+
+func (d DynamoDBBackend) Get(ctx context.Context, key string) (o weatherapi.Observation, ok bool, err error) {
+	res, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(d.tableName),
+		Key: map[string]types.AttributeValue{
+			"pk": &types.AttributeValueMemberS{Value: key},
+		},
+	})
+	if err != nil {
+		return
+	}
+	expiresAt, isNumber := res.Item["expires_at"].(*types.AttributeValueMemberN)
+	observation, isString := res.Item["observation"].(*types.AttributeValueMemberS)
+	if !isNumber || !isString {
+		return
+	}
+	if seconds, parseErr := strconv.ParseInt(expiresAt.Value, 10, 64); parseErr != nil || time.Now().Unix() >= seconds {
+		return
+	}
+	if err = json.Unmarshal([]byte(observation.Value), &o); err != nil {
+		return
+	}
+	ok = true
+	return
+}
+
+func (d DynamoDBBackend) Set(ctx context.Context, key string, o weatherapi.Observation, ttl time.Duration) (err error) {
+	observation, err := json.Marshal(o)
+	if err != nil {
+		return
+	}
+	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.tableName),
+		Item: map[string]types.AttributeValue{
+			"pk":          &types.AttributeValueMemberS{Value: key},
+			"observation": &types.AttributeValueMemberS{Value: string(observation)},
+			"expires_at":  &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)},
+		},
+	})
+	return
+}
@@ -0,0 +1,84 @@
+package weathercache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/antonielabuschagne/data-loader/weatherapi"
+)
+
+// LRU is a Backend held in memory, so it lasts as long as a warm Lambda function. Once it's full
+// the least recently used observation is dropped to make room. It's safe for concurrent use.
+type LRU struct {
+	// Size is the most observations held.
+	Size int
+
+	mu    sync.Mutex
+	items *list.List
+	index map[string]*list.Element
+	now   func() time.Time
+}
+
+type lruEntry struct {
+	key         string
+	observation weatherapi.Observation
+	expiresAt   time.Time
+}
+
+func NewLRU(size int) *LRU {
+	return &LRU{
+		Size:  size,
+		items: list.New(),
+		index: make(map[string]*list.Element),
+		now:   time.Now,
+	}
+}
+
+func (l *LRU) Get(ctx context.Context, key string) (o weatherapi.Observation, ok bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.index[key]
+	if !ok {
+		return
+	}
+	entry := e.Value.(*lruEntry)
+	if !l.now().Before(entry.expiresAt) {
+		l.remove(e)
+		ok = false
+		return
+	}
+	l.items.MoveToFront(e)
+	o = entry.observation
+	return
+}
+
+func (l *LRU) Set(ctx context.Context, key string, o weatherapi.Observation, ttl time.Duration) (err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry := &lruEntry{key: key, observation: o, expiresAt: l.now().Add(ttl)}
+	if e, ok := l.index[key]; ok {
+		e.Value = entry
+		l.items.MoveToFront(e)
+		return
+	}
+	l.index[key] = l.items.PushFront(entry)
+	for l.items.Len() > l.Size && l.items.Len() > 0 {
+		l.remove(l.items.Back())
+	}
+	return
+}
+
+// Len is the number of observations held, including any that have expired but not been looked up
+// since.
+func (l *LRU) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.items.Len()
+}
+
+func (l *LRU) remove(e *list.Element) {
+	l.items.Remove(e)
+	delete(l.index, e.Value.(*lruEntry).key)
+}
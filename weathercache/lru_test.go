@@ -0,0 +1,51 @@
+package weathercache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/antonielabuschagne/data-loader/weatherapi"
+)
+
+func TestLRU(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 4, 20, 10, 0, 0, 0, time.UTC)
+	l := NewLRU(2)
+	l.now = func() time.Time { return now }
+	observation := func(name string) (o weatherapi.Observation) {
+		o.Location.Name = name
+		return
+	}
+
+	expectCached := func(description, key string, expected bool) {
+		o, ok, err := l.Get(ctx, key)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", description, err)
+		}
+		if ok != expected {
+			t.Errorf("%s: got cached %v for %s, expected %v", description, ok, key, expected)
+		}
+		if ok && o.Location.Name != key {
+			t.Errorf("%s: got %q for %s", description, o.Location.Name, key)
+		}
+	}
+
+	l.Set(ctx, "a", observation("a"), time.Minute)
+	l.Set(ctx, "b", observation("b"), time.Minute)
+	expectCached("given an observation was set, it's returned", "a", true)
+	l.Set(ctx, "c", observation("c"), time.Minute)
+	expectCached("given the LRU is full, the least recently used is dropped", "b", false)
+	expectCached("given the LRU is full, the recently used are kept", "a", true)
+	expectCached("given the LRU is full, the newest is kept", "c", true)
+	l.Set(ctx, "c", observation("c"), 2*time.Minute)
+	if l.Len() != 2 {
+		t.Errorf("given an observation is set again, got %d observations, expected 2", l.Len())
+	}
+	now = now.Add(time.Minute)
+	expectCached("given the TTL has passed, the observation has expired", "a", false)
+	expectCached("given the TTL was extended, the observation is returned", "c", true)
+	if l.Len() != 1 {
+		t.Errorf("given an observation expired, got %d observations, expected 1", l.Len())
+	}
+}